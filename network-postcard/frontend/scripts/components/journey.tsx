@@ -28,6 +28,7 @@ interface JourneyState {
     image?: string;
     intermediate?: string;
     steps: number;
+    done: boolean;
     time: string;
     preparing: boolean;
     stops: Array<{ name: string, time: string }>;
@@ -37,6 +38,7 @@ export class Journey extends React.Component<RouteComponentProps, JourneyState>
 
     state: JourneyState = {
         steps: 0,
+        done: false,
         time: "0:00",
         stops: [],
         preparing: true,
@@ -67,7 +69,7 @@ export class Journey extends React.Component<RouteComponentProps, JourneyState>
 
             this.setState( {  time: delta.toFixed( 2 ) } );
 
-            if ( this.state.steps < 8 ) {
+            if ( ! this.state.done ) {
                 requestAnimationFrame( timer );
             } else {
                 setTime( delta );
@@ -90,7 +92,7 @@ export class Journey extends React.Component<RouteComponentProps, JourneyState>
                 this.map.scrollRight();
             }
 
-            this.setState( { steps: hop.step, intermediate: hop.image} );
+            this.setState( { steps: hop.step, done: hop.done, intermediate: hop.image} );
             this.extendList( hop.step );
         } );
     }
@@ -141,7 +143,7 @@ export class Journey extends React.Component<RouteComponentProps, JourneyState>
     private extendList( to: number ) {
         const results = this.state.stops;
 
-        for ( let i = results.length; i <= to; i++ ) {
+        for ( let i = results.length; i <= to && i < nodePositions.length; i++ ) {
             results.push( {
                 name: nodePositions[ i ].id,
                 time: this.state.time,
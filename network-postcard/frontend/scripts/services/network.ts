@@ -11,78 +11,86 @@
 // WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 // See the License for the specific language governing permissions and
 // limitations under the License.
-import "firebase/firestore";
-
-import firebase, { firestore } from "firebase/app";
 import { Subject } from "rxjs";
 import { setResult } from "./store";
 
 
-firebase.initializeApp( {
-    // apiKey: '### FIREBASE API KEY ###',
-    // authDomain: '### FIREBASE AUTH DOMAIN ###',
-    projectId: "gcprelay-next"
-} );
-
-const db: firestore.Firestore = firebase.firestore();
+const ENTRYPOINT = "https://entrypoint.gcprelay.net";
+const TOKENS = "https://tokens.gcprelay.net/token";
 
 export interface JourneyHop {
     step: number;
+    steps: number;
     time: number;
     image: string;
+    done: boolean;
 }
 
 export function sendImage( blob: Blob ): Subject<JourneyHop> {
     const subject = new Subject<JourneyHop>();
     const id = Math.round( Math.random() * 1000000000 ).toString();
     let max = -1;
-    let latestImage = "";
-    let isFirst = true;
     let startTime = Date.now();
 
-    const removeListener = db.collection( "routes" ).doc( id ).onSnapshot( ( doc ) => {
-        const data = doc.data() as SnapshotData | undefined;
+    // The stream is opened before the route is started, so that no hop is
+    // missed. It ends with a done event once every node has had the postcard.
+    const events = new EventSource( `${ ENTRYPOINT }/routes/${ id }/events` );
 
-        if ( ! data ) {
-            return;
-        }
+    events.addEventListener( "hop", ( e ) => {
+        const hop = JSON.parse( ( e as MessageEvent ).data ) as HopEvent;
 
-        if ( isFirst && data.AllNodes.length === Object.keys( data.Nodes ).length ) {
-            isFirst = false;
+        // Hops can be recorded out of order, only ever move forward.
+        if ( hop.step <= max ) {
             return;
         }
+        max = hop.step;
+
+        subject.next( {
+            step: hop.step,
+            steps: hop.steps,
+            time: Date.now() - startTime,
+            image: `${ ENTRYPOINT }${ hop.postcard }`,
+            done: false,
+        } );
+    } );
 
-        const previousMax = max;
-
-        max = Math.max(
-            max,
-            Object.keys( data.Nodes ).reduce( ( previous, x ) => Math.max( parseInt( x, 10 ), previous ), 0 )
-        );
-
-        if ( max > previousMax ) {
-            latestImage = `data:image/png;base64,${ data.Postcard }`;
-        }
-
-        if ( previousMax !== max ) {
-            subject.next( {
-                step: max,
-                time: Date.now() - startTime,
-                image: latestImage || "",
-            } );
+    events.addEventListener( "done", ( e ) => {
+        const done = JSON.parse( ( e as MessageEvent ).data ) as DoneEvent;
+        if ( done.status && done.status !== "completed" ) {
+            subject.error( new Error( `route ${ id } ended as ${ done.status }` ) );
+            events.close();
+            return;
         }
+        const image = `${ ENTRYPOINT }${ done.postcard }`;
+
+        setResult( image );
+        subject.next( {
+            step: done.steps - 1,
+            steps: done.steps,
+            time: Date.now() - startTime,
+            image,
+            done: true,
+        } );
+        subject.complete();
+        events.close();
+    } );
 
-        if ( max === 8 ) {
-            setResult( `data:image/png;base64,${ data.Postcard }` );
-            subject.complete();
-            removeListener();
-        }
+    events.addEventListener( "timeout", () => {
+        subject.error( new Error( `route ${ id } did not finish` ) );
+        events.close();
     } );
 
-    blobToDataURL( blob ).then( body => {
-        fetch( `https://entrypoint.gcprelay.net/relay?init=true&id=${ id }`, {
+    Promise.all( [ blobToDataURL( blob ), getToken() ] ).then( ( [ body, token ] ) => {
+        fetch( `${ ENTRYPOINT }/relay?init=true&id=${ id }&token=${ encodeURIComponent( token ) }`, {
             method: "POST",
             body,
             mode: "cors",
+        } ).then( response => {
+            // 202 means the route is waiting its turn, and will start on its own.
+            if ( !response.ok ) {
+                subject.error( new Error( `route ${ id } was not started: ${ response.status }` ) );
+                events.close();
+            }
         } );
 
         startTime = Date.now();
@@ -91,6 +99,13 @@ export function sendImage( blob: Blob ): Subject<JourneyHop> {
     return subject;
 }
 
+// getToken asks the token server for the token needed to start a route.
+function getToken(): Promise<string> {
+    return fetch( TOKENS, { mode: "cors" } )
+        .then( response => response.json() )
+        .then( ( reply: { token: string } ) => reply.token );
+}
+
 function blobToDataURL( blob: Blob ): Promise<string> {
     return new Promise( resolve => {
         const reader = new FileReader();
@@ -102,30 +117,21 @@ function blobToDataURL( blob: Blob ): Promise<string> {
     } );
 }
 
-interface Timestamp {
+interface HopEvent {
+    step: number;
+    steps: number;
+    node: string;
+    in: string;
+    out: string;
     seconds: number;
-    nanoseconds: number;
+    skipped?: boolean;
+    postcard: string;
 }
 
-interface Node {
-    Host: { Endpoint: string, Name: string, Private: string };
-    In: Timestamp;
-    Out: Timestamp;
-    Slot: number;
-}
-
-interface SnapshotData {
-    LastUpdate: Timestamp;
-    ID: string;
-    Initialized: boolean;
-    AllNodes: Node[];
-    Nodes: { [ key: number ]: Node };
-    Postcard: string;
-    Total: {
-        Destination: Node,
-        Duration: number,
-        Nanoseconds: number,
-        Origin: Node,
-        Seconds: number
-    };
+interface DoneEvent {
+    id: string;
+    status: "completed" | "failed" | "timed_out" | "cancelled";
+    steps: number;
+    seconds: number;
+    postcard: string;
 }
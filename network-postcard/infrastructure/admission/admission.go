@@ -0,0 +1,231 @@
+// Package admission keeps an entry node from starting more routes than the
+// ring can carry without the extra work showing up in the hop times. Routes
+// over the limit wait their turn in a first in, first out queue, and every
+// client is held to a rate of new routes.
+package admission
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueFull means there are too many routes waiting already.
+	ErrQueueFull = fmt.Errorf("too many routes are waiting to start")
+	// ErrDuplicate means a route with the same id is already waiting or in
+	// flight.
+	ErrDuplicate = fmt.Errorf("route is already waiting or in flight")
+)
+
+// Controller admits routes up to a maximum in flight at once.
+type Controller struct {
+	max       int
+	queueSize int
+
+	mu       sync.Mutex
+	inFlight map[string]bool
+	queue    []*Ticket
+}
+
+// NewController returns a Controller that lets max routes be in flight at
+// once, and queueSize more wait. A max of 0 admits every route straight away.
+func NewController(max, queueSize int) *Controller {
+	return &Controller{
+		max:       max,
+		queueSize: queueSize,
+		inFlight:  make(map[string]bool),
+	}
+}
+
+// Ticket is a route's place in line.
+type Ticket struct {
+	ID        string
+	Queued    time.Time
+	admitted  chan struct{}
+	cancelled chan struct{}
+}
+
+// Admitted is closed when the route can start.
+func (t *Ticket) Admitted() <-chan struct{} {
+	return t.admitted
+}
+
+// Cancelled is closed when the route is cancelled while it waits.
+func (t *Ticket) Cancelled() <-chan struct{} {
+	return t.cancelled
+}
+
+// Enqueue gets a route in line. The ticket is admitted straight away if
+// there is room.
+func (c *Controller) Enqueue(id string) (*Ticket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inFlight[id] || c.find(id) >= 0 {
+		return nil, ErrDuplicate
+	}
+
+	t := &Ticket{ID: id, Queued: time.Now(), admitted: make(chan struct{}), cancelled: make(chan struct{})}
+	if c.max <= 0 || (len(c.inFlight) < c.max && len(c.queue) == 0) {
+		c.admit(t)
+		return t, nil
+	}
+
+	if len(c.queue) >= c.queueSize {
+		return nil, ErrQueueFull
+	}
+	c.queue = append(c.queue, t)
+	return t, nil
+}
+
+// Done frees the place of a route that is over, and admits the next one in
+// line. A route that is still waiting is taken out of line.
+func (c *Controller) Done(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if i := c.find(id); i >= 0 {
+		c.queue = append(c.queue[:i], c.queue[i+1:]...)
+		return
+	}
+
+	delete(c.inFlight, id)
+	for len(c.queue) > 0 && (c.max <= 0 || len(c.inFlight) < c.max) {
+		t := c.queue[0]
+		c.queue = c.queue[1:]
+		c.admit(t)
+	}
+}
+
+// Cancel takes a route that is waiting out of line, so that its place goes
+// to the routes behind it, and closes its ticket's Cancelled. It answers
+// false if the route isn't waiting. A route in flight keeps its place until
+// it is Done.
+func (c *Controller) Cancel(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := c.find(id)
+	if i < 0 {
+		return false
+	}
+	t := c.queue[i]
+	c.queue = append(c.queue[:i], c.queue[i+1:]...)
+	close(t.cancelled)
+	return true
+}
+
+// Position returns where a route is in line, counting from 1, or 0 if it is
+// in flight. ok is false if the route is neither.
+func (c *Controller) Position(id string) (position int, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inFlight[id] {
+		return 0, true
+	}
+	if i := c.find(id); i >= 0 {
+		return i + 1, true
+	}
+	return 0, false
+}
+
+// Len returns how many routes are in flight, and how many are waiting.
+func (c *Controller) Len() (inFlight, waiting int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.inFlight), len(c.queue)
+}
+
+func (c *Controller) admit(t *Ticket) {
+	c.inFlight[t.ID] = true
+	close(t.admitted)
+}
+
+func (c *Controller) find(id string) int {
+	for i, t := range c.queue {
+		if t.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Limiter holds every client to a rate of new routes, with a token bucket
+// per client.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// pruneAt is how many clients the limiter keeps track of before it forgets
+// the ones it doesn't need to.
+const pruneAt = 1024
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter that lets every client start perMinute routes
+// a minute, and up to burst of them at once. A perMinute of 0 lets clients
+// start as many as they want.
+func NewLimiter(perMinute float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow answers if the client can start a route now. If it can't, wait is
+// how long until it can.
+func (l *Limiter) Allow(client string) (ok bool, wait time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, found := l.buckets[client]
+	if !found {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	if len(l.buckets) > pruneAt {
+		l.prune(now)
+	}
+	return true, 0
+}
+
+// prune forgets the clients whose buckets have filled up again, so that the
+// limiter doesn't grow with every client it has ever seen.
+func (l *Limiter) prune(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for client, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, client)
+		}
+	}
+}
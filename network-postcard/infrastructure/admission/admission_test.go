@@ -0,0 +1,140 @@
+package admission
+
+import (
+	"testing"
+	"time"
+)
+
+func TestController(t *testing.T) {
+	c := NewController(2, 2)
+
+	tickets := map[string]*Ticket{}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		ticket, err := c.Enqueue(id)
+		if err != nil {
+			t.Fatalf("could not enqueue %s: %v", id, err)
+		}
+		tickets[id] = ticket
+	}
+
+	if _, err := c.Enqueue("e"); err != ErrQueueFull {
+		t.Errorf("full queue got %v, want %v", err, ErrQueueFull)
+	}
+	if _, err := c.Enqueue("a"); err != ErrDuplicate {
+		t.Errorf("duplicate got %v, want %v", err, ErrDuplicate)
+	}
+
+	wantPositions := func(label string, want map[string]int) {
+		for id, w := range want {
+			got, ok := c.Position(id)
+			if w < 0 {
+				if ok {
+					t.Errorf("%s: %s is at %d, want it gone", label, id, got)
+				}
+				continue
+			}
+			if !ok || got != w {
+				t.Errorf("%s: %s is at %d, want %d", label, id, got, w)
+			}
+		}
+	}
+
+	wantPositions("full", map[string]int{"a": 0, "b": 0, "c": 1, "d": 2})
+	if admitted(tickets["c"]) {
+		t.Errorf("c was admitted over the limit")
+	}
+
+	c.Done("a")
+	wantPositions("a done", map[string]int{"a": -1, "c": 0, "d": 1})
+	if !admitted(tickets["c"]) {
+		t.Errorf("c was not admitted when a was done")
+	}
+
+	// A route that gives up waiting is taken out of line.
+	c.Done("d")
+	wantPositions("d gave up", map[string]int{"d": -1})
+	if inFlight, waiting := c.Len(); inFlight != 2 || waiting != 0 {
+		t.Errorf("got %d in flight and %d waiting, want 2 and 0", inFlight, waiting)
+	}
+
+	unlimited := NewController(0, 0)
+	for _, id := range []string{"a", "b", "c"} {
+		ticket, err := unlimited.Enqueue(id)
+		if err != nil || !admitted(ticket) {
+			t.Errorf("unlimited controller did not admit %s: %v", id, err)
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	c := NewController(1, 1)
+	first, _ := c.Enqueue("a")
+	second, _ := c.Enqueue("b")
+
+	if !c.Cancel("b") {
+		t.Errorf("waiting route was not cancelled")
+	}
+	select {
+	case <-second.Cancelled():
+	default:
+		t.Errorf("cancelled ticket was not told")
+	}
+	if _, ok := c.Position("b"); ok {
+		t.Errorf("cancelled route is still in line")
+	}
+
+	// Its place goes to the next route.
+	if _, err := c.Enqueue("c"); err != nil {
+		t.Errorf("could not take the cancelled route's place: %v", err)
+	}
+
+	// A route in flight is only freed by Done.
+	if c.Cancel("a") {
+		t.Errorf("route in flight was cancelled")
+	}
+	if !admitted(first) {
+		t.Errorf("route in flight lost its place")
+	}
+	c.Done("a")
+	if admitted(second) {
+		t.Errorf("cancelled route was admitted")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(60, 2)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("kiosk"); !ok {
+			t.Fatalf("burst of 2 stopped at %d", i)
+		}
+	}
+
+	ok, wait := l.Allow("kiosk")
+	if ok {
+		t.Errorf("kiosk went over its burst")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("got wait %v, want up to a second", wait)
+	}
+
+	if ok, _ := l.Allow("other kiosk"); !ok {
+		t.Errorf("other kiosk was held to the first one's rate")
+	}
+
+	unlimited := NewLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if ok, _ := unlimited.Allow("kiosk"); !ok {
+			t.Fatalf("unlimited limiter stopped at %d", i)
+		}
+	}
+}
+
+func admitted(t *Ticket) bool {
+	select {
+	case <-t.Admitted():
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,215 @@
+// Package auth signs the routes that relay nodes pass between each other,
+// and issues the short lived tokens that a client needs to start a route.
+// Both are HMAC-SHA256 with a key that is shared between the machines that
+// need it. Operators send a key of their own as it is.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the signature of a relayed route.
+	SignatureHeader = "X-Gcprelay-Signature"
+	// TimestampHeader carries the time a relayed route was signed.
+	TimestampHeader = "X-Gcprelay-Timestamp"
+	// MaxAge is how far the time a route was signed can be from now before
+	// the signature is no longer accepted.
+	MaxAge = 30 * time.Second
+)
+
+var (
+	// ErrBadSignature means a route was not signed, or not signed with the
+	// key.
+	ErrBadSignature = fmt.Errorf("signature is missing or invalid")
+	// ErrStale means a route was signed too long ago to be accepted.
+	ErrStale = fmt.Errorf("signature is too old")
+	// ErrReplayed means a signed route was sent again.
+	ErrReplayed = fmt.Errorf("signature has already been used")
+	// ErrBadToken means a token is missing or was not issued with the key.
+	ErrBadToken = fmt.Errorf("token is missing or invalid")
+	// ErrExpired means a token was issued with the key, but has expired.
+	ErrExpired = fmt.Errorf("token has expired")
+	// ErrUsed means a token has already started a route.
+	ErrUsed = fmt.Errorf("token has already been used")
+)
+
+// Key is a shared secret. An empty key turns checks off, so that the relay
+// can run locally without one.
+type Key []byte
+
+// Enabled answers if there is a key to sign and verify with.
+func (k Key) Enabled() bool {
+	return len(k) > 0
+}
+
+func (k Key) mac(parts ...string) string {
+	m := hmac.New(sha256.New, k)
+	m.Write([]byte(strings.Join(parts, ".")))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Sign returns the signature of a body sent at t.
+func (k Key) Sign(t time.Time, body []byte) string {
+	return k.mac("relay", strconv.FormatInt(t.UnixNano(), 10), string(body))
+}
+
+// Verify checks that sig is the signature of body sent at the time in
+// timestamp, and that it was sent recently.
+func (k Key) Verify(timestamp string, body []byte, sig string) error {
+	ns, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+
+	t := time.Unix(0, ns)
+	if !hmac.Equal([]byte(sig), []byte(k.Sign(t, body))) {
+		return ErrBadSignature
+	}
+
+	if age := time.Since(t); age > MaxAge || age < -MaxAge {
+		return ErrStale
+	}
+	return nil
+}
+
+// SignRequest adds the timestamp and signature headers for body to h.
+func (k Key) SignRequest(h http.Header, body []byte) {
+	now := time.Now()
+	h.Set(TimestampHeader, strconv.FormatInt(now.UnixNano(), 10))
+	h.Set(SignatureHeader, k.Sign(now, body))
+}
+
+// VerifyRequest checks the timestamp and signature headers in h against
+// body.
+func (k Key) VerifyRequest(h http.Header, body []byte) error {
+	return k.Verify(h.Get(TimestampHeader), body, h.Get(SignatureHeader))
+}
+
+// Replays remembers the signatures of the routes that were accepted until
+// they are too old to verify, so that a route captured on the wire can't be
+// sent again. A signature covers the route, with its id and how far it has
+// got, and when it was sent, so no two relays share one. It also remembers
+// the tokens that have started routes, until they expire.
+type Replays struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewReplays returns a Replays that hasn't seen any signatures.
+func NewReplays() *Replays {
+	return &Replays{seen: make(map[string]time.Time)}
+}
+
+// Check records a signature that was verified, and returns ErrReplayed if it
+// had been recorded already.
+func (r *Replays) Check(sig string) error {
+	// A signature stays fresh for MaxAge either side of when it was sent.
+	if !r.record(sig, time.Now().Add(2*MaxAge)) {
+		return ErrReplayed
+	}
+	return nil
+}
+
+// record remembers s until expires, and answers false if it was already
+// remembered. Anything that has expired is forgotten first.
+func (r *Replays) record(s string, expires time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range r.seen {
+		if now.After(e) {
+			delete(r.seen, k)
+		}
+	}
+
+	if _, ok := r.seen[s]; ok {
+		return false
+	}
+	r.seen[s] = expires
+	return true
+}
+
+// VerifySecret checks that secret is the key itself.
+func (k Key) VerifySecret(secret string) error {
+	if !hmac.Equal([]byte(secret), k) {
+		return ErrBadToken
+	}
+	return nil
+}
+
+// Token returns a token that expires after ttl. Every token has a nonce of
+// its own, so that no two are the same and each can be used once.
+func (k Key) Token(ttl time.Duration) string {
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	return expires + "." + nonce + "." + k.mac("token", expires, nonce)
+}
+
+// VerifyToken checks that token was issued with the key and hasn't expired.
+func (k Key) VerifyToken(token string) error {
+	_, err := k.verifyToken(token)
+	return err
+}
+
+// UseToken checks a token like VerifyToken, and that it hasn't been used
+// before. The token is remembered in replays until it expires.
+func (k Key) UseToken(token string, replays *Replays) error {
+	expires, err := k.verifyToken(token)
+	if err != nil {
+		return err
+	}
+	if !replays.record(token, expires) {
+		return ErrUsed
+	}
+	return nil
+}
+
+// verifyToken checks a token, and returns when it expires.
+func (k Key) verifyToken(token string) (time.Time, error) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return time.Time{}, ErrBadToken
+	}
+
+	if !hmac.Equal([]byte(parts[2]), []byte(k.mac("token", parts[0], parts[1]))) {
+		return time.Time{}, ErrBadToken
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, ErrBadToken
+	}
+	if time.Now().Unix() > expires {
+		return time.Time{}, ErrExpired
+	}
+	return time.Unix(expires, 0), nil
+}
+
+// TokenHandler issues tokens that expire after ttl. It is meant to be served
+// by the frontend host, so that only visitors of the site can start routes.
+func TokenHandler(k Key, ttl time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply := struct {
+			Token   string    `json:"token"`
+			Expires time.Time `json:"expires"`
+		}{k.Token(ttl), time.Now().Add(ttl)}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reply)
+	})
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyRequest(t *testing.T) {
+	k := Key("secret")
+	body := []byte(`{"ID":"dummy"}`)
+
+	h := http.Header{}
+	k.SignRequest(h, body)
+	if err := k.VerifyRequest(h, body); err != nil {
+		t.Errorf("signed request did not verify: %v", err)
+	}
+
+	if err := k.VerifyRequest(h, []byte(`{"ID":"forged"}`)); err != ErrBadSignature {
+		t.Errorf("changed body got %v, want %v", err, ErrBadSignature)
+	}
+
+	if err := Key("other").VerifyRequest(h, body); err != ErrBadSignature {
+		t.Errorf("other key got %v, want %v", err, ErrBadSignature)
+	}
+
+	if err := k.VerifyRequest(http.Header{}, body); err != ErrBadSignature {
+		t.Errorf("unsigned request got %v, want %v", err, ErrBadSignature)
+	}
+
+	old := time.Now().Add(-2 * MaxAge)
+	if err := k.Verify(strconv.FormatInt(old.UnixNano(), 10), body, k.Sign(old, body)); err != ErrStale {
+		t.Errorf("old signature got %v, want %v", err, ErrStale)
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	k := Key("secret")
+
+	cases := []struct {
+		label string
+		token string
+		want  error
+	}{
+		{"valid", k.Token(time.Minute), nil},
+		{"expired", k.Token(-time.Minute), ErrExpired},
+		{"other key", Key("other").Token(time.Minute), ErrBadToken},
+		{"empty", "", ErrBadToken},
+		{"relay signature", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10) + ".nonce." + k.Sign(time.Now(), nil), ErrBadToken},
+	}
+
+	for _, c := range cases {
+		if err := k.VerifyToken(c.token); err != c.want {
+			t.Errorf("%s got %v, want %v", c.label, err, c.want)
+		}
+	}
+
+	if k.Token(time.Minute) == k.Token(time.Minute) {
+		t.Errorf("two tokens issued together are the same")
+	}
+}
+
+func TestUseToken(t *testing.T) {
+	k := Key("secret")
+	r := NewReplays()
+	token := k.Token(time.Minute)
+
+	if err := k.UseToken(token, r); err != nil {
+		t.Errorf("new token got %v", err)
+	}
+	if err := k.UseToken(token, r); err != ErrUsed {
+		t.Errorf("used token got %v, want %v", err, ErrUsed)
+	}
+	if err := k.UseToken(k.Token(-time.Minute), r); err != ErrExpired {
+		t.Errorf("expired token got %v, want %v", err, ErrExpired)
+	}
+
+	// A used token is remembered for as long as it could be used.
+	if e := r.seen[token]; e.Before(time.Now().Add(MaxAge)) {
+		t.Errorf("used token is only remembered until %v", e)
+	}
+}
+
+func TestReplays(t *testing.T) {
+	r := NewReplays()
+	k := Key("secret")
+	first, second := k.Sign(time.Now(), []byte("a")), k.Sign(time.Now(), []byte("b"))
+
+	if err := r.Check(first); err != nil {
+		t.Errorf("new signature got %v", err)
+	}
+	if err := r.Check(second); err != nil {
+		t.Errorf("other signature got %v", err)
+	}
+	if err := r.Check(first); err != ErrReplayed {
+		t.Errorf("replayed signature got %v, want %v", err, ErrReplayed)
+	}
+
+	// Signatures are forgotten once they are too old to verify anyway.
+	r.seen[first] = time.Now().Add(-time.Second)
+	if err := r.Check(second); err != ErrReplayed {
+		t.Errorf("replayed signature got %v, want %v", err, ErrReplayed)
+	}
+	if _, ok := r.seen[first]; ok {
+		t.Errorf("old signature was kept")
+	}
+}
+
+func TestVerifySecret(t *testing.T) {
+	k := Key("secret")
+	if err := k.VerifySecret("secret"); err != nil {
+		t.Errorf("key got %v", err)
+	}
+	for _, secret := range []string{"", "Secret", k.Token(time.Minute)} {
+		if err := k.VerifySecret(secret); err != ErrBadToken {
+			t.Errorf("%q got %v, want %v", secret, err, ErrBadToken)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Command relaysim runs a whole ring of relay nodes inside of one process on
+// loopback ports, and sends a postcard all the way around it. It is a way to
+// exercise stamping and the hop math without deploying any vms.
+//
+// The stamps are read from GCPRELAY_IMAGEPATH like they are on the real
+// nodes.
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/gcloud"
+	"github.com/tpryan/gcprelay/infrastructure/persist"
+	"github.com/tpryan/gcprelay/infrastructure/relay"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+// zones are the names given to the simulated nodes, so that they pick up the
+// same stamps as the real ones.
+var zones = []string{
+	"asia-east1-a",
+	"asia-northeast1-a",
+	"australia-southeast1-a",
+	"us-west1-a",
+	"us-central1-f",
+	"us-east4-a",
+	"europe-west2-b",
+	"europe-west3-a",
+	"southamerica-east1-a",
+}
+
+func main() {
+	count := flag.Int("nodes", len(zones), "number of relay nodes to start")
+	input := flag.String("image", route.ImagePath+"/postcard.png", "png to send around the ring")
+	output := flag.String("out", "postcard.png", "where to write the stamped postcard")
+	timeout := flag.Duration("timeout", 30*time.Second, "how long to wait for the postcard to come back")
+	transport := flag.String("transport", "http", "how nodes pass the route on, http or grpc")
+	verbose := flag.Bool("v", false, "show the logs of the relay nodes")
+	flag.Parse()
+
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	if *count < 2 {
+		fatalf("need at least 2 nodes, got %d", *count)
+	}
+
+	store := persist.NewMemory()
+	servers, err := startRing(*count, store, *transport)
+	if err != nil {
+		fatalf("could not start relay nodes: %v", err)
+	}
+
+	// Visit the simulated nodes in the order they were started, whatever
+	// zones the layout in GCPRELAY_IMAGEPATH expects.
+	l := route.CurrentLayout()
+	l.Order = nil
+	for _, s := range servers {
+		l.Order = append(l.Order, s.Host.Name)
+	}
+	err = route.SetLayout(l)
+	if err != nil {
+		fatalf("could not set layout: %v", err)
+	}
+
+	for _, s := range servers {
+		fmt.Printf("started %s on %s\n", s.Host.Name, s.Host.Private)
+	}
+
+	img, err := ioutil.ReadFile(*input)
+	if err != nil {
+		fatalf("could not read postcard: %v", err)
+	}
+
+	id := route.NewID(32)
+	url := fmt.Sprintf("http://%s/relay?init=true&id=%s", servers[0].Host.Private, id)
+	body := strings.NewReader(base64.StdEncoding.EncodeToString(img))
+
+	resp, err := http.Post(url, "text/plain", body)
+	if err != nil {
+		fatalf("could not send postcard to the first node: %v", err)
+	}
+	resp.Body.Close()
+
+	r, err := waitForRoute(store, id, *timeout)
+	if err != nil {
+		fatalf("postcard did not make it around: %v", err)
+	}
+
+	for i, hop := range r.Hops {
+		fmt.Printf("%d %s -> %s: %s via %s\n", i, hop.Origin.Host.Name, hop.Destination.Host.Name, hop.Duration, hop.Destination.Via)
+	}
+	fmt.Printf("total %s -> %s: %s\n", r.Total.Origin.Host.Name, r.Total.Destination.Host.Name, r.Total.Duration)
+
+	postcard, err := base64.StdEncoding.DecodeString(r.Postcard)
+	if err != nil {
+		fatalf("could not decode the stamped postcard: %v", err)
+	}
+
+	if err := ioutil.WriteFile(*output, postcard, 0644); err != nil {
+		fatalf("could not write the stamped postcard: %v", err)
+	}
+	fmt.Printf("wrote %s\n", *output)
+}
+
+// startRing starts count relay servers that share one store, each on its own
+// loopback port with a made up identity.
+func startRing(count int, store persist.Store, transport string) ([]*relay.Server, error) {
+	var servers []*relay.Server
+
+	for i := 0; i < count; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+
+		name := fmt.Sprintf("sim-node-%d", i)
+		if i < len(zones) {
+			name = zones[i]
+		}
+
+		host, err := route.NewHost(gcloud.Static{
+			"name":        name,
+			"external-ip": l.Addr().String(),
+			"private-ip":  l.Addr().String(),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		s := &relay.Server{
+			Host:      host,
+			Store:     store,
+			Protocol:  "http",
+			Transport: transport,
+		}
+		if err := s.Register(); err != nil {
+			return nil, err
+		}
+
+		go http.Serve(l, s.Handler())
+		servers = append(servers, s)
+	}
+
+	return servers, nil
+}
+
+// waitForRoute polls the store until the route has been through every node.
+func waitForRoute(store persist.Store, id string, timeout time.Duration) (*route.Route, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		r, err := store.Route(id)
+		if err == nil && len(r.Nodes) > 0 && r.Done() && !r.Total.Destination.Out.IsZero() {
+			return r, nil
+		}
+		if err != nil && err != persist.ErrRouteNotFound {
+			return nil, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("timed out after %s", timeout)
+}
+
+func fatalf(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "relaysim: "+format+"\n", a...)
+	os.Exit(1)
+}
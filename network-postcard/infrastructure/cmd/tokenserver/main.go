@@ -0,0 +1,45 @@
+// Command tokenserver issues the short lived tokens that the frontend needs to
+// start a route. It runs next to the frontend, with the same
+// GCPRELAY_TOKEN_KEY as the relay nodes, and only answers the frontend at
+// GCPRELAY_ORIGIN. Each token starts one route.
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/auth"
+)
+
+// ttl is how long a token can be used to start a route.
+const ttl = 2 * time.Minute
+
+func main() {
+	key := auth.Key(os.Getenv("GCPRELAY_TOKEN_KEY"))
+	if !key.Enabled() {
+		log.Fatalf("GCPRELAY_TOKEN_KEY is not set")
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	// Tokens are only handed to the frontend, so other sites can't ask for
+	// them on behalf of their visitors.
+	origin := os.Getenv("GCPRELAY_ORIGIN")
+	if origin == "" || origin == "*" {
+		log.Fatalf("GCPRELAY_ORIGIN must be set to the origin of the frontend")
+	}
+
+	tokens := auth.TokenHandler(key, ttl)
+	http.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", origin)
+		tokens.ServeHTTP(w, r)
+	})
+
+	log.Printf("tokenserver listening on port %s", port)
+	log.Fatal(http.ListenAndServe(":"+port, nil))
+}
@@ -2,12 +2,106 @@
 package gcloud
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"strings"
 
 	"cloud.google.com/go/compute/metadata"
 )
 
+// Datatypes are the pieces of metadata that a Provider can answer.
+var Datatypes = []string{"external-ip", "private-ip", "name", "project-id"}
+
+// Provider answers questions about the machine the relay is running on.
+type Provider interface {
+	Metadata(datatype string) (string, error)
+}
+
+// NewProvider returns the Provider for the named source. The file source
+// needs the path of a json file of datatypes to values.
+func NewProvider(source, path string) (Provider, error) {
+	switch source {
+	case "", "gce":
+		return GCE{}, nil
+	case "env":
+		return Env{}, nil
+	case "file":
+		return NewFile(path)
+	}
+	return nil, fmt.Errorf("unknown metadata source '%s'", source)
+}
+
+// GCE is a Provider that asks the Compute Engine metadata server.
+type GCE struct{}
+
+// Metadata retrieves specific pieces of Metadata from Google Cloud's
+// Compute Engine infrastructure
+func (GCE) Metadata(datatype string) (string, error) {
+	return Metadata(datatype)
+}
+
+// Env is a Provider that reads metadata from environment variables. The
+// variable for a datatype is GCPRELAY_ followed by the upper cased datatype
+// with dashes turned into underscores, so "private-ip" is read from
+// GCPRELAY_PRIVATE_IP.
+type Env struct{}
+
+// Metadata retrieves a piece of metadata from the environment.
+func (Env) Metadata(datatype string) (string, error) {
+	if !valid(datatype) {
+		return "", fmt.Errorf("Invalid metadata requests")
+	}
+
+	key := "GCPRELAY_" + strings.ToUpper(strings.Replace(datatype, "-", "_", -1))
+	value := os.Getenv(key)
+	if value == "" {
+		return "", fmt.Errorf("environment variable %s is not set", key)
+	}
+	return value, nil
+}
+
+// Static is a Provider with fixed answers, keyed by datatype.
+type Static map[string]string
+
+// NewFile reads a Static Provider from a json file.
+func NewFile(path string) (Static, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read metadata file '%s': %v", path, err)
+	}
+
+	var s Static
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("could not decode metadata file '%s': %v", path, err)
+	}
+	return s, nil
+}
+
+// Metadata retrieves a piece of metadata from the fixed answers.
+func (s Static) Metadata(datatype string) (string, error) {
+	if !valid(datatype) {
+		return "", fmt.Errorf("Invalid metadata requests")
+	}
+
+	value, ok := s[datatype]
+	if !ok {
+		return "", fmt.Errorf("no value for metadata '%s'", datatype)
+	}
+	return value, nil
+}
+
+func valid(datatype string) bool {
+	for _, d := range Datatypes {
+		if d == datatype {
+			return true
+		}
+	}
+	return false
+}
+
 // Metadata retrieves specific pieces of Metadata from Google Cloud's
 // Compute Engine infrastructure
 func Metadata(datatype string) (string, error) {
@@ -0,0 +1,69 @@
+package gcloud
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnv(t *testing.T) {
+	os.Setenv("GCPRELAY_NAME", "us-west1-a")
+	os.Setenv("GCPRELAY_PRIVATE_IP", "10.0.0.2")
+	defer os.Unsetenv("GCPRELAY_NAME")
+	defer os.Unsetenv("GCPRELAY_PRIVATE_IP")
+
+	cases := []struct {
+		datatype string
+		want     string
+		wantErr  bool
+	}{
+		{"name", "us-west1-a", false},
+		{"private-ip", "10.0.0.2", false},
+		{"external-ip", "", true},
+		{"favorite-color", "", true},
+	}
+
+	for _, c := range cases {
+		got, err := Env{}.Metadata(c.datatype)
+		if (err != nil) != c.wantErr {
+			t.Errorf("Env.Metadata(%s) got err %v, wantErr %t", c.datatype, err, c.wantErr)
+		}
+		if got != c.want {
+			t.Errorf("Env.Metadata(%s) got %s, want %s", c.datatype, got, c.want)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	content := `{"name": "asia-east1-a", "external-ip": "203.0.113.7"}`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("could not write metadata file: %v", err)
+	}
+
+	p, err := NewProvider("file", path)
+	if err != nil {
+		t.Fatalf("could not read metadata file: %v", err)
+	}
+
+	cases := []struct {
+		datatype string
+		want     string
+		wantErr  bool
+	}{
+		{"name", "asia-east1-a", false},
+		{"external-ip", "203.0.113.7", false},
+		{"project-id", "", true},
+	}
+
+	for _, c := range cases {
+		got, err := p.Metadata(c.datatype)
+		if (err != nil) != c.wantErr {
+			t.Errorf("File.Metadata(%s) got err %v, wantErr %t", c.datatype, err, c.wantErr)
+		}
+		if got != c.want {
+			t.Errorf("File.Metadata(%s) got %s, want %s", c.datatype, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Package pdf writes print ready postcards. It has its own writer for the
+// small part of PDF they need: pages with a trim and bleed box, jpeg images,
+// text in the standard fonts and lines.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"strings"
+)
+
+// Inch is how many PDF units, points, there are in an inch.
+const Inch = 72.0
+
+// Font is one of the standard fonts that every PDF reader has, so that no
+// font has to be embedded.
+type Font string
+
+const (
+	Helvetica     Font = "Helvetica"
+	HelveticaBold Font = "Helvetica-Bold"
+	Courier       Font = "Courier"
+)
+
+// fonts are every font a page can use, in the order of their resource
+// names: F1, F2 and so on.
+var fonts = []Font{Helvetica, HelveticaBold, Courier}
+
+// courierAdvance is how wide every character of Courier is, as a share of
+// the font size.
+const courierAdvance = 0.6
+
+// Box is a rectangle on a page, from its bottom left corner to its top
+// right one.
+type Box struct {
+	X0, Y0, X1, Y1 float64
+}
+
+// Width returns how wide the box is.
+func (b Box) Width() float64 { return b.X1 - b.X0 }
+
+// Height returns how high the box is.
+func (b Box) Height() float64 { return b.Y1 - b.Y0 }
+
+func (b Box) String() string {
+	return fmt.Sprintf("[%s %s %s %s]", num(b.X0), num(b.Y0), num(b.X1), num(b.Y1))
+}
+
+// Document is a PDF that pages are added to.
+type Document struct {
+	Title string
+	pages []*Page
+}
+
+// Page is a page of a Document. Positions are in points from the bottom
+// left corner of the sheet.
+type Page struct {
+	// Media is the whole sheet, and Trim where it is cut. The sheet is
+	// bigger than what is left after the cut by the bleed, so that anything
+	// printed to the edge still is if the cut is a little off.
+	Media, Trim Box
+
+	content bytes.Buffer
+	images  []image.Image
+}
+
+// AddPage adds a page that is width by height once it is cut, with bleed
+// on every side.
+func (d *Document) AddPage(width, height, bleed float64) *Page {
+	p := &Page{
+		Media: Box{0, 0, width + 2*bleed, height + 2*bleed},
+		Trim:  Box{bleed, bleed, width + bleed, height + bleed},
+	}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+// Image draws img stretched over the box. It is embedded as a jpeg at its
+// own resolution.
+func (p *Page) Image(img image.Image, b Box) {
+	p.images = append(p.images, img)
+	fmt.Fprintf(&p.content, "q %s 0 0 %s %s %s cm /Im%d Do Q\n", num(b.Width()), num(b.Height()), num(b.X0), num(b.Y0), len(p.images))
+}
+
+// Text draws s with its baseline starting at x, y.
+func (p *Page) Text(f Font, size, x, y float64, s string) {
+	fmt.Fprintf(&p.content, "BT /F%d %s Tf %s %s Td %s Tj ET\n", fontIndex(f), num(size), num(x), num(y), literal(s))
+}
+
+// Line draws a line width points wide.
+func (p *Page) Line(x0, y0, x1, y1, width float64) {
+	fmt.Fprintf(&p.content, "%s w %s %s m %s %s l S\n", num(width), num(x0), num(y0), num(x1), num(y1))
+}
+
+// Rect draws the outline of a box width points wide.
+func (p *Page) Rect(b Box, width float64) {
+	fmt.Fprintf(&p.content, "%s w %s %s %s %s re S\n", num(width), num(b.X0), num(b.Y0), num(b.Width()), num(b.Height()))
+}
+
+// Gray sets the colour of the text and lines drawn after it, from 0 for
+// black to 1 for white.
+func (p *Page) Gray(g float64) {
+	fmt.Fprintf(&p.content, "%s g %s G\n", num(g), num(g))
+}
+
+// CourierWidth returns how wide s is in Courier at size.
+func CourierWidth(s string, size float64) float64 {
+	return float64(len([]rune(s))) * courierAdvance * size
+}
+
+func fontIndex(f Font) int {
+	for i, known := range fonts {
+		if known == f {
+			return i + 1
+		}
+	}
+	return 1
+}
+
+// num formats a number without trailing zeros, since PDF readers don't
+// all take exponents.
+func num(v float64) string {
+	s := strings.TrimRight(fmt.Sprintf("%.3f", v), "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+// literal quotes s as a PDF string. The standard fonts are written with
+// WinAnsiEncoding, which is close enough to Latin-1 for postcards, and
+// anything outside of it is replaced.
+func literal(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(byte(r))
+		case r < 32 || r > 255:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// writer keeps track of where every object starts, for the cross
+// reference table at the end of the file.
+type writer struct {
+	w       io.Writer
+	n       int64
+	offsets []int64
+	err     error
+}
+
+func (w *writer) printf(format string, a ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(w.w, format, a...)
+	w.n += int64(n)
+	w.err = err
+}
+
+func (w *writer) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	w.err = err
+}
+
+// object writes object number n. Objects have to be written in order.
+func (w *writer) object(n int, dict string) {
+	w.offsets = append(w.offsets, w.n)
+	w.printf("%d 0 obj\n%s\nendobj\n", n, dict)
+}
+
+// stream writes object number n as a stream of data.
+func (w *writer) stream(n int, dict string, data []byte) {
+	w.offsets = append(w.offsets, w.n)
+	w.printf("%d 0 obj\n<< %s /Length %d >>\nstream\n", n, dict, len(data))
+	w.write(data)
+	w.printf("\nendstream\nendobj\n")
+}
+
+// Write writes the document as a PDF.
+func (d *Document) Write(out io.Writer) error {
+	if len(d.pages) == 0 {
+		return fmt.Errorf("document has no pages")
+	}
+
+	// The catalog, the page tree, the information dictionary and the
+	// fonts come first, then every page with its content and images.
+	const catalog, tree, info = 1, 2, 3
+	first := info + len(fonts) + 1
+	pageNums := make([]int, len(d.pages))
+	next := first
+	for i, p := range d.pages {
+		pageNums[i] = next
+		next += 2 + len(p.images)
+	}
+
+	w := &writer{w: out}
+	w.printf("%%PDF-1.4\n%%\xe2\xe3\xcf\xd3\n")
+
+	var kids, fontRefs []string
+	for _, n := range pageNums {
+		kids = append(kids, fmt.Sprintf("%d 0 R", n))
+	}
+	for i := range fonts {
+		fontRefs = append(fontRefs, fmt.Sprintf("/F%d %d 0 R", i+1, info+1+i))
+	}
+
+	w.object(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", tree))
+	w.object(tree, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	w.object(info, fmt.Sprintf("<< /Title %s /Producer (gcprelay) >>", literal(d.Title)))
+	for i, f := range fonts {
+		w.object(info+1+i, fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", f))
+	}
+
+	for i, p := range d.pages {
+		n := pageNums[i]
+
+		var xobjects []string
+		for j := range p.images {
+			xobjects = append(xobjects, fmt.Sprintf("/Im%d %d 0 R", j+1, n+2+j))
+		}
+		w.object(n, fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox %s /BleedBox %s /TrimBox %s /Resources << /Font << %s >> /XObject << %s >> >> /Contents %d 0 R >>",
+			tree, p.Media, p.Media, p.Trim, strings.Join(fontRefs, " "), strings.Join(xobjects, " "), n+1))
+
+		var content bytes.Buffer
+		z := zlib.NewWriter(&content)
+		z.Write(p.content.Bytes())
+		if err := z.Close(); err != nil {
+			return fmt.Errorf("could not compress page %d: %v", i+1, err)
+		}
+		w.stream(n+1, "/Filter /FlateDecode", content.Bytes())
+
+		for j, img := range p.images {
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 92}); err != nil {
+				return fmt.Errorf("could not encode image %d of page %d: %v", j+1, i+1, err)
+			}
+			size := img.Bounds().Size()
+			w.stream(n+2+j, fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode", size.X, size.Y), buf.Bytes())
+		}
+	}
+
+	xref := w.n
+	w.printf("xref\n0 %d\n0000000000 65535 f \n", len(w.offsets)+1)
+	for _, o := range w.offsets {
+		w.printf("%010d 00000 n \n", o)
+	}
+	w.printf("trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(w.offsets)+1, catalog, info, xref)
+
+	if w.err != nil {
+		return fmt.Errorf("could not write pdf: %v", w.err)
+	}
+	return nil
+}
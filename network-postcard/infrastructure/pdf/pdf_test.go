@@ -0,0 +1,187 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+func TestLiteral(t *testing.T) {
+	cases := map[string]string{
+		"plain":        "(plain)",
+		"a (b) c\\d":   `(a \(b\) c\\d)`,
+		"café":         "(caf\xe9)",
+		"tab\there 東京": "(tab?here ??)",
+	}
+	for in, want := range cases {
+		if got := literal(in); got != want {
+			t.Errorf("literal(%q) got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNum(t *testing.T) {
+	cases := map[float64]string{0: "0", 1.5: "1.5", 450: "450", -0.0001: "0", 2.0 / 3: "0.667"}
+	for in, want := range cases {
+		if got := num(in); got != want {
+			t.Errorf("num(%v) got %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	d := &Document{Title: "Test"}
+	if err := d.Write(&bytes.Buffer{}); err == nil {
+		t.Errorf("document with no pages got no error")
+	}
+
+	p := d.AddPage(100, 50, 10)
+	p.Text(Courier, 10, 20, 20, "hello")
+	p.Image(image.NewRGBA(image.Rect(0, 0, 4, 2)), p.Media)
+	d.AddPage(100, 50, 0).Line(0, 0, 100, 50, 1)
+
+	var buf bytes.Buffer
+	if err := d.Write(&buf); err != nil {
+		t.Fatalf("could not write document: %v", err)
+	}
+	out := buf.String()
+
+	if !strings.HasPrefix(out, "%PDF-1.4\n") || !strings.HasSuffix(out, "%%EOF\n") {
+		t.Errorf("document doesn't start and end like a pdf")
+	}
+	for _, want := range []string{"/Count 2", "/MediaBox [0 0 120 70]", "/TrimBox [10 10 110 60]", "/Width 4 /Height 2"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("document is missing %s", want)
+		}
+	}
+	checkXref(t, out)
+
+	if contents := streams(t, out); !strings.Contains(contents, "(hello) Tj") {
+		t.Errorf("page contents are missing the text: %q", contents)
+	}
+}
+
+func TestPostcard(t *testing.T) {
+	r := &route.Route{ID: "printed", LastUpdate: time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)}
+	names := []string{"asia-east1-a", "australia-southeast1-a", "southamerica-east1-a"}
+	for _, name := range names {
+		r.AddNode(route.Node{Host: route.Host{Name: name}, In: time.Now(), Out: time.Now()})
+	}
+	for i := 1; i < len(names); i++ {
+		r.Hops = append(r.Hops, route.Hop{Origin: r.Nodes[i-1], Destination: r.Nodes[i], Seconds: 0.1 * float64(i)})
+	}
+	// Many more hops than fit on the back.
+	for i := 0; i < 60; i++ {
+		r.Hops = append(r.Hops, r.Hops[0])
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 1000, 667))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{200, 30, 30, 255}), image.Point{}, draw.Src)
+	if err := r.SetPostcard(img); err != nil {
+		t.Fatalf("could not set postcard: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := Postcard(&buf, r); err != nil {
+		t.Fatalf("could not write postcard: %v", err)
+	}
+	out := buf.String()
+
+	// 6x4 inches, with an eighth of an inch of bleed, and the front at
+	// 300 dpi all the way into the bleed.
+	for _, want := range []string{"/Count 2", "/MediaBox [0 0 450 306]", "/TrimBox [9 9 441 297]", "/Width 1875 /Height 1275"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("postcard is missing %s", want)
+		}
+	}
+	checkXref(t, out)
+
+	contents := streams(t, out)
+	for _, want := range []string{
+		"(asia-east1-a to southamerica-east1-a) Tj",
+		"(3 stops in ",
+		"(Finished October 18, 2026 09:30 UTC) Tj",
+		"(0.100s) Tj",
+		"more) Tj",
+		"(Route printed) Tj",
+	} {
+		if !strings.Contains(contents, want) {
+			t.Errorf("back is missing %s", want)
+		}
+	}
+
+	// The rows don't run off the bottom of the card.
+	for _, m := range regexp.MustCompile(`/F3 6.5 Tf [\d.]+ ([\d.]+) Td`).FindAllStringSubmatch(contents, -1) {
+		if y, _ := strconv.ParseFloat(m[1], 64); y < Bleed+margin {
+			t.Errorf("itinerary row at %v is below the margin", y)
+		}
+	}
+
+	if err := Postcard(&buf, &route.Route{ID: "empty"}); err == nil {
+		t.Errorf("route with no nodes got no error")
+	}
+}
+
+func TestFit(t *testing.T) {
+	if got := fit("short", 100, 10); got != "short" {
+		t.Errorf("got %q, want it left alone", got)
+	}
+	// 6 points a character fits 5 in 30.
+	if got := fit("asia-east1-a", 30, 10); got != "asi.." {
+		t.Errorf("got %q, want asi..", got)
+	}
+}
+
+// checkXref checks that every entry of the cross reference table points at
+// the object it is for.
+func checkXref(t *testing.T, out string) {
+	t.Helper()
+
+	start := strings.LastIndex(out, "startxref\n")
+	offset, err := strconv.Atoi(strings.Fields(out[start+len("startxref\n"):])[0])
+	if err != nil || !strings.HasPrefix(out[offset:], "xref\n") {
+		t.Fatalf("startxref doesn't point at the cross reference table")
+	}
+
+	lines := strings.Split(out[offset:], "\n")
+	for i, line := range lines[3:] {
+		if !strings.HasSuffix(line, " n ") {
+			break
+		}
+		o, _ := strconv.Atoi(line[:10])
+		if want := strconv.Itoa(i+1) + " 0 obj"; !strings.HasPrefix(out[o:], want) {
+			t.Errorf("xref entry %d points at %q", i+1, out[o:o+10])
+		}
+	}
+}
+
+// streams returns every compressed stream in the document, inflated.
+func streams(t *testing.T, out string) string {
+	t.Helper()
+
+	var result strings.Builder
+	re := regexp.MustCompile(`/Filter /FlateDecode /Length (\d+) >>\nstream\n`)
+	for _, m := range re.FindAllStringSubmatchIndex(out, -1) {
+		n, _ := strconv.Atoi(out[m[2]:m[3]])
+		z, err := zlib.NewReader(strings.NewReader(out[m[1] : m[1]+n]))
+		if err != nil {
+			t.Fatalf("could not inflate stream: %v", err)
+		}
+		b, err := ioutil.ReadAll(z)
+		if err != nil {
+			t.Fatalf("could not inflate stream: %v", err)
+		}
+		result.Write(b)
+	}
+	return result.String()
+}
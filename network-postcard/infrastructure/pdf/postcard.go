@@ -0,0 +1,116 @@
+package pdf
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+const (
+	// Width and Height are the size of a postcard once it is cut: the
+	// standard 6 by 4 inches.
+	Width  = 6 * Inch
+	Height = 4 * Inch
+	// Bleed is how far the front runs past the cut on every side.
+	Bleed = Inch / 8
+	// DPI is the resolution the front is printed at.
+	DPI = 300
+
+	// margin keeps the text on the back clear of the cut.
+	margin = Inch / 4
+)
+
+// Postcard writes a finished route as a two page PDF: the stamped postcard
+// on the front, running into the bleed, and the trip on the back.
+func Postcard(w io.Writer, r *route.Route) error {
+	card, err := r.Card()
+	if err != nil {
+		return err
+	}
+	img, err := r.Image()
+	if err != nil {
+		return err
+	}
+
+	d := &Document{Title: "Postcard " + r.ID}
+
+	// The postcard is scaled up to fill the whole sheet at DPI, and what
+	// doesn't fit the shape of the sheet is cut from the sides.
+	front := d.AddPage(Width, Height, Bleed)
+	front.Image(imaging.Fill(img, pixels(front.Media.Width()), pixels(front.Media.Height()), imaging.Center, imaging.Lanczos), front.Media)
+
+	back(d.AddPage(Width, Height, Bleed), card, r.LastUpdate)
+
+	return d.Write(w)
+}
+
+// pixels returns how many pixels are printed along a length in points.
+func pixels(points float64) int {
+	return int(math.Round(points / Inch * DPI))
+}
+
+// back lays out the back of the postcard like the back of any other: the
+// message on the left, here the itinerary, and the stamp and address on
+// the right.
+func back(p *Page, c route.Card, finished time.Time) {
+	t := p.Trim
+	left, right := t.X0+margin, t.X1-margin
+	top, bottom := t.Y1-margin, t.Y0+margin
+	middle := t.X0 + t.Width()/2
+
+	p.Gray(0.6)
+	p.Line(middle, bottom, middle, top, 0.5)
+
+	// The stamp box, and the lines for an address.
+	p.Rect(Box{right - 0.85*Inch, top - Inch, right, top}, 0.5)
+	for i := 0; i < 4; i++ {
+		y := t.Y0 + t.Height()*0.45 - float64(i)*0.35*Inch
+		p.Line(middle+0.25*Inch, y, right, y, 0.5)
+	}
+
+	p.Gray(0)
+	column := middle - 0.2*Inch
+	y := top - 12
+	p.Text(HelveticaBold, 12, left, y, fmt.Sprintf("%s to %s", c.Origin, c.Destination))
+	y -= 14
+	p.Text(Helvetica, 9, left, y, fmt.Sprintf("%d stops in %.3f seconds", c.Stops, c.Seconds))
+	if !finished.IsZero() {
+		y -= 11
+		p.Text(Helvetica, 9, left, y, "Finished "+finished.UTC().Format("January 2, 2006 15:04 MST"))
+	}
+	y -= 18
+
+	// The itinerary fills what is left of the column, above the route id.
+	const size, leading = 6.5, 8.5
+	idY := bottom
+	maxRows := int((y - idY - leading) / leading)
+	if maxRows < 1 {
+		maxRows = 1
+	}
+	for _, row := range route.ItineraryRows(c.Hops, maxRows) {
+		durationX := column - CourierWidth(row[1], size)
+		p.Text(Courier, size, left, y, fit(row[0], durationX-left-size, size))
+		p.Text(Courier, size, durationX, y, row[1])
+		y -= leading
+	}
+
+	p.Gray(0.4)
+	p.Text(Courier, 5.5, left, idY, "Route "+c.ID)
+}
+
+// fit shortens s so that it is no wider than width in Courier at size.
+func fit(s string, width, size float64) string {
+	max := int(width / (courierAdvance * size))
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	if max < 3 {
+		return ""
+	}
+	return string(runes[:max-2]) + ".."
+}
@@ -0,0 +1,355 @@
+package persist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/printqueue"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	nodesBucket  = []byte("nodes")
+	routesBucket = []byte("routes")
+	hopsBucket   = []byte("hops")
+	framesBucket = []byte("frames")
+	jobsBucket   = []byte("printjobs")
+)
+
+// Bolt is an implementation of Store that keeps everything in a single bolt
+// database file on local disk. It is meant for demos that have no access to
+// Google Cloud.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// NewBolt opens, or creates, the bolt database at path.
+func NewBolt(path string) (*Bolt, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no path given for bolt database")
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open bolt database '%s': %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{nodesBucket, routesBucket, hopsBucket, framesBucket, jobsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create bolt buckets: %v", err)
+	}
+
+	return &Bolt{db: db}, nil
+}
+
+// Close releases the database file.
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// DefaultRoute arranges the registered nodes into a route.Route
+func (b *Bolt) DefaultRoute() (*route.Route, error) {
+	var nodes []node
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(nodesBucket).ForEach(func(k, v []byte) error {
+			var n node
+			if err := json.Unmarshal(v, &n); err != nil {
+				return fmt.Errorf("could not decode node '%s': %v", k, err)
+			}
+			nodes = append(nodes, n)
+			return nil
+		})
+	})
+	if err != nil {
+		return &route.Route{ID: route.NewID(32)}, fmt.Errorf("could not read nodes: %v", err)
+	}
+
+	return newRoute(nodes)
+}
+
+// RecordRoute saves the progress the named node has made on a route.
+func (b *Bolt) RecordRoute(name string, r *route.Route) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(routesBucket)
+
+		var stored *route.Route
+		if v := bucket.Get([]byte(r.ID)); v != nil {
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return fmt.Errorf("could not decode stored route: %v", err)
+			}
+		}
+
+		v, err := json.Marshal(mergeRoute(stored, name, r))
+		if err != nil {
+			return fmt.Errorf("could not encode route: %v", err)
+		}
+		if err := bucket.Put([]byte(r.ID), v); err != nil {
+			return err
+		}
+
+		if !r.Done() {
+			return nil
+		}
+
+		hops := tx.Bucket(hopsBucket)
+		for _, h := range r.Hops {
+			seq, err := hops.NextSequence()
+			if err != nil {
+				return err
+			}
+			v, err := json.Marshal(h)
+			if err != nil {
+				return fmt.Errorf("could not encode hop: %v", err)
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, seq)
+			if err := hops.Put(key, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Register records an active node.
+func (b *Bolt) Register(host *route.Host) error {
+	v, err := json.Marshal(node{Host: *host, LastSeen: now()})
+	if err != nil {
+		return fmt.Errorf("could not encode host: %v", err)
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(nodesBucket).Put([]byte(host.Name), v)
+	})
+}
+
+// Deregister marks a node as removed.
+func (b *Bolt) Deregister(name string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(nodesBucket)
+
+		v := bucket.Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		var n node
+		if err := json.Unmarshal(v, &n); err != nil {
+			return fmt.Errorf("could not decode node '%s': %v", name, err)
+		}
+		return putRemoved(bucket, n)
+	})
+}
+
+// Reap marks the nodes that have not been seen for StaleAfter as removed.
+func (b *Bolt) Reap() ([]string, error) {
+	var reaped []string
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(nodesBucket)
+
+		var stale []node
+		err := bucket.ForEach(func(k, v []byte) error {
+			var n node
+			if err := json.Unmarshal(v, &n); err != nil {
+				return fmt.Errorf("could not decode node '%s': %v", k, err)
+			}
+			if n.stale() && !n.Removed {
+				stale = append(stale, n)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Keys can't be changed while the bucket is being iterated over.
+		for _, n := range stale {
+			if err := putRemoved(bucket, n); err != nil {
+				return err
+			}
+			reaped = append(reaped, n.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reaped, nil
+}
+
+// Route fetches a previously recorded route.
+func (b *Bolt) Route(id string) (*route.Route, error) {
+	var r *route.Route
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(routesBucket).Get([]byte(id))
+		if v == nil {
+			return ErrRouteNotFound
+		}
+		return json.Unmarshal(v, &r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// History returns the hops of completed routes.
+func (b *Bolt) History() ([]route.Hop, error) {
+	var hops []route.Hop
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(hopsBucket).Cursor()
+		for k, v := c.Last(); k != nil && len(hops) < historyLimit; k, v = c.Prev() {
+			var h route.Hop
+			if err := json.Unmarshal(v, &h); err != nil {
+				return fmt.Errorf("could not decode hop: %v", err)
+			}
+			hops = append(hops, h)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Put them back in the order they were recorded.
+	for i, j := 0, len(hops)-1; i < j; i, j = i+1, j-1 {
+		hops[i], hops[j] = hops[j], hops[i]
+	}
+	return hops, nil
+}
+
+// SetStatus moves a recorded route to a new status.
+func (b *Bolt) SetStatus(id string, status route.Status, reason string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(routesBucket)
+
+		v := bucket.Get([]byte(id))
+		if v == nil {
+			return ErrRouteNotFound
+		}
+
+		var r route.Route
+		if err := json.Unmarshal(v, &r); err != nil {
+			return fmt.Errorf("could not decode stored route: %v", err)
+		}
+		if err := r.SetStatus(status, reason); err != nil {
+			return err
+		}
+
+		v, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("could not encode route: %v", err)
+		}
+		return bucket.Put([]byte(id), v)
+	})
+}
+
+// Active returns the recorded routes that aren't over yet.
+func (b *Bolt) Active() ([]*route.Route, error) {
+	var active []*route.Route
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(routesBucket).ForEach(func(k, v []byte) error {
+			var r route.Route
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("could not decode route '%s': %v", k, err)
+			}
+			if !r.Status.Final() {
+				active = append(active, &r)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return active, nil
+}
+
+// putRemoved writes a node back marked as removed.
+func putRemoved(bucket *bolt.Bucket, n node) error {
+	n.Removed = true
+	v, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("could not encode node '%s': %v", n.Name, err)
+	}
+	return bucket.Put([]byte(n.Name), v)
+}
+
+// frameKey sorts the frames of a route together, in order.
+func frameKey(id string, index int) []byte {
+	return binary.BigEndian.AppendUint32([]byte(id+"/"), uint32(index))
+}
+
+// SaveFrame keeps a frame of a route.
+func (b *Bolt) SaveFrame(id string, f route.Frame) error {
+	v, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("could not encode frame: %v", err)
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(framesBucket).Put(frameKey(id, f.Index), v)
+	})
+}
+
+// Frames returns the frames of a route in order.
+func (b *Bolt) Frames(id string) ([]route.Frame, error) {
+	var frames []route.Frame
+	err := b.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(id + "/")
+		c := tx.Bucket(framesBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var f route.Frame
+			if err := json.Unmarshal(v, &f); err != nil {
+				return fmt.Errorf("could not decode frame: %v", err)
+			}
+			frames = append(frames, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return frames, nil
+}
+
+// SaveJob records a print job.
+func (b *Bolt) SaveJob(j printqueue.Job) error {
+	v, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("could not encode print job: %v", err)
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(j.ID), v)
+	})
+}
+
+// PrintJobs returns every print job that was recorded.
+func (b *Bolt) PrintJobs() ([]printqueue.Job, error) {
+	var jobs []printqueue.Job
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var j printqueue.Job
+			if err := json.Unmarshal(v, &j); err != nil {
+				return fmt.Errorf("could not decode print job '%s': %v", k, err)
+			}
+			jobs = append(jobs, j)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
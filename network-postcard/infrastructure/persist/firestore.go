@@ -0,0 +1,478 @@
+package persist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/tpryan/gcprelay/infrastructure/printqueue"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ctx = context.Background()
+
+// Agent is a go between for the main application and firestore. It is the
+// firestore implementation of Store.
+type Agent struct {
+	ProjectID string
+
+	mu     sync.Mutex
+	client *firestore.Client
+}
+
+// DefaultRoute fetches the list of nodes from Firestore and arranges them
+// into a route.Route
+func (a *Agent) DefaultRoute() (*route.Route, error) {
+
+	client, err := a.getClient()
+	if err != nil {
+		return &route.Route{ID: route.NewID(32)}, fmt.Errorf("Failed to create client: %v", err)
+	}
+
+	nodes, err := a.nodes(client)
+	if err != nil {
+		return &route.Route{ID: route.NewID(32)}, err
+	}
+
+	return newRoute(nodes)
+}
+
+func (a *Agent) nodes(client *firestore.Client) ([]node, error) {
+	var nodes []node
+	iter := client.Collection("nodes").Documents(ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate: %v", err)
+		}
+		var n node
+		doc.DataTo(&n)
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// getClient returns the firestore client of the agent, creating it the
+// first time it is asked for. Every call shares the one client.
+func (a *Agent) getClient() (*firestore.Client, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client != nil {
+		return a.client, nil
+	}
+	client, err := firestore.NewClient(context.Background(), a.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+	a.client = client
+	return client, nil
+}
+
+// Close closes the firestore client, if one was created.
+func (a *Agent) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client == nil {
+		return nil
+	}
+	err := a.client.Close()
+	a.client = nil
+	return err
+}
+
+// RecordRoute saves a route to firestore for prosperity and so that the front
+// end can see what is going own.
+func (a *Agent) RecordRoute(name string, r *route.Route) error {
+	client, err := a.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to create client: %v", err)
+	}
+
+	if r.JustStarted() {
+		log.Printf("firestore first record: %+v", r.ID)
+		r.LastUpdate = time.Now()
+		if _, err = client.Collection("routes").Doc(r.ID).Set(ctx, r); err != nil {
+			return fmt.Errorf("failed to write to firestore: %v", err)
+		}
+		return nil
+	}
+	update := map[string]interface{}{
+		"ID": r.ID,
+	}
+
+	if r.Done() {
+		update["Total"] = r.Total
+		update["Postcard"] = r.Postcard
+		update["LastUpdate"] = r.LastUpdate
+	}
+
+	nodes := map[string]interface{}{}
+	hops := map[string]interface{}{}
+	for _, i := range recorded(name, r) {
+		nodes[strconv.Itoa(i)] = r.Nodes[i]
+		if i > 0 && i-1 < len(r.Hops) {
+			hops[strconv.Itoa(i-1)] = r.Hops[i-1]
+		}
+	}
+
+	update["Nodes"] = nodes
+
+	if len(hops) > 0 {
+		update["Hops"] = hops
+	}
+
+	doc, err := client.Collection("routes").Doc(r.ID).Get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get old record from firestore: %v", err)
+	}
+
+	lastupdate, ok := doc.Data()["LastUpdate"]
+
+	// Only the status, and how many times it has changed, are needed to
+	// tell if the status of this node's copy should be written.
+	var stored route.Route
+	if s, ok := doc.Data()["Status"].(string); ok {
+		stored.Status = route.Status(s)
+	}
+	if t, ok := doc.Data()["Transitions"].([]interface{}); ok {
+		stored.Transitions = make([]route.Transition, len(t))
+	}
+	if keepStatus(&stored, r) {
+		update["Status"] = r.Status
+		update["Transitions"] = r.Transitions
+	}
+
+	if t, isTime := lastupdate.(time.Time); !ok || !isTime || t.Before(r.LastUpdate) {
+		log.Printf("updating postcard of %s, stored one is older or missing: %v", r.ID, lastupdate)
+		update["Postcard"] = r.Postcard
+		update["LastUpdate"] = r.LastUpdate
+	}
+
+	if _, err = client.Collection("routes").Doc(r.ID).Set(ctx, update, firestore.MergeAll); err != nil {
+		return fmt.Errorf("failed to write to firestore: %v", err)
+	}
+
+	if r.Done() {
+		batch := client.Batch()
+		for i, h := range r.Hops {
+			batch.Set(client.Collection("hops").Doc(r.ID+"_"+strconv.Itoa(i)), h)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return fmt.Errorf("failed to write hops to firestore: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Register records an active node to the firestore list.
+func (a *Agent) Register(host *route.Host) error {
+	client, err := a.getClient()
+
+	if err != nil {
+		return fmt.Errorf("failed to create client: %v", err)
+	}
+
+	_, err = client.Collection("nodes").Doc(host.Name).Set(ctx, node{Host: *host, LastSeen: now()})
+	if err != nil {
+		return fmt.Errorf("failed to register host to firestore: %v", err)
+	}
+	return nil
+}
+
+// Deregister marks a node in the firestore list as removed.
+func (a *Agent) Deregister(name string) error {
+	client, err := a.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to create client: %v", err)
+	}
+
+	_, err = client.Collection("nodes").Doc(name).Update(ctx, []firestore.Update{{Path: "Removed", Value: true}})
+	if err != nil && status.Code(err) != codes.NotFound {
+		return fmt.Errorf("failed to deregister host from firestore: %v", err)
+	}
+	return nil
+}
+
+// Reap marks the nodes in the firestore list that have not been seen for
+// StaleAfter as removed.
+func (a *Agent) Reap() ([]string, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+
+	nodes, err := a.nodes(client)
+	if err != nil {
+		return nil, err
+	}
+
+	var reaped []string
+	for _, n := range nodes {
+		if !n.stale() || n.Removed {
+			continue
+		}
+		if _, err := client.Collection("nodes").Doc(n.Name).Update(ctx, []firestore.Update{{Path: "Removed", Value: true}}); err != nil {
+			return reaped, fmt.Errorf("failed to reap host from firestore: %v", err)
+		}
+		reaped = append(reaped, n.Name)
+	}
+	return reaped, nil
+}
+
+// Route fetches a route from firestore. The partial writes that RecordRoute
+// makes turn the Nodes and Hops lists into maps keyed by index, so they are
+// turned back into lists before decoding.
+func (a *Agent) Route(id string) (*route.Route, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+
+	doc, err := client.Collection("routes").Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrRouteNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get route from firestore: %v", err)
+	}
+	return routeFromDoc(doc)
+}
+
+// routeFromDoc decodes a route document.
+func routeFromDoc(doc *firestore.DocumentSnapshot) (*route.Route, error) {
+	data := doc.Data()
+	for _, field := range []string{"Nodes", "Hops"} {
+		data[field] = indexedList(data[field])
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal route from firestore: %v", err)
+	}
+
+	var r route.Route
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("could not unmarshal route from firestore: %v", err)
+	}
+	return &r, nil
+}
+
+// indexedList converts a map keyed by list index back into a list.
+func indexedList(v interface{}) interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+
+	var keys []int
+	for k := range m {
+		i, err := strconv.Atoi(k)
+		if err != nil {
+			return v
+		}
+		keys = append(keys, i)
+	}
+	sort.Ints(keys)
+
+	if len(keys) == 0 {
+		return []interface{}{}
+	}
+	list := make([]interface{}, keys[len(keys)-1]+1)
+	for _, i := range keys {
+		list[i] = m[strconv.Itoa(i)]
+	}
+	return list
+}
+
+// History returns the hops of the most recently completed routes.
+func (a *Agent) History() ([]route.Hop, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+
+	var hops []route.Hop
+	iter := client.Collection("hops").OrderBy("Destination.In", firestore.Desc).Limit(historyLimit).Documents(ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate: %v", err)
+		}
+		var h route.Hop
+		if err := doc.DataTo(&h); err != nil {
+			return nil, fmt.Errorf("could not decode hop %s: %v", doc.Ref.ID, err)
+		}
+		hops = append(hops, h)
+	}
+
+	// Put them back in the order they were recorded.
+	for i, j := 0, len(hops)-1; i < j; i, j = i+1, j-1 {
+		hops[i], hops[j] = hops[j], hops[i]
+	}
+	return hops, nil
+}
+
+// SetStatus moves a route in firestore to a new status. The route is read
+// and written in a transaction, so that two changes can't both be made.
+func (a *Agent) SetStatus(id string, s route.Status, reason string) error {
+	client, err := a.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to create client: %v", err)
+	}
+
+	ref := client.Collection("routes").Doc(id)
+	return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return ErrRouteNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get route from firestore: %v", err)
+		}
+
+		r, err := routeFromDoc(doc)
+		if err != nil {
+			return err
+		}
+		if err := r.SetStatus(s, reason); err != nil {
+			return err
+		}
+
+		update := map[string]interface{}{
+			"Status":      r.Status,
+			"Transitions": r.Transitions,
+		}
+		return tx.Set(ref, update, firestore.MergeAll)
+	})
+}
+
+// Active returns the routes in firestore that aren't over yet.
+func (a *Agent) Active() ([]*route.Route, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+
+	var active []*route.Route
+	statuses := []route.Status{route.StatusPending, route.StatusInFlight}
+	iter := client.Collection("routes").Where("Status", "in", statuses).Documents(ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate: %v", err)
+		}
+		r, err := routeFromDoc(doc)
+		if err != nil {
+			return nil, err
+		}
+		active = append(active, r)
+	}
+	return active, nil
+}
+
+// frameDoc is a frame, along with the route it belongs to.
+type frameDoc struct {
+	RouteID string
+	route.Frame
+}
+
+// SaveFrame keeps a frame of a route in firestore.
+func (a *Agent) SaveFrame(id string, f route.Frame) error {
+	client, err := a.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to create client: %v", err)
+	}
+
+	doc := client.Collection("frames").Doc(id + "_" + strconv.Itoa(f.Index))
+	if _, err := doc.Set(ctx, frameDoc{RouteID: id, Frame: f}); err != nil {
+		return fmt.Errorf("failed to write frame to firestore: %v", err)
+	}
+	return nil
+}
+
+// Frames returns the frames of a route in firestore in order. They are
+// sorted here, so that the query doesn't need an index.
+func (a *Agent) Frames(id string) ([]route.Frame, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+
+	var frames []route.Frame
+	iter := client.Collection("frames").Where("RouteID", "==", id).Documents(ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate: %v", err)
+		}
+		var f frameDoc
+		if err := doc.DataTo(&f); err != nil {
+			return nil, fmt.Errorf("could not decode frame %s: %v", doc.Ref.ID, err)
+		}
+		frames = append(frames, f.Frame)
+	}
+	return sortFrames(frames), nil
+}
+
+// SaveJob records a print job in firestore.
+func (a *Agent) SaveJob(j printqueue.Job) error {
+	client, err := a.getClient()
+	if err != nil {
+		return fmt.Errorf("failed to create client: %v", err)
+	}
+
+	if _, err := client.Collection("printjobs").Doc(j.ID).Set(ctx, j); err != nil {
+		return fmt.Errorf("failed to write print job to firestore: %v", err)
+	}
+	return nil
+}
+
+// PrintJobs returns every print job recorded in firestore.
+func (a *Agent) PrintJobs() ([]printqueue.Job, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+
+	var jobs []printqueue.Job
+	iter := client.Collection("printjobs").Documents(ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate: %v", err)
+		}
+		var j printqueue.Job
+		if err := doc.DataTo(&j); err != nil {
+			return nil, fmt.Errorf("could not decode print job %s: %v", doc.Ref.ID, err)
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
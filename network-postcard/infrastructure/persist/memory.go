@@ -0,0 +1,224 @@
+package persist
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/tpryan/gcprelay/infrastructure/printqueue"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+// Memory is an in memory implementation of Store. It is meant for tests and
+// for running every relay node inside of one process.
+type Memory struct {
+	mu     sync.Mutex
+	nodes  map[string]node
+	routes map[string][]byte
+	hops   []route.Hop
+	frames map[string]map[int]route.Frame
+	jobs   map[string]printqueue.Job
+}
+
+// NewMemory returns an empty Memory store.
+func NewMemory() *Memory {
+	return &Memory{
+		nodes:  make(map[string]node),
+		routes: make(map[string][]byte),
+		frames: make(map[string]map[int]route.Frame),
+		jobs:   make(map[string]printqueue.Job),
+	}
+}
+
+// DefaultRoute arranges the registered nodes into a route.Route
+func (m *Memory) DefaultRoute() (*route.Route, error) {
+	m.mu.Lock()
+	var nodes []node
+	for _, n := range m.nodes {
+		nodes = append(nodes, n)
+	}
+	m.mu.Unlock()
+
+	return newRoute(nodes)
+}
+
+// RecordRoute saves the progress the named node has made on a route.
+func (m *Memory) RecordRoute(name string, r *route.Route) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Routes are kept encoded so that callers can not change them behind
+	// the store's back.
+	var stored *route.Route
+	if b, ok := m.routes[r.ID]; ok {
+		if err := json.Unmarshal(b, &stored); err != nil {
+			return fmt.Errorf("could not decode stored route: %v", err)
+		}
+	}
+
+	b, err := json.Marshal(mergeRoute(stored, name, r))
+	if err != nil {
+		return fmt.Errorf("could not encode route: %v", err)
+	}
+	m.routes[r.ID] = b
+
+	if r.Done() {
+		m.hops = append(m.hops, r.Hops...)
+		if len(m.hops) > historyLimit {
+			m.hops = m.hops[len(m.hops)-historyLimit:]
+		}
+	}
+
+	return nil
+}
+
+// Register records an active node.
+func (m *Memory) Register(host *route.Host) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nodes[host.Name] = node{Host: *host, LastSeen: now()}
+	return nil
+}
+
+// Deregister marks a node as removed.
+func (m *Memory) Deregister(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if n, ok := m.nodes[name]; ok {
+		n.Removed = true
+		m.nodes[name] = n
+	}
+	return nil
+}
+
+// Reap marks the nodes that have not been seen for StaleAfter as removed.
+func (m *Memory) Reap() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var reaped []string
+	for name, n := range m.nodes {
+		if n.stale() && !n.Removed {
+			n.Removed = true
+			m.nodes[name] = n
+			reaped = append(reaped, name)
+		}
+	}
+	return reaped, nil
+}
+
+// Route fetches a previously recorded route.
+func (m *Memory) Route(id string) (*route.Route, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.routes[id]
+	if !ok {
+		return nil, ErrRouteNotFound
+	}
+
+	var r route.Route
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("could not decode stored route: %v", err)
+	}
+	return &r, nil
+}
+
+// History returns the hops of completed routes.
+func (m *Memory) History() ([]route.Hop, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]route.Hop{}, m.hops...), nil
+}
+
+// SetStatus moves a recorded route to a new status.
+func (m *Memory) SetStatus(id string, status route.Status, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.routes[id]
+	if !ok {
+		return ErrRouteNotFound
+	}
+
+	var r route.Route
+	if err := json.Unmarshal(b, &r); err != nil {
+		return fmt.Errorf("could not decode stored route: %v", err)
+	}
+	if err := r.SetStatus(status, reason); err != nil {
+		return err
+	}
+
+	v, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("could not encode route: %v", err)
+	}
+	m.routes[id] = v
+	return nil
+}
+
+// Active returns the recorded routes that aren't over yet.
+func (m *Memory) Active() ([]*route.Route, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var active []*route.Route
+	for _, b := range m.routes {
+		var r route.Route
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, fmt.Errorf("could not decode stored route: %v", err)
+		}
+		if !r.Status.Final() {
+			active = append(active, &r)
+		}
+	}
+	return active, nil
+}
+
+// SaveFrame keeps a frame of a route.
+func (m *Memory) SaveFrame(id string, f route.Frame) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.frames[id] == nil {
+		m.frames[id] = make(map[int]route.Frame)
+	}
+	m.frames[id][f.Index] = f
+	return nil
+}
+
+// Frames returns the frames of a route in order.
+func (m *Memory) Frames(id string) ([]route.Frame, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var frames []route.Frame
+	for _, f := range m.frames[id] {
+		frames = append(frames, f)
+	}
+	return sortFrames(frames), nil
+}
+
+// SaveJob records a print job.
+func (m *Memory) SaveJob(j printqueue.Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.jobs[j.ID] = j
+	return nil
+}
+
+// PrintJobs returns every print job that was recorded.
+func (m *Memory) PrintJobs() ([]printqueue.Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var jobs []printqueue.Job
+	for _, j := range m.jobs {
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
@@ -1,143 +1,207 @@
+// Package persist records the nodes and routes of the relay so that the
+// front end can follow a postcard around the world. Firestore is the backend
+// used in production, but an in memory and an on disk backend are provided so
+// that the relay can run without a Google Cloud project.
 package persist
 
 import (
-	"context"
 	"fmt"
-	"log"
-	"strconv"
+	"sort"
 	"time"
 
-	"cloud.google.com/go/firestore"
+	"github.com/tpryan/gcprelay/infrastructure/printqueue"
 	"github.com/tpryan/gcprelay/infrastructure/route"
-	"google.golang.org/api/iterator"
 )
 
-var (
-	client *firestore.Client
-	ctx    = context.Background()
-)
+// ErrRouteNotFound is returned when a route that was asked for has never been
+// recorded.
+var ErrRouteNotFound = fmt.Errorf("route was not found")
+
+// Store is the set of operations the relay server needs from a persistence
+// backend.
+type Store interface {
+	// DefaultRoute arranges all of the registered nodes into a route.Route.
+	DefaultRoute() (*route.Route, error)
+	// RecordRoute saves the progress the named node has made on a route.
+	RecordRoute(name string, r *route.Route) error
+	// Register records an active node, and when it was last seen. Nodes
+	// call it again every so often as a heartbeat.
+	Register(host *route.Host) error
+	// Deregister marks a node as removed, so that it is no longer
+	// included in new routes.
+	Deregister(name string) error
+	// Reap marks the nodes that have not been seen for StaleAfter as
+	// removed, and returns their names.
+	Reap() ([]string, error)
+	// Route fetches a previously recorded route.
+	Route(id string) (*route.Route, error)
+	// History returns the hops of completed routes, oldest first, and at
+	// most the 1000 most recent ones.
+	History() ([]route.Hop, error)
+	// SetStatus moves a recorded route to a new status. The error wraps
+	// route.ErrBadTransition if the route can't go to it.
+	SetStatus(id string, s route.Status, reason string) error
+	// Active returns the recorded routes that aren't over yet.
+	Active() ([]*route.Route, error)
+	// SaveFrame keeps the postcard of a route as a node left it, so that
+	// the trip can be played back.
+	SaveFrame(id string, f route.Frame) error
+	// Frames returns the frames of a route in order.
+	Frames(id string) ([]route.Frame, error)
+	// SaveJob records a print job as it is now, so that the print queue
+	// remembers what it printed when the node restarts.
+	SaveJob(j printqueue.Job) error
+	// PrintJobs returns every print job that was recorded.
+	PrintJobs() ([]printqueue.Job, error)
+}
+
+// historyLimit is the most hops that History will return.
+const historyLimit = 1000
+
+// StaleAfter is how long a node can go without a heartbeat before it is
+// left out of new routes.
+var StaleAfter = time.Minute
+
+// now is replaced in tests.
+var now = time.Now
 
-// Agent is a go between for the main application and firestore.
-type Agent struct {
-	ProjectID string
+// node is a registered host, along with when it was last seen. Nodes that
+// are deregistered or reaped are marked Removed rather than deleted, so that
+// new routes can tell a zone whose node is down from one that was never set
+// up.
+type node struct {
+	route.Host
+	LastSeen time.Time `json:"lastseen,omitempty"`
+	Removed  bool      `json:"removed,omitempty"`
 }
 
-// DefaultRoute fetches the list of nodes from Firestore and arranges them
-// into a route.Route
-func (a *Agent) DefaultRoute() (*route.Route, error) {
+// stale answers if the node has gone without a heartbeat for too long.
+// Nodes that were registered before heartbeats existed are always stale.
+func (n node) stale() bool {
+	return now().Sub(n.LastSeen) > StaleAfter
+}
+
+// down answers if the node should be left out of new routes.
+func (n node) down() bool {
+	return n.Removed || n.stale()
+}
+
+// New returns the Store for the named backend. The firestore backend needs
+// a project id, the bolt backend needs the path of its database file.
+func New(backend, projectID, path string) (Store, error) {
+	switch backend {
+	case "", "firestore":
+		return &Agent{ProjectID: projectID}, nil
+	case "memory":
+		return NewMemory(), nil
+	case "bolt":
+		return NewBolt(path)
+	}
+	return nil, fmt.Errorf("unknown persistence backend '%s'", backend)
+}
 
+// newRoute arranges the nodes that are up into a route in the order of the
+// layout, and sets the blank postcard on it. Zones whose node is down are
+// left out of the route.
+func newRoute(nodes []node) (*route.Route, error) {
 	r := &route.Route{ID: route.NewID(32)}
-	client, err := a.getClient()
-	if err != nil {
-		return r, fmt.Errorf("Failed to create client: %v", err)
-	}
 
-	iter := client.Collection("nodes").Documents(ctx)
-	for {
-		doc, err := iter.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return r, fmt.Errorf("Failed to iterate: %v", err)
+	var hosts []route.Host
+	var down []string
+	for _, n := range nodes {
+		if n.down() {
+			down = append(down, n.Name)
+			continue
 		}
-		var node route.Node
-		doc.DataTo(&node.Host)
-		r.AddNode(node)
+		hosts = append(hosts, n.Host)
+	}
+
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	for _, h := range hosts {
+		r.AddNode(route.Node{Host: h})
 	}
 
 	img, err := route.GetImage("postcard")
 	if err != nil {
-		return r, fmt.Errorf("Failed to binary something somtheing the image: %v", err)
+		return r, fmt.Errorf("could not get the postcard image: %v", err)
 	}
 
 	if err := r.SetPostcard(img); err != nil {
 		return nil, err
 	}
-	r.Order()
+	if err := r.Order(down...); err != nil {
+		return r, fmt.Errorf("could not order route: %v", err)
+	}
 
 	return r, nil
 }
 
-func (a *Agent) getClient() (*firestore.Client, error) {
-	if client != nil {
-		return client, nil
+// recorded returns the indexes of the nodes, and the hops to them, that the
+// named node writes when it records a route: its own and any that have been
+// skipped.
+func recorded(name string, r *route.Route) []int {
+	var result []int
+	current := r.CurrentNode(name)
+	for i, n := range r.Nodes {
+		if i == current || n.Skipped {
+			result = append(result, i)
+		}
 	}
-	return firestore.NewClient(context.Background(), a.ProjectID)
+	return result
 }
 
-// RecordRoute saves a route to firestore for prosperity and so that the front
-// end can see what is going own.
-func (a *Agent) RecordRoute(name string, r *route.Route) error {
-	client, err := a.getClient()
-	if err != nil {
-		return fmt.Errorf("failed to create client: %v", err)
-	}
-
-	defer client.Close()
-
-	if r.JustStarted() {
-		log.Printf("firestore first record: %+v", r.ID)
+// mergeRoute folds the progress that the named node made on r into the
+// stored copy of the route. It mirrors the partial writes that the firestore
+// backend makes, so that a node that finishes late can not overwrite the
+// work of the nodes that came after it.
+func mergeRoute(stored *route.Route, name string, r *route.Route) *route.Route {
+	if stored == nil || r.JustStarted() {
 		r.LastUpdate = time.Now()
-		if _, err = client.Collection("routes").Doc(r.ID).Set(ctx, r); err != nil {
-			return fmt.Errorf("failed to write to firestore: %v", err)
-		}
-		return nil
-	}
-	update := map[string]interface{}{
-		"ID": r.ID,
+		return r
 	}
 
-	if r.Done() {
-		update["Total"] = r.Total
-		update["Postcard"] = r.Postcard
-		update["LastUpdate"] = r.LastUpdate
-	}
-
-	update["Nodes"] = map[string]interface{}{
-		strconv.Itoa(r.CurrentNode(name)): r.Nodes[r.CurrentNode(name)],
-	}
+	for _, i := range recorded(name, r) {
+		for len(stored.Nodes) <= i {
+			stored.Nodes = append(stored.Nodes, route.Node{})
+		}
+		stored.Nodes[i] = r.Nodes[i]
 
-	if len(r.Hops) > 0 {
-		update["Hops"] = map[string]interface{}{
-			strconv.Itoa(r.CurrentNode(name) - 1): r.Hops[r.CurrentNode(name)-1],
+		if i > 0 && i-1 < len(r.Hops) {
+			for len(stored.Hops) < i {
+				stored.Hops = append(stored.Hops, route.Hop{})
+			}
+			stored.Hops[i-1] = r.Hops[i-1]
 		}
 	}
 
-	doc, err := client.Collection("routes").Doc(r.ID).Get(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get old record from firestore: %v", err)
+	if r.Done() {
+		stored.Total = r.Total
+		stored.Postcard = r.Postcard
+		stored.LastUpdate = r.LastUpdate
 	}
 
-	lastupdate, ok := doc.Data()["LastUpdate"]
-
-	if !ok || lastupdate.(time.Time).Nanosecond() < r.LastUpdate.Nanosecond() {
-		fmt.Printf("updating image cause firebase timestamp was ahead or missing: %v raw: %v\n", lastupdate, doc.Data()["LastUpdate"])
-		update["Postcard"] = r.Postcard
-		update["LastUpdate"] = r.LastUpdate
-	} else {
-		fmt.Printf("NOT updating image cause firebase timestamp was behind: %v\n", lastupdate)
+	if stored.LastUpdate.Before(r.LastUpdate) {
+		stored.Postcard = r.Postcard
+		stored.LastUpdate = r.LastUpdate
 	}
 
-	if _, err = client.Collection("routes").Doc(r.ID).Set(ctx, update, firestore.MergeAll); err != nil {
-		return fmt.Errorf("failed to write to firestore: %v", err)
+	if keepStatus(stored, r) {
+		stored.Status = r.Status
+		stored.Transitions = r.Transitions
 	}
 
-	return nil
+	return stored
 }
 
-// Register records an active node to the firestore list.
-func (a *Agent) Register(host *route.Host) error {
-	client, err := a.getClient()
-
-	if err != nil {
-		return fmt.Errorf("failed to create client: %v", err)
-	}
-	defer client.Close()
+// keepStatus answers if the status of r should replace the stored one. A
+// route that is over stays over, so that a node that is still working on a
+// cancelled or timed out route can't bring it back.
+func keepStatus(stored, r *route.Route) bool {
+	return !stored.Status.Final() && len(r.Transitions) > len(stored.Transitions)
+}
 
-	_, err = client.Collection("nodes").Doc(host.Name).Set(ctx, host)
-	if err != nil {
-		return fmt.Errorf("failed to register host to firestore: %v", err)
-	}
-	return nil
+// sortFrames puts frames in order of their index.
+func sortFrames(frames []route.Frame) []route.Frame {
+	sort.Slice(frames, func(i, j int) bool { return frames[i].Index < frames[j].Index })
+	return frames
 }
@@ -0,0 +1,348 @@
+package persist
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/printqueue"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		backend string
+		wantErr bool
+	}{
+		{"", false},
+		{"firestore", false},
+		{"memory", false},
+		{"bolt", false},
+		{"mysql", true},
+	}
+
+	for _, c := range cases {
+		_, err := New(c.backend, "test-project", filepath.Join(t.TempDir(), "gcprelay.db"))
+		if (err != nil) != c.wantErr {
+			t.Errorf("New(%s) got err %v, wantErr %t", c.backend, err, c.wantErr)
+		}
+	}
+}
+
+func TestRecordRoute(t *testing.T) {
+	b, err := NewBolt(filepath.Join(t.TempDir(), "gcprelay.db"))
+	if err != nil {
+		t.Fatalf("could not open bolt store: %v", err)
+	}
+	defer b.Close()
+
+	stores := map[string]Store{
+		"memory": NewMemory(),
+		"bolt":   b,
+	}
+
+	for label, s := range stores {
+		r := dummyRoute()
+		if err := s.RecordRoute("asia-east1-a", r); err != nil {
+			t.Fatalf("%s: could not record first route: %v", label, err)
+		}
+
+		// Second node finishes, then a slower write from the first node
+		// arrives after it.
+		second := dummyRoute()
+		second.Nodes[0].In = time.Date(2017, 12, 17, 1, 0, 1, 0, time.UTC)
+		second.Nodes[0].Out = time.Date(2017, 12, 17, 1, 0, 2, 0, time.UTC)
+		second.Nodes[1].In = time.Date(2017, 12, 17, 1, 0, 3, 0, time.UTC)
+		second.Nodes[1].Out = time.Date(2017, 12, 17, 1, 0, 4, 0, time.UTC)
+		second.CalculateHops()
+		if err := s.RecordRoute("asia-northeast1-a", second); err != nil {
+			t.Fatalf("%s: could not record second node: %v", label, err)
+		}
+
+		first := dummyRoute()
+		first.Nodes[0].In = second.Nodes[0].In
+		first.Nodes[0].Out = second.Nodes[0].Out
+		if err := s.RecordRoute("asia-east1-a", first); err != nil {
+			t.Fatalf("%s: could not record first node: %v", label, err)
+		}
+
+		got, err := s.Route(r.ID)
+		if err != nil {
+			t.Fatalf("%s: could not get route: %v", label, err)
+		}
+
+		if !got.Nodes[1].Done() {
+			t.Errorf("%s: second node was overwritten by first node: %+v", label, got.Nodes[1])
+		}
+		if len(got.Hops) == 0 || got.Hops[0].Seconds != 1 {
+			t.Errorf("%s: hop was not recorded: %+v", label, got.Hops)
+		}
+
+		if _, err := s.Route("missing"); err != ErrRouteNotFound {
+			t.Errorf("%s: Route(missing) got %v, want %v", label, err, ErrRouteNotFound)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	b, err := NewBolt(filepath.Join(t.TempDir(), "gcprelay.db"))
+	if err != nil {
+		t.Fatalf("could not open bolt store: %v", err)
+	}
+	defer b.Close()
+
+	stores := map[string]Store{
+		"memory": NewMemory(),
+		"bolt":   b,
+	}
+
+	for label, s := range stores {
+		r := dummyRoute()
+		for i := range r.Nodes {
+			r.Nodes[i].In = time.Date(2017, 12, 17, 1, 0, 2*i, 0, time.UTC)
+			r.Nodes[i].Out = time.Date(2017, 12, 17, 1, 0, 2*i+1, 0, time.UTC)
+		}
+		r.CalculateHops()
+
+		if err := s.RecordRoute("australia-southeast1-a", r); err != nil {
+			t.Fatalf("%s: could not record route: %v", label, err)
+		}
+
+		hops, err := s.History()
+		if err != nil {
+			t.Fatalf("%s: could not get history: %v", label, err)
+		}
+		if len(hops) != 2 {
+			t.Fatalf("%s: got %d hops, want 2", label, len(hops))
+		}
+		if hops[0].Origin.Host.Name != "asia-east1-a" || hops[1].Destination.Host.Name != "australia-southeast1-a" {
+			t.Errorf("%s: hops are out of order: %+v", label, hops)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	b, err := NewBolt(filepath.Join(t.TempDir(), "gcprelay.db"))
+	if err != nil {
+		t.Fatalf("could not open bolt store: %v", err)
+	}
+	defer b.Close()
+
+	stores := map[string]Store{
+		"memory": NewMemory(),
+		"bolt":   b,
+	}
+
+	defer func() { now = time.Now }()
+	defer route.SetLayout(route.CurrentLayout())
+
+	zones := []string{"asia-east1-a", "asia-northeast1-a", "australia-southeast1-a"}
+	l := route.CurrentLayout()
+	l.Order = zones
+	for label, s := range stores {
+		if err := route.SetLayout(l); err != nil {
+			t.Fatalf("could not set layout: %v", err)
+		}
+
+		// The dead node was last seen before StaleAfter.
+		now = func() time.Time { return time.Now().Add(-2 * StaleAfter) }
+		if err := s.Register(&route.Host{Name: "asia-east1-a"}); err != nil {
+			t.Fatalf("%s: could not register dead node: %v", label, err)
+		}
+
+		now = time.Now
+		for _, name := range []string{"asia-northeast1-a", "australia-southeast1-a"} {
+			if err := s.Register(&route.Host{Name: name}); err != nil {
+				t.Fatalf("%s: could not register %s: %v", label, name, err)
+			}
+		}
+
+		r, err := s.DefaultRoute()
+		if err != nil {
+			t.Fatalf("%s: could not get default route: %v", label, err)
+		}
+		if len(r.Nodes) != 2 || r.CurrentNode("asia-east1-a") != len(r.Nodes) {
+			t.Errorf("%s: stale node was not left out of route: %+v", label, r.Nodes)
+		}
+
+		reaped, err := s.Reap()
+		if err != nil {
+			t.Fatalf("%s: could not reap: %v", label, err)
+		}
+		if len(reaped) != 1 || reaped[0] != "asia-east1-a" {
+			t.Errorf("%s: got reaped %v, want [asia-east1-a]", label, reaped)
+		}
+
+		if err := s.Deregister("asia-northeast1-a"); err != nil {
+			t.Fatalf("%s: could not deregister: %v", label, err)
+		}
+
+		r, err = s.DefaultRoute()
+		if err != nil {
+			t.Fatalf("%s: could not get default route: %v", label, err)
+		}
+		if len(r.Nodes) != 1 || r.Nodes[0].Host.Name != "australia-southeast1-a" {
+			t.Errorf("%s: deregistered node is still in route: %+v", label, r.Nodes)
+		}
+
+		// A zone that never registered a node is a mistake in the layout.
+		missing := l
+		missing.Order = append(zones, "us-west1-a")
+		if err := route.SetLayout(missing); err != nil {
+			t.Fatalf("could not set layout: %v", err)
+		}
+		if _, err := s.DefaultRoute(); err == nil {
+			t.Errorf("%s: got a route without a node for us-west1-a", label)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	b, err := NewBolt(filepath.Join(t.TempDir(), "gcprelay.db"))
+	if err != nil {
+		t.Fatalf("could not open bolt store: %v", err)
+	}
+	defer b.Close()
+
+	stores := map[string]Store{
+		"memory": NewMemory(),
+		"bolt":   b,
+	}
+
+	for label, s := range stores {
+		if err := s.SetStatus("dummy", route.StatusCancelled, ""); err != ErrRouteNotFound {
+			t.Errorf("%s: missing route got %v, want %v", label, err, ErrRouteNotFound)
+		}
+
+		r := dummyRoute()
+		r.SetStatus(route.StatusPending, "")
+		r.SetStatus(route.StatusInFlight, "")
+		if err := s.RecordRoute("asia-east1-a", r); err != nil {
+			t.Fatalf("%s: could not record route: %v", label, err)
+		}
+
+		active, err := s.Active()
+		if err != nil {
+			t.Fatalf("%s: could not get active routes: %v", label, err)
+		}
+		if len(active) != 1 || active[0].ID != r.ID {
+			t.Errorf("%s: got active routes %+v, want %s", label, active, r.ID)
+		}
+
+		if err := s.SetStatus(r.ID, route.StatusCancelled, "test"); err != nil {
+			t.Fatalf("%s: could not cancel route: %v", label, err)
+		}
+		if err := s.SetStatus(r.ID, route.StatusTimedOut, "test"); !errors.Is(err, route.ErrBadTransition) {
+			t.Errorf("%s: timing out a cancelled route got %v, want %v", label, err, route.ErrBadTransition)
+		}
+
+		// A node that finishes the route afterwards doesn't bring it back.
+		r.Nodes[0].In, r.Nodes[0].Out = time.Now(), time.Now()
+		r.SetStatus(route.StatusCompleted, "")
+		if err := s.RecordRoute("asia-east1-a", r); err != nil {
+			t.Fatalf("%s: could not record route: %v", label, err)
+		}
+
+		got, err := s.Route(r.ID)
+		if err != nil {
+			t.Fatalf("%s: could not get route: %v", label, err)
+		}
+		if got.Status != route.StatusCancelled || len(got.Transitions) != 3 {
+			t.Errorf("%s: got status %s after %+v, want %s", label, got.Status, got.Transitions, route.StatusCancelled)
+		}
+
+		if active, err := s.Active(); err != nil || len(active) != 0 {
+			t.Errorf("%s: cancelled route is still active: %+v %v", label, active, err)
+		}
+	}
+}
+
+func TestFrames(t *testing.T) {
+	b, err := NewBolt(filepath.Join(t.TempDir(), "gcprelay.db"))
+	if err != nil {
+		t.Fatalf("could not open bolt store: %v", err)
+	}
+	defer b.Close()
+
+	stores := map[string]Store{
+		"memory": NewMemory(),
+		"bolt":   b,
+	}
+
+	for label, s := range stores {
+		// Frames are saved out of order, and alongside another route's.
+		for _, i := range []int{2, 0, 1} {
+			if err := s.SaveFrame("dummy", route.Frame{Index: i, Postcard: "frame"}); err != nil {
+				t.Fatalf("%s: could not save frame: %v", label, err)
+			}
+		}
+		if err := s.SaveFrame("dummy2", route.Frame{Index: 0}); err != nil {
+			t.Fatalf("%s: could not save frame: %v", label, err)
+		}
+
+		frames, err := s.Frames("dummy")
+		if err != nil {
+			t.Fatalf("%s: could not get frames: %v", label, err)
+		}
+		if len(frames) != 3 {
+			t.Fatalf("%s: got %d frames, want 3", label, len(frames))
+		}
+		for i, f := range frames {
+			if f.Index != i || f.Postcard != "frame" {
+				t.Errorf("%s: got frame %+v at %d", label, f, i)
+			}
+		}
+
+		if frames, err := s.Frames("missing"); err != nil || len(frames) != 0 {
+			t.Errorf("%s: missing route got frames %+v %v", label, frames, err)
+		}
+	}
+}
+
+func TestPrintJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gcprelay.db")
+	b, err := NewBolt(path)
+	if err != nil {
+		t.Fatalf("could not open bolt store: %v", err)
+	}
+
+	stores := map[string]Store{
+		"memory": NewMemory(),
+		"bolt":   b,
+	}
+
+	for label, s := range stores {
+		for _, status := range []printqueue.Status{printqueue.StatusQueued, printqueue.StatusPrinted} {
+			if err := s.SaveJob(printqueue.Job{ID: "dummy", Status: status}); err != nil {
+				t.Fatalf("%s: could not save job: %v", label, err)
+			}
+		}
+
+		jobs, err := s.PrintJobs()
+		if err != nil {
+			t.Fatalf("%s: could not get jobs: %v", label, err)
+		}
+		if len(jobs) != 1 || jobs[0].ID != "dummy" || jobs[0].Status != printqueue.StatusPrinted {
+			t.Errorf("%s: got jobs %+v", label, jobs)
+		}
+	}
+
+	// Jobs are still there when the database is opened again.
+	b.Close()
+	if b, err = NewBolt(path); err != nil {
+		t.Fatalf("could not open bolt store again: %v", err)
+	}
+	defer b.Close()
+	if jobs, err := b.PrintJobs(); err != nil || len(jobs) != 1 {
+		t.Errorf("got jobs %+v %v after opening again", jobs, err)
+	}
+}
+
+func dummyRoute() *route.Route {
+	r := &route.Route{ID: "dummy"}
+	r.AddNode(route.Node{Host: route.Host{Name: "asia-east1-a"}})
+	r.AddNode(route.Node{Host: route.Host{Name: "asia-northeast1-a"}})
+	r.AddNode(route.Node{Host: route.Host{Name: "australia-southeast1-a"}})
+	return r
+}
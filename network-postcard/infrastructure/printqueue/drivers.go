@@ -0,0 +1,204 @@
+package printqueue
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Open returns the driver for a printer spec:
+//   - ipp://host/path, or ipps://, for a printer that speaks IPP.
+//   - lp, or lp:printer, for a CUPS queue, through the lp command.
+//   - dir:path to write every job to a directory.
+func Open(spec string) (Driver, error) {
+	switch {
+	case strings.HasPrefix(spec, "ipp://"), strings.HasPrefix(spec, "ipps://"):
+		return &IPP{URL: spec}, nil
+	case spec == "lp":
+		return &LP{}, nil
+	case strings.HasPrefix(spec, "lp:"):
+		return &LP{Printer: strings.TrimPrefix(spec, "lp:")}, nil
+	case strings.HasPrefix(spec, "dir:"):
+		return &Dir{Path: strings.TrimPrefix(spec, "dir:")}, nil
+	}
+	return nil, fmt.Errorf("unknown printer '%s'", spec)
+}
+
+// Dir writes every job to a directory, as postcard-{id}-{attempt}.pdf. It
+// is meant for testing, and for printing from another machine.
+type Dir struct {
+	Path string
+}
+
+// Print writes the document to the directory. It is written under another
+// name first, so that nothing watching the directory sees half of it.
+func (d *Dir) Print(ctx context.Context, j Job, doc []byte) error {
+	if err := os.MkdirAll(d.Path, 0755); err != nil {
+		return fmt.Errorf("could not create print directory: %v", err)
+	}
+
+	name := filepath.Join(d.Path, fmt.Sprintf("postcard-%s-%d.pdf", j.ID, j.Attempts))
+	if err := ioutil.WriteFile(name+".tmp", doc, 0644); err != nil {
+		return fmt.Errorf("could not write job: %v", err)
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return fmt.Errorf("could not write job: %v", err)
+	}
+	return nil
+}
+
+// LP prints with the CUPS lp command. Set the media and anything else the
+// printer needs with lpoptions, or in Options.
+type LP struct {
+	// Printer is the CUPS destination. The default one is used if it is
+	// empty.
+	Printer string
+	// Options are passed to lp with -o.
+	Options []string
+	// Command is the lp command. It defaults to lp.
+	Command string
+}
+
+// Print pipes the document to lp.
+func (l *LP) Print(ctx context.Context, j Job, doc []byte) error {
+	command := l.Command
+	if command == "" {
+		command = "lp"
+	}
+
+	args := []string{"-t", "postcard-" + j.ID}
+	if l.Printer != "" {
+		args = append(args, "-d", l.Printer)
+	}
+	for _, o := range l.Options {
+		args = append(args, "-o", o)
+	}
+
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdin = bytes.NewReader(doc)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("lp failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// IPP prints straight to a printer, or a print server, with an IPP
+// Print-Job request.
+type IPP struct {
+	// URL is the printer, like ipp://printer.local/ipp/print.
+	URL string
+	// Client sends the request. It defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+const (
+	ippVersion  = 0x0101
+	ippPrintJob = 0x0002
+
+	ippOperationAttributes = 0x01
+	ippEndOfAttributes     = 0x03
+
+	ippName     = 0x42
+	ippURI      = 0x45
+	ippCharset  = 0x47
+	ippLanguage = 0x48
+	ippMimeType = 0x49
+)
+
+// Print sends the document to the printer.
+func (p *IPP) Print(ctx context.Context, j Job, doc []byte) error {
+	endpoint, err := ippEndpoint(p.URL)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(ippRequest(p.URL, j, doc)))
+	if err != nil {
+		return fmt.Errorf("could not create ipp request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/ipp")
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach printer: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("printer answered %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read printer response: %v", err)
+	}
+	if len(body) < 8 {
+		return fmt.Errorf("printer response is too short")
+	}
+	// Status codes from 0x0100 up are errors.
+	if status := binary.BigEndian.Uint16(body[2:4]); status >= 0x0100 {
+		return fmt.Errorf("printer refused the job with status 0x%04x", status)
+	}
+	return nil
+}
+
+// ippEndpoint returns the http address of an ipp:// or ipps:// printer. IPP
+// is served over http, on port 631 unless there is another one.
+func ippEndpoint(printer string) (string, error) {
+	u, err := url.Parse(printer)
+	if err != nil {
+		return "", fmt.Errorf("could not parse printer url: %v", err)
+	}
+
+	switch u.Scheme {
+	case "ipp":
+		u.Scheme = "http"
+	case "ipps":
+		u.Scheme = "https"
+	default:
+		return "", fmt.Errorf("printer url '%s' is not ipp:// or ipps://", printer)
+	}
+	if u.Port() == "" {
+		u.Host += ":631"
+	}
+	return u.String(), nil
+}
+
+// ippRequest encodes a Print-Job request for the document.
+func ippRequest(printer string, j Job, doc []byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint16(ippVersion))
+	binary.Write(&b, binary.BigEndian, uint16(ippPrintJob))
+	binary.Write(&b, binary.BigEndian, uint32(j.Attempts))
+
+	b.WriteByte(ippOperationAttributes)
+	ippAttribute(&b, ippCharset, "attributes-charset", "utf-8")
+	ippAttribute(&b, ippLanguage, "attributes-natural-language", "en")
+	ippAttribute(&b, ippURI, "printer-uri", printer)
+	ippAttribute(&b, ippName, "requesting-user-name", "gcprelay")
+	ippAttribute(&b, ippName, "job-name", "postcard-"+j.ID)
+	ippAttribute(&b, ippMimeType, "document-format", "application/pdf")
+	b.WriteByte(ippEndOfAttributes)
+
+	b.Write(doc)
+	return b.Bytes()
+}
+
+func ippAttribute(b *bytes.Buffer, tag byte, name, value string) {
+	b.WriteByte(tag)
+	binary.Write(b, binary.BigEndian, uint16(len(name)))
+	b.WriteString(name)
+	binary.Write(b, binary.BigEndian, uint16(len(value)))
+	b.WriteString(value)
+}
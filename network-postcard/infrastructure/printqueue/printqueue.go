@@ -0,0 +1,333 @@
+// Package printqueue prints finished postcards one at a time, and keeps a
+// record of every one it was asked to print in a Store, so that the record
+// outlasts a restart. Each route is only printed once unless it is reprinted
+// on purpose. Jobs are sent to the printer by a Driver, so the same queue
+// works with an IPP printer, a CUPS queue, or a directory for testing.
+package printqueue
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrDuplicate means the route already has a job.
+	ErrDuplicate = fmt.Errorf("route already has a print job")
+	// ErrNotFound means the route has no job.
+	ErrNotFound = fmt.Errorf("print job was not found")
+	// ErrBadState means a job can't be reprinted or cancelled in the
+	// state it is in.
+	ErrBadState = fmt.Errorf("print job can not do that now")
+)
+
+// Status is where a job is in its life.
+type Status string
+
+const (
+	// StatusQueued is a job that is waiting for the printer.
+	StatusQueued Status = "queued"
+	// StatusPrinting is a job that has been sent to the printer.
+	StatusPrinting Status = "printing"
+	// StatusPrinted is a job the printer took.
+	StatusPrinted Status = "printed"
+	// StatusFailed is a job the printer didn't take after every retry.
+	StatusFailed Status = "failed"
+	// StatusCancelled is a job that was stopped on purpose.
+	StatusCancelled Status = "cancelled"
+)
+
+// Job is the printing of a route's postcard.
+type Job struct {
+	// ID is the id of the route.
+	ID     string `json:"id"`
+	Status Status `json:"status"`
+	// Attempts is how many times the job has been sent to the printer,
+	// and Printed how many of those it took, counting reprints.
+	Attempts int       `json:"attempts"`
+	Printed  int       `json:"printed"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+
+	// run counts the times the job has been queued, so that a print that
+	// was cancelled can't change a job that has been queued again since.
+	run    int
+	cancel context.CancelFunc
+}
+
+// Driver sends a document to a printer.
+type Driver interface {
+	Print(ctx context.Context, j Job, doc []byte) error
+}
+
+// Store keeps the record of every job.
+type Store interface {
+	// SaveJob records a job as it is now.
+	SaveJob(j Job) error
+	// PrintJobs returns every job that was recorded.
+	PrintJobs() ([]Job, error)
+}
+
+// Queue prints jobs one at a time, in the order they were queued.
+type Queue struct {
+	driver Driver
+	render func(id string) ([]byte, error)
+	store  Store
+
+	// Retries is how many more times printing is tried before a job
+	// fails, and Backoff how long to wait before the first retry. The wait
+	// doubles with every retry after that.
+	Retries int
+	Backoff time.Duration
+
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	pending []*Job
+	working bool
+	// idle is closed when the queue has nothing left to print.
+	idle chan struct{}
+}
+
+// New returns a Queue that prints with driver the documents that render
+// returns for a route id, and records its jobs in store. The jobs store
+// already has are picked up where they were left: ones that were waiting
+// are queued again, and ones that were being printed are failed, since they
+// may have printed already and are only printed again on purpose. A nil
+// store keeps the record in memory.
+func New(driver Driver, render func(id string) ([]byte, error), store Store) (*Queue, error) {
+	idle := make(chan struct{})
+	close(idle)
+	q := &Queue{
+		driver:  driver,
+		render:  render,
+		store:   store,
+		Retries: 3,
+		Backoff: time.Second,
+		jobs:    make(map[string]*Job),
+		idle:    idle,
+	}
+	if store == nil {
+		return q, nil
+	}
+
+	jobs, err := store.PrintJobs()
+	if err != nil {
+		return nil, fmt.Errorf("could not load print jobs: %v", err)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Updated.Before(jobs[k].Updated) })
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := range jobs {
+		j := &jobs[i]
+		q.jobs[j.ID] = j
+		switch j.Status {
+		case StatusQueued:
+			q.queue(j, j.Updated)
+		case StatusPrinting:
+			j.Status = StatusFailed
+			j.Error = "stopped while it was printing"
+			j.Updated = time.Now()
+			q.save(j)
+		}
+	}
+	return q, nil
+}
+
+// Add queues a route to be printed. A route that already has a job isn't
+// printed again; its job is returned with ErrDuplicate.
+func (q *Queue) Add(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if j, ok := q.jobs[id]; ok {
+		return *j, ErrDuplicate
+	}
+
+	now := time.Now()
+	j := &Job{ID: id, Created: now}
+	q.jobs[id] = j
+	q.queue(j, now)
+	q.save(j)
+	return *j, nil
+}
+
+// Reprint queues a job that is over to be printed again.
+func (q *Queue) Reprint(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	if j.Status == StatusQueued || j.Status == StatusPrinting {
+		return *j, fmt.Errorf("%w: it is %s", ErrBadState, j.Status)
+	}
+
+	j.Error = ""
+	q.queue(j, time.Now())
+	q.save(j)
+	return *j, nil
+}
+
+// Cancel stops a job that is waiting, or being sent to the printer.
+func (q *Queue) Cancel(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+
+	switch j.Status {
+	case StatusQueued:
+		for i, p := range q.pending {
+			if p == j {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				break
+			}
+		}
+	case StatusPrinting:
+		j.cancel()
+	default:
+		return *j, fmt.Errorf("%w: it is %s", ErrBadState, j.Status)
+	}
+
+	j.Status = StatusCancelled
+	j.Updated = time.Now()
+	q.save(j)
+	return *j, nil
+}
+
+// Job returns the job of a route.
+func (q *Queue) Job(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+// Jobs returns every job, oldest first.
+func (q *Queue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]Job, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		jobs = append(jobs, *j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Created.Before(jobs[k].Created) })
+	return jobs
+}
+
+// Idle returns a channel that is closed once there is nothing left to
+// print.
+func (q *Queue) Idle() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.idle
+}
+
+// queue puts a job in line, and starts printing if nothing is. It must be
+// called with mu held.
+func (q *Queue) queue(j *Job, now time.Time) {
+	j.Status = StatusQueued
+	j.Updated = now
+	j.run++
+	q.pending = append(q.pending, j)
+
+	if !q.working {
+		q.working = true
+		q.idle = make(chan struct{})
+		go q.work()
+	}
+}
+
+// save records a job in the store, if there is one. It must be called with
+// mu held.
+func (q *Queue) save(j *Job) {
+	if q.store == nil {
+		return
+	}
+	if err := q.store.SaveJob(*j); err != nil {
+		log.Printf("error: could not save print job %s: %v", j.ID, err)
+	}
+}
+
+// work prints the jobs in line until there are none left.
+func (q *Queue) work() {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.working = false
+			close(q.idle)
+			q.mu.Unlock()
+			return
+		}
+		j := q.pending[0]
+		q.pending = q.pending[1:]
+
+		ctx, cancel := context.WithCancel(context.Background())
+		j.Status = StatusPrinting
+		j.Updated = time.Now()
+		j.cancel = cancel
+		run := j.run
+		snapshot := *j
+		q.save(j)
+		q.mu.Unlock()
+
+		attempts, err := q.print(ctx, snapshot)
+		cancel()
+
+		q.mu.Lock()
+		j.Attempts += attempts
+		if j.run == run && j.Status == StatusPrinting {
+			j.Updated = time.Now()
+			if err != nil {
+				j.Status = StatusFailed
+				j.Error = err.Error()
+			} else {
+				j.Status = StatusPrinted
+				j.Printed++
+			}
+		}
+		q.save(j)
+		q.mu.Unlock()
+	}
+}
+
+// print renders the job's document and sends it to the printer, retrying
+// with backoff. It returns how many times the printer was tried.
+func (q *Queue) print(ctx context.Context, j Job) (int, error) {
+	doc, err := q.render(j.ID)
+	if err != nil {
+		return 0, fmt.Errorf("could not render postcard: %v", err)
+	}
+
+	backoff := q.Backoff
+	for attempt := 1; ; attempt++ {
+		j.Attempts++
+		err = q.driver.Print(ctx, j, doc)
+		if err == nil || ctx.Err() != nil || attempt > q.Retries {
+			return attempt, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,345 @@
+package printqueue
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDriver fails the first failures prints, and blocks every print until
+// release is closed, if it is set.
+type fakeDriver struct {
+	mu       sync.Mutex
+	failures int
+	printed  []string
+	started  chan string
+	release  chan struct{}
+}
+
+func (f *fakeDriver) Print(ctx context.Context, j Job, doc []byte) error {
+	if f.started != nil {
+		f.started <- j.ID
+	}
+	if f.release != nil {
+		select {
+		case <-f.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return fmt.Errorf("out of paper")
+	}
+	f.printed = append(f.printed, string(doc))
+	return nil
+}
+
+func render(id string) ([]byte, error) {
+	if id == "broken" {
+		return nil, fmt.Errorf("no such route")
+	}
+	return []byte("pdf of " + id), nil
+}
+
+func newQueue(d Driver) *Queue {
+	q, _ := New(d, render, nil)
+	q.Backoff = time.Millisecond
+	return q
+}
+
+// mapStore keeps jobs in a map.
+type mapStore struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+func (m *mapStore) SaveJob(j Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[j.ID] = j
+	return nil
+}
+
+func (m *mapStore) PrintJobs() ([]Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var jobs []Job
+	for _, j := range m.jobs {
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+func TestQueue(t *testing.T) {
+	d := &fakeDriver{failures: 1}
+	q := newQueue(d)
+
+	for _, id := range []string{"first", "second", "broken"} {
+		if _, err := q.Add(id); err != nil {
+			t.Fatalf("could not add %s: %v", id, err)
+		}
+	}
+	// Routes are only printed once.
+	if j, err := q.Add("first"); err != ErrDuplicate || j.ID != "first" {
+		t.Errorf("adding a route again got %+v %v, want %v", j, err, ErrDuplicate)
+	}
+	<-q.Idle()
+
+	if got := strings.Join(d.printed, ","); got != "pdf of first,pdf of second" {
+		t.Errorf("printed %s", got)
+	}
+
+	// The first print ran out of paper, and was retried.
+	if j, _ := q.Job("first"); j.Status != StatusPrinted || j.Attempts != 2 || j.Printed != 1 {
+		t.Errorf("got first job %+v", j)
+	}
+	if j, _ := q.Job("broken"); j.Status != StatusFailed || j.Error == "" || j.Attempts != 0 {
+		t.Errorf("got broken job %+v", j)
+	}
+
+	if _, err := q.Reprint("missing"); err != ErrNotFound {
+		t.Errorf("reprinting a missing job got %v, want %v", err, ErrNotFound)
+	}
+	if _, err := q.Reprint("second"); err != nil {
+		t.Fatalf("could not reprint: %v", err)
+	}
+	<-q.Idle()
+	if j, _ := q.Job("second"); j.Status != StatusPrinted || j.Printed != 2 {
+		t.Errorf("got reprinted job %+v", j)
+	}
+
+	jobs := q.Jobs()
+	if len(jobs) != 3 || jobs[0].ID != "first" || jobs[2].ID != "broken" {
+		t.Errorf("got jobs %+v", jobs)
+	}
+}
+
+func TestQueueFails(t *testing.T) {
+	q := newQueue(&fakeDriver{failures: 10})
+	q.Retries = 2
+
+	q.Add("jammed")
+	<-q.Idle()
+
+	if j, _ := q.Job("jammed"); j.Status != StatusFailed || j.Attempts != 3 || !strings.Contains(j.Error, "out of paper") {
+		t.Errorf("got job %+v, want it failed after 3 attempts", j)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	d := &fakeDriver{started: make(chan string, 10), release: make(chan struct{})}
+	q := newQueue(d)
+
+	q.Add("printing")
+	q.Add("waiting")
+	<-d.started
+
+	for _, id := range []string{"waiting", "printing"} {
+		if j, err := q.Cancel(id); err != nil || j.Status != StatusCancelled {
+			t.Fatalf("could not cancel %s: %+v %v", id, j, err)
+		}
+	}
+	<-q.Idle()
+
+	if len(d.printed) != 0 {
+		t.Errorf("cancelled jobs were printed: %v", d.printed)
+	}
+	if _, err := q.Cancel("printing"); !errors.Is(err, ErrBadState) {
+		t.Errorf("cancelling a cancelled job got %v, want %v", err, ErrBadState)
+	}
+
+	// A cancelled job can be printed after all.
+	close(d.release)
+	if _, err := q.Reprint("waiting"); err != nil {
+		t.Fatalf("could not reprint: %v", err)
+	}
+	if _, err := q.Reprint("waiting"); !errors.Is(err, ErrBadState) {
+		t.Errorf("reprinting a queued job got %v, want %v", err, ErrBadState)
+	}
+	<-q.Idle()
+	if j, _ := q.Job("waiting"); j.Status != StatusPrinted {
+		t.Errorf("got job %+v, want it printed", j)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	store := &mapStore{jobs: make(map[string]Job)}
+	d := &fakeDriver{}
+	q, err := New(d, render, store)
+	if err != nil {
+		t.Fatalf("could not start queue: %v", err)
+	}
+	q.Add("printed")
+	<-q.Idle()
+
+	// The node stopped with one job being printed, and one waiting.
+	now := time.Now()
+	store.jobs["printing"] = Job{ID: "printing", Status: StatusPrinting, Created: now, Updated: now}
+	store.jobs["waiting"] = Job{ID: "waiting", Status: StatusQueued, Created: now, Updated: now}
+
+	d = &fakeDriver{}
+	q, err = New(d, render, store)
+	if err != nil {
+		t.Fatalf("could not restart queue: %v", err)
+	}
+	<-q.Idle()
+
+	// Routes printed before the restart aren't printed again.
+	if j, err := q.Add("printed"); err != ErrDuplicate || j.Status != StatusPrinted {
+		t.Errorf("adding a printed route got %+v %v, want %v", j, err, ErrDuplicate)
+	}
+	if got := strings.Join(d.printed, ","); got != "pdf of waiting" {
+		t.Errorf("printed %s after restart", got)
+	}
+	if j, _ := q.Job("printing"); j.Status != StatusFailed || j.Error == "" {
+		t.Errorf("got job %+v that was printing, want it failed", j)
+	}
+	if j := store.jobs["waiting"]; j.Status != StatusPrinted || j.Printed != 1 {
+		t.Errorf("got stored job %+v", j)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	cases := []struct {
+		spec string
+		want Driver
+	}{
+		{"ipp://printer.local/ipp/print", &IPP{URL: "ipp://printer.local/ipp/print"}},
+		{"lp", &LP{}},
+		{"lp:kiosk", &LP{Printer: "kiosk"}},
+		{"dir:/tmp/prints", &Dir{Path: "/tmp/prints"}},
+	}
+	for _, c := range cases {
+		got, err := Open(c.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", c.spec, err)
+		}
+		if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", c.want) {
+			t.Errorf("%s: got %#v, want %#v", c.spec, got, c.want)
+		}
+	}
+	if _, err := Open("fax:555"); err == nil {
+		t.Errorf("unknown printer got no error")
+	}
+}
+
+func TestDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prints")
+	q := newQueue(&Dir{Path: path})
+
+	q.Add("abc")
+	<-q.Idle()
+	q.Reprint("abc")
+	<-q.Idle()
+
+	files, _ := filepath.Glob(filepath.Join(path, "*"))
+	if len(files) != 2 || filepath.Base(files[0]) != "postcard-abc-1.pdf" || filepath.Base(files[1]) != "postcard-abc-2.pdf" {
+		t.Fatalf("got files %v", files)
+	}
+	if b, _ := ioutil.ReadFile(files[0]); string(b) != "pdf of abc" {
+		t.Errorf("got %q in file", b)
+	}
+}
+
+func TestLP(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+
+	// A stand in for lp that records what it was called with.
+	script := filepath.Join(dir, "lp")
+	body := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s.args\ncat > %s\n", out, out)
+	if err := ioutil.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatalf("could not write script: %v", err)
+	}
+
+	lp := &LP{Printer: "kiosk", Options: []string{"media=Postcard"}, Command: script}
+	if err := lp.Print(context.Background(), Job{ID: "abc"}, []byte("%PDF")); err != nil {
+		t.Fatalf("could not print: %v", err)
+	}
+
+	args, _ := ioutil.ReadFile(out + ".args")
+	if got := strings.TrimSpace(string(args)); got != "-t postcard-abc -d kiosk -o media=Postcard" {
+		t.Errorf("lp got args %q", got)
+	}
+	if doc, _ := ioutil.ReadFile(out); string(doc) != "%PDF" {
+		t.Errorf("lp got %q on stdin", doc)
+	}
+
+	failing := &LP{Command: filepath.Join(dir, "missing")}
+	if err := failing.Print(context.Background(), Job{ID: "abc"}, nil); err == nil {
+		t.Errorf("missing lp got no error")
+	}
+}
+
+func TestIPP(t *testing.T) {
+	var got []byte
+	status := uint16(0x0000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/ipp" || r.Method != http.MethodPost {
+			t.Errorf("got %s request of %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		got, _ = ioutil.ReadAll(r.Body)
+
+		var reply bytes.Buffer
+		binary.Write(&reply, binary.BigEndian, uint16(ippVersion))
+		binary.Write(&reply, binary.BigEndian, status)
+		reply.Write(got[4:8])
+		reply.WriteByte(ippEndOfAttributes)
+		w.Header().Set("Content-Type", "application/ipp")
+		w.Write(reply.Bytes())
+	}))
+	defer ts.Close()
+
+	printer := strings.Replace(ts.URL, "http://", "ipp://", 1) + "/ipp/print"
+	p := &IPP{URL: printer}
+	if err := p.Print(context.Background(), Job{ID: "abc", Attempts: 1}, []byte("%PDF-1.4")); err != nil {
+		t.Fatalf("could not print: %v", err)
+	}
+
+	if op := binary.BigEndian.Uint16(got[2:4]); op != ippPrintJob {
+		t.Errorf("got operation 0x%04x, want Print-Job", op)
+	}
+	for _, want := range []string{"attributes-charset", "printer-uri\x00" + string(rune(len(printer))) + printer, "postcard-abc", "application/pdf"} {
+		if !bytes.Contains(got, []byte(want)) {
+			t.Errorf("request is missing %q", want)
+		}
+	}
+	if !bytes.HasSuffix(got, []byte{ippEndOfAttributes, '%', 'P', 'D', 'F', '-', '1', '.', '4'}) {
+		t.Errorf("document doesn't follow the attributes")
+	}
+
+	// client-error-not-possible
+	status = 0x0404
+	if err := p.Print(context.Background(), Job{ID: "abc", Attempts: 1}, nil); err == nil || !strings.Contains(err.Error(), "0x0404") {
+		t.Errorf("refused job got %v", err)
+	}
+}
+
+func TestIPPEndpoint(t *testing.T) {
+	cases := map[string]string{
+		"ipp://printer.local/ipp/print":      "http://printer.local:631/ipp/print",
+		"ipps://printer.local:8631/printers": "https://printer.local:8631/printers",
+	}
+	for in, want := range cases {
+		if got, err := ippEndpoint(in); err != nil || got != want {
+			t.Errorf("ippEndpoint(%s) got %s %v, want %s", in, got, err, want)
+		}
+	}
+	if _, err := ippEndpoint("http://printer.local"); err == nil {
+		t.Errorf("http url got no error")
+	}
+}
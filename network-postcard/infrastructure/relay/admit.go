@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/admission"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+// client identifies who started a route, for rate limiting. Behind
+// ProxyHops proxies, it is the address the outermost one saw, which it added
+// to X-Forwarded-For ProxyHops from the end. Anything before that was sent
+// by the client, and could be anything. Requests that didn't come through
+// the proxies are identified by the address they came from.
+func (s *Server) client(r *http.Request) string {
+	if s.ProxyHops > 0 {
+		var forwarded []string
+		for _, f := range r.Header.Values("X-Forwarded-For") {
+			for _, addr := range strings.Split(f, ",") {
+				forwarded = append(forwarded, strings.TrimSpace(addr))
+			}
+		}
+		if len(forwarded) >= s.ProxyHops {
+			if addr := forwarded[len(forwarded)-s.ProxyHops]; addr != "" {
+				return addr
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// setPending marks a new route as pending, along with its place in line if
+// it has to wait.
+func setPending(r *route.Route, position int) error {
+	reason := ""
+	if position > 0 {
+		reason = fmt.Sprintf("queued at position %d", position)
+	}
+	return r.SetStatus(route.StatusPending, reason)
+}
+
+// launch sends a route on its way once it is admitted, and frees its place
+// once it is over. The time it waits isn't part of the route, since the
+// first node stamps it when it is sent.
+func (s *Server) launch(ctx context.Context, r *route.Route, t *admission.Ticket) {
+	select {
+	case <-t.Admitted():
+	default:
+		select {
+		case <-t.Admitted():
+		case <-t.Cancelled():
+			logWithID(r.ID, "route was cancelled while it waited, not sending it")
+			return
+		}
+		// It could have been ended somewhere else while it waited.
+		if <-s.stopped(r.ID) {
+			logWithID(r.ID, "route was ended while it waited, not sending it")
+			s.queue.Done(r.ID)
+			return
+		}
+	}
+	admissionWait.Observe(time.Since(t.Queued).Seconds())
+
+	if err := r.SetStatus(route.StatusInFlight, ""); err != nil {
+		logWithID(r.ID, "error: could not set status: %v", err)
+	}
+	if err := s.save(ctx, r); err != nil {
+		logWithID(r.ID, "error: could not write route to firestore: %v", err)
+	}
+	frame := r.Frame("")
+	spawn("frame", func() { s.saveFrame(r.ID, frame) })
+
+	logWithID(r.ID, "sending message on to next node ")
+	s.forwarding.Add(1)
+	spawn("forward", func() { s.forward(ctx, r) })
+	spawn("admission", func() {
+		s.await(r.ID)
+		s.queue.Done(r.ID)
+		s.print(r.ID)
+	})
+}
+
+// await returns once a route is over, so that its place can go to the next
+// one in line, or once it has made no progress for the deadline, in case no
+// watchdog is running to time it out.
+func (s *Server) await(id string) {
+	updates, cancel := s.feeds.subscribe(id)
+	defer cancel()
+
+	progressed := time.Now()
+	for {
+		t := time.NewTimer(time.Until(progressed.Add(s.deadline())))
+		select {
+		case r := <-updates:
+			t.Stop()
+			if r.Status.Final() {
+				return
+			}
+			if p := r.Progressed(); p.After(progressed) {
+				progressed = p
+			}
+		case <-t.C:
+			logWithID(id, "giving up the place of a route with no progress for %v", s.deadline())
+			return
+		}
+	}
+}
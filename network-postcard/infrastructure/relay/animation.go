@@ -0,0 +1,242 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/persist"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+// animationCacheSize is how many routes' animations a node keeps rendered.
+const animationCacheSize = 16
+
+// animationTimeout is how long a request waits for an animation to be
+// rendered before it is told to try again.
+const animationTimeout = 30 * time.Second
+
+// animationFormats are the animations a route can be downloaded as, by the
+// name they are asked for with.
+var animationFormats = map[string]struct {
+	contentType string
+	encode      func(route.Animation, io.Writer) error
+}{
+	"animation.gif": {"image/gif", route.Animation.EncodeGIF},
+	"animation.png": {"image/apng", route.Animation.EncodeAPNG},
+}
+
+// animations keeps the most recently rendered animations, since rendering
+// one takes a while and a finished postcard tends to be shared right away.
+type animations struct {
+	mu    sync.Mutex
+	items map[string][]byte
+	order []string
+	// pending are the routes being rendered, so that everyone who asks for
+	// one while it is waits for the same render.
+	pending map[string]*rendering
+
+	// rendering lets one animation be rendered at a time, so that a burst
+	// of them doesn't take all of the node's CPU.
+	rendering sync.Mutex
+}
+
+// rendering is the animations of a route being rendered. done is closed once
+// they are.
+type rendering struct {
+	done  chan struct{}
+	items map[string][]byte
+	err   error
+}
+
+func newAnimations() *animations {
+	return &animations{items: make(map[string][]byte), pending: make(map[string]*rendering)}
+}
+
+func (a *animations) get(key string) ([]byte, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	b, ok := a.items[key]
+	return b, ok
+}
+
+func (a *animations) put(key string, b []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.items[key]; !ok {
+		a.order = append(a.order, key)
+	}
+	a.items[key] = b
+	for len(a.order) > animationCacheSize*len(animationFormats) {
+		delete(a.items, a.order[0])
+		a.order = a.order[1:]
+	}
+}
+
+// saveFrame keeps a frame of a route, shrunk to the size it is animated at,
+// so that it stays well under the size the store can hold.
+func (s *Server) saveFrame(id string, f route.Frame) {
+	f, err := f.Shrink(route.AnimationWidth)
+	if err != nil {
+		logWithID(id, "error: could not shrink frame, saving it as it is: %v", err)
+	}
+	if err := s.Store.SaveFrame(id, f); err != nil {
+		persistenceErrors.Inc()
+		logWithID(id, "error: could not save frame: %v", err)
+	}
+}
+
+// animate renders the animations of a route that the node has just
+// completed, so that they are ready by the time they are asked for. They are
+// only rendered if every node that stamped the route has saved its frame by
+// then.
+func (s *Server) animate(id string, status route.Status, stamped int) {
+	if status != route.StatusCompleted {
+		logWithID(id, "route is %s, not animating it", status)
+		return
+	}
+
+	frames, err := s.Store.Frames(id)
+	if err != nil {
+		logWithID(id, "error: could not get frames: %v", err)
+		return
+	}
+	if len(frames) != stamped+1 {
+		logWithID(id, "only %d of %d frames are saved, not animating yet", len(frames), stamped+1)
+		return
+	}
+
+	job := s.startRender(id, frames, true)
+	<-job.done
+	if job.err != nil {
+		logWithID(id, "error: could not animate route: %v", job.err)
+	}
+}
+
+// startRender renders the animations of a route in the background, or
+// returns the render of it that is already under way. They are only kept if
+// keep is set, once the frames can't change any more.
+func (s *Server) startRender(id string, frames []route.Frame, keep bool) *rendering {
+	a := s.animations
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if job, ok := a.pending[id]; ok {
+		return job
+	}
+	job := &rendering{done: make(chan struct{})}
+	a.pending[id] = job
+
+	spawn("animation", func() {
+		a.rendering.Lock()
+		job.items, job.err = render(frames)
+		a.rendering.Unlock()
+
+		// They are kept before the render is let go of, so that there
+		// is no gap where a request would start it again.
+		if job.err == nil && keep {
+			for name, b := range job.items {
+				a.put(id+"/"+name, b)
+			}
+		}
+		a.mu.Lock()
+		delete(a.pending, id)
+		a.mu.Unlock()
+		close(job.done)
+	})
+	return job
+}
+
+// render encodes frames as every format of animation.
+func render(frames []route.Frame) (map[string][]byte, error) {
+	anim, err := route.NewAnimation(frames)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode frames: %v", err)
+	}
+
+	items := make(map[string][]byte)
+	for name, format := range animationFormats {
+		var buf bytes.Buffer
+		if err := format.encode(anim, &buf); err != nil {
+			return nil, fmt.Errorf("could not render %s: %v", name, err)
+		}
+		items[name] = buf.Bytes()
+	}
+	return items, nil
+}
+
+// handleAnimation sends a finished route as an animation of the stamps
+// landing one after another, to download and share. Rendering it is left to
+// the background, and if it takes too long the client is told to try again.
+func (s *Server) handleAnimation(w http.ResponseWriter, r *http.Request, id, name string) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+
+	b, ok := s.animations.get(id + "/" + name)
+	if !ok {
+		rt, err := s.Store.Route(id)
+		if err == persist.ErrRouteNotFound {
+			sendError(w, err, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logWithID(id, "error: could not get route for animation: %v", err)
+			sendError(w, fmt.Errorf("could not get route"), http.StatusInternalServerError)
+			return
+		}
+		if !rt.Status.Final() {
+			sendError(w, fmt.Errorf("route is %s, it can be animated once it is over", rt.Status), http.StatusConflict)
+			return
+		}
+
+		frames, err := s.Store.Frames(id)
+		if err != nil {
+			logWithID(id, "error: could not get frames: %v", err)
+			sendError(w, fmt.Errorf("could not get frames"), http.StatusInternalServerError)
+			return
+		}
+		if len(frames) == 0 {
+			sendError(w, fmt.Errorf("route has no frames"), http.StatusNotFound)
+			return
+		}
+
+		// A completed route has a frame from the start and from every
+		// node that stamped it. Only then is its animation kept.
+		completed := rt.Status == route.StatusCompleted
+		want := len(rt.Visited()) + 1
+		if completed && len(frames) < want {
+			w.Header().Set("Retry-After", "1")
+			sendError(w, fmt.Errorf("only %d of %d frames are saved", len(frames), want), http.StatusServiceUnavailable)
+			return
+		}
+		job := s.startRender(id, frames, completed && len(frames) == want)
+
+		// The server's write timeout is for requests that answer
+		// straight away, and this one waits for the render.
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(animationTimeout + 10*time.Second))
+
+		select {
+		case <-job.done:
+		case <-r.Context().Done():
+			return
+		case <-time.After(animationTimeout):
+			w.Header().Set("Retry-After", "5")
+			sendError(w, fmt.Errorf("animation is still being rendered"), http.StatusServiceUnavailable)
+			return
+		}
+		if job.err != nil {
+			logWithID(id, "error: could not render animation: %v", job.err)
+			sendError(w, fmt.Errorf("could not render animation"), http.StatusInternalServerError)
+			return
+		}
+		b = job.items[name]
+	}
+
+	w.Header().Set("Content-Type", animationFormats[name].contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"postcard-%s-%s\"", id, name))
+	w.Write(b)
+}
@@ -0,0 +1,59 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// arrivalTTL is how long the node remembers a route that got to it, which is
+// well past the time a sender keeps trying to send it.
+const arrivalTTL = 10 * time.Minute
+
+// arrivals are the routes that have got to the node. A node that is slow to
+// answer can be sent a route again by a sender that gave up waiting, and it
+// is only stamped and passed on the first time.
+type arrivals struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newArrivals() *arrivals {
+	return &arrivals{seen: make(map[string]time.Time)}
+}
+
+// arrive records that a route got to the node, and answers false if it
+// already had.
+func (a *arrivals) arrive(key string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for k, expires := range a.seen {
+		if now.After(expires) {
+			delete(a.seen, k)
+		}
+	}
+
+	if _, ok := a.seen[key]; ok {
+		return false
+	}
+	a.seen[key] = now.Add(arrivalTTL)
+	return true
+}
+
+// has answers if a route got to the node.
+func (a *arrivals) has(key string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	expires, ok := a.seen[key]
+	return ok && time.Now().Before(expires)
+}
+
+// forget lets a route that the node couldn't take be sent to it again.
+func (a *arrivals) forget(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.seen, key)
+}
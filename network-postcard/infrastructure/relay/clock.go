@@ -0,0 +1,145 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+const (
+	// clockProbes is how many timestamp exchanges are made with a node. The
+	// one with the least round trip time is the most accurate.
+	clockProbes = 4
+	// clockMaxAge is how long an offset is used before it is measured again.
+	clockMaxAge = 5 * time.Minute
+)
+
+// clockReply is the answer to a clock probe, with the times the probe was
+// received and the reply was sent in nanoseconds since the epoch.
+type clockReply struct {
+	Receive  int64 `json:"receive"`
+	Transmit int64 `json:"transmit"`
+}
+
+// handleClock answers a clock probe from another node.
+func (s *Server) handleClock(w http.ResponseWriter, r *http.Request) {
+	receive := time.Now()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clockReply{Receive: receive.UnixNano(), Transmit: time.Now().UnixNano()})
+}
+
+// clockOffset is the offset of another node's clock from this one.
+type clockOffset struct {
+	offset   time.Duration
+	measured time.Time
+}
+
+// clocks keeps the offsets of the nodes that have sent this node routes.
+type clocks struct {
+	mu      sync.Mutex
+	offsets map[string]clockOffset
+	probing map[string]bool
+}
+
+// offset returns how far the clock of the node at host is ahead of this
+// one's. If it hasn't been measured lately, it is measured in the background
+// for the next route.
+func (c *clocks) offset(host string, probe func(string) (time.Duration, time.Duration, error)) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.offsets == nil {
+		c.offsets = make(map[string]clockOffset)
+		c.probing = make(map[string]bool)
+	}
+
+	o, ok := c.offsets[host]
+	if (!ok || time.Since(o.measured) > clockMaxAge) && !c.probing[host] {
+		c.probing[host] = true
+		go func() {
+			offset, _, err := probe(host)
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			delete(c.probing, host)
+			if err != nil {
+				log.Printf("error: could not measure clock of %s: %v", host, err)
+				return
+			}
+			c.offsets[host] = clockOffset{offset: offset, measured: time.Now()}
+		}()
+	}
+	return o.offset, ok
+}
+
+// probeClock measures how far the clock of the node at host is ahead of this
+// one's, with an NTP style exchange of timestamps. It also returns the round
+// trip delay of the probe the offset was taken from, which the offset can be
+// out by as much as half of.
+func (s *Server) probeClock(host string) (time.Duration, time.Duration, error) {
+	client := &http.Client{Timeout: 2 * time.Second}
+	url := s.Protocol + "://" + host + "/clock"
+
+	var best, bestDelay time.Duration
+	found := false
+	for i := 0; i < clockProbes; i++ {
+		sent := time.Now()
+		resp, err := client.Get(url)
+		if err != nil {
+			return 0, 0, fmt.Errorf("could not probe clock: %v", err)
+		}
+
+		var reply clockReply
+		err = json.NewDecoder(resp.Body).Decode(&reply)
+		resp.Body.Close()
+		received := time.Now()
+		if err != nil {
+			return 0, 0, fmt.Errorf("could not decode clock reply: %v", err)
+		}
+
+		offset, delay := ntpOffset(sent, time.Unix(0, reply.Receive), time.Unix(0, reply.Transmit), received)
+		if !found || delay < bestDelay {
+			best, bestDelay, found = offset, delay, true
+		}
+	}
+	return best, bestDelay, nil
+}
+
+// ntpOffset works out the offset of a remote clock, and the round trip
+// delay, from the time a probe was sent, received by the remote node, the
+// reply sent by it, and the reply received.
+func ntpOffset(sent, receive, transmit, received time.Time) (offset, delay time.Duration) {
+	offset = (receive.Sub(sent) + transmit.Sub(received)) / 2
+	delay = received.Sub(sent) - transmit.Sub(receive)
+	return offset, delay
+}
+
+// recordSkew sets the skew of the named node's clock from the clock of the
+// node that sent it the route, if it is known.
+func (s *Server) recordSkew(r *route.Route, name string) {
+	current := r.CurrentNode(name)
+	if current >= len(r.Nodes) {
+		return
+	}
+
+	var sender *route.Node
+	for i := current - 1; i >= 0; i-- {
+		if !r.Nodes[i].Skipped && !r.Nodes[i].Out.IsZero() {
+			sender = &r.Nodes[i]
+			break
+		}
+	}
+	if sender == nil || sender.Host.Private == "" {
+		return
+	}
+
+	if offset, ok := s.clocks.offset(sender.Host.Private, s.probeClock); ok {
+		// The offset is of the sender's clock from this one.
+		r.Nodes[current].Skew = -offset
+	}
+}
@@ -0,0 +1,226 @@
+package relay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/persist"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+const (
+	// eventPoll is how often the place in line of a route that is being
+	// streamed is checked. The route itself comes from the feeds.
+	eventPoll = 250 * time.Millisecond
+	// eventTimeout is how long a route is streamed for before giving up on
+	// it finishing.
+	eventTimeout = 2 * time.Minute
+)
+
+// HopEvent is sent to the events stream of a route every time a node
+// finishes with it.
+type HopEvent struct {
+	// Step is the index of the node in the route.
+	Step    int       `json:"step"`
+	Steps   int       `json:"steps"`
+	Node    string    `json:"node"`
+	In      time.Time `json:"in,omitempty"`
+	Out     time.Time `json:"out,omitempty"`
+	Seconds float64   `json:"seconds"`
+	Skipped bool      `json:"skipped,omitempty"`
+	// Postcard is the path of the latest version of the postcard.
+	Postcard string `json:"postcard"`
+}
+
+// QueuedEvent is sent to the events stream of a route that is waiting its
+// turn to start, every time its place in line changes. A position of 0 means
+// it has started.
+type QueuedEvent struct {
+	Position int `json:"position"`
+}
+
+// DoneEvent is the last event sent to the events stream of a route.
+type DoneEvent struct {
+	ID string `json:"id"`
+	// Status is how the route ended.
+	Status   route.Status `json:"status"`
+	Steps    int          `json:"steps"`
+	Seconds  float64      `json:"seconds"`
+	Postcard string       `json:"postcard"`
+}
+
+// handleRoutes answers /routes/{id}/events, /routes/{id}/postcard,
+// /routes/{id}/status, /routes/{id}/cancel, /routes/{id}/animation.gif or
+// .png and /routes/{id}/postcard.pdf.
+func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/routes/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch parts[1] {
+	case "events":
+		s.handleEvents(w, r, parts[0])
+	case "postcard":
+		s.handlePostcard(w, r, parts[0])
+	case "status":
+		s.handleStatus(w, r, parts[0])
+	case "cancel":
+		s.handleCancel(w, r, parts[0])
+	case "animation.gif", "animation.png":
+		s.handleAnimation(w, r, parts[0], parts[1])
+	case "postcard.pdf":
+		s.handlePDF(w, r, parts[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleEvents streams the progress of a route as server sent events. The
+// stream can be opened before the route is started.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// The stream stays open for a lot longer than the server's write timeout.
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		logWithID(id, "error: could not clear write deadline: %v", err)
+	}
+
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	updates, cancel := s.feeds.subscribe(id)
+	defer cancel()
+
+	ticker := time.NewTicker(eventPoll)
+	defer ticker.Stop()
+	timeout := time.After(eventTimeout)
+
+	sent := make(map[int]bool)
+	position := 0
+	for {
+		if p, ok := s.queue.Position(id); ok && p != position {
+			sendEvent(w, "queued", 0, QueuedEvent{Position: p})
+			position = p
+			flusher.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timeout:
+			sendEvent(w, "timeout", len(sent), map[string]string{"id": id})
+			flusher.Flush()
+			return
+		case <-ticker.C:
+		case rt := <-updates:
+			for _, e := range hopEvents(rt, sent) {
+				sendEvent(w, "hop", e.Step, e)
+				sent[e.Step] = true
+			}
+
+			if finished(rt) {
+				sendEvent(w, "done", len(rt.Nodes), DoneEvent{
+					ID:       rt.ID,
+					Status:   rt.Status,
+					Steps:    len(rt.Nodes),
+					Seconds:  rt.Total.Seconds,
+					Postcard: postcardPath(rt.ID, len(rt.Nodes)),
+				})
+				flusher.Flush()
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// finished answers if the route is over: it failed, timed out or was
+// cancelled, or it is done and its total has been recorded. A route that
+// didn't reach any node never gets a total.
+func finished(r *route.Route) bool {
+	if r.Status.Final() && r.Status != route.StatusCompleted {
+		return true
+	}
+	return r.Done() && (!r.Total.Destination.Out.IsZero() || len(r.Visited()) == 0)
+}
+
+// hopEvents returns the events for the nodes that have finished with the
+// route and haven't been sent yet.
+func hopEvents(r *route.Route, sent map[int]bool) []HopEvent {
+	var events []HopEvent
+	for i, n := range r.Nodes {
+		if sent[i] || !(n.Done() || n.Skipped) {
+			continue
+		}
+
+		e := HopEvent{
+			Step:     i,
+			Steps:    len(r.Nodes),
+			Node:     n.Host.Name,
+			In:       n.In,
+			Out:      n.Out,
+			Skipped:  n.Skipped,
+			Postcard: postcardPath(r.ID, i),
+		}
+		if i > 0 && i-1 < len(r.Hops) {
+			e.Seconds = r.Hops[i-1].Seconds
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// postcardPath is where the postcard of a route can be fetched from. The step
+// keeps browsers from showing an earlier version of it.
+func postcardPath(id string, step int) string {
+	return fmt.Sprintf("/routes/%s/postcard?step=%d", id, step)
+}
+
+func sendEvent(w http.ResponseWriter, event string, id int, data interface{}) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("error: could not marshal %s event: %v", event, err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", event, id, b)
+}
+
+// handlePostcard sends the latest version of a route's postcard as a png.
+func (s *Server) handlePostcard(w http.ResponseWriter, r *http.Request, id string) {
+	rt, err := s.Store.Route(id)
+	if err == persist.ErrRouteNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logWithID(id, "error: could not get route for postcard: %v", err)
+		http.Error(w, "could not get route", http.StatusInternalServerError)
+		return
+	}
+
+	img, err := base64.StdEncoding.DecodeString(rt.Postcard)
+	if err != nil {
+		logWithID(id, "error: could not decode postcard: %v", err)
+		http.Error(w, "could not decode postcard", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(img)
+}
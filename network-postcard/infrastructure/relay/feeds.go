@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/persist"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+// feedPoll is how often a route that is being watched is read from the
+// store, to pick up the hops recorded by other nodes. The changes this node
+// makes are picked up straight away.
+const feedPoll = time.Second
+
+// feeds sends the latest version of the routes that are being watched to
+// everyone watching them. Each route is read from the store once for all of
+// its watchers: when the node records it or changes its status, and every
+// poll in case another node has.
+type feeds struct {
+	store persist.Store
+	poll  time.Duration
+
+	mu    sync.Mutex
+	feeds map[string]*feed
+}
+
+// feed is a route that is being watched.
+type feed struct {
+	watchers map[chan *route.Route]bool
+	// last is the latest version of the route, for watchers that join
+	// late. It is nil until the route has been read.
+	last    *route.Route
+	changed chan struct{}
+	stop    chan struct{}
+}
+
+func newFeeds(store persist.Store, poll time.Duration) *feeds {
+	return &feeds{store: store, poll: poll, feeds: make(map[string]*feed)}
+}
+
+// subscribe watches a route. Every version of it read from the store is sent
+// on the channel, starting with the latest, or if the watcher falls behind,
+// the newest version is sent in place of the ones it missed. The route is
+// shared with the other watchers, and must not be changed. cancel stops
+// watching.
+func (f *feeds) subscribe(id string) (updates <-chan *route.Route, cancel func()) {
+	ch := make(chan *route.Route, 1)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fd, ok := f.feeds[id]
+	if !ok {
+		fd = &feed{
+			watchers: make(map[chan *route.Route]bool),
+			changed:  make(chan struct{}, 1),
+			stop:     make(chan struct{}),
+		}
+		f.feeds[id] = fd
+		go f.watch(id, fd)
+	}
+	fd.watchers[ch] = true
+	if fd.last != nil {
+		ch <- fd.last
+	}
+
+	return ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		delete(fd.watchers, ch)
+		if len(fd.watchers) == 0 && f.feeds[id] == fd {
+			delete(f.feeds, id)
+			close(fd.stop)
+		}
+	}
+}
+
+// notify has the watchers of a route get its latest version, after the node
+// has changed it in the store.
+func (f *feeds) notify(id string) {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if fd, ok := f.feeds[id]; ok {
+		select {
+		case fd.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// watch reads a route for its watchers until they have all gone.
+func (f *feeds) watch(id string, fd *feed) {
+	t := time.NewTicker(f.poll)
+	defer t.Stop()
+
+	for {
+		r, err := f.store.Route(id)
+		if err != nil && err != persist.ErrRouteNotFound {
+			logWithID(id, "error: could not get route for watchers: %v", err)
+		}
+		if r != nil {
+			f.send(fd, r)
+		}
+
+		select {
+		case <-fd.stop:
+			return
+		case <-fd.changed:
+		case <-t.C:
+		}
+	}
+}
+
+// send gives every watcher the new version of the route, in place of any
+// version it hasn't taken yet.
+func (f *feeds) send(fd *feed, r *route.Route) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fd.last = r
+	for ch := range fd.watchers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- r
+	}
+}
@@ -0,0 +1,299 @@
+package relay
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/auth"
+	"github.com/tpryan/gcprelay/infrastructure/relaypb"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcRelay answers the gRPC Relay service for a Server.
+type grpcRelay struct {
+	relaypb.UnimplementedRelayServer
+	s *Server
+}
+
+// Relay receives a route from the previous node.
+func (g *grpcRelay) Relay(ctx context.Context, in *relaypb.Route) (*relaypb.RelayReply, error) {
+	if g.s.RelayKey.Enabled() {
+		err := verifyProto(ctx, g.s.RelayKey, in)
+		if err == nil {
+			md, _ := metadata.FromIncomingContext(ctx)
+			err = g.s.replays.Check(metadataCarrier(md).Get(auth.SignatureHeader))
+		}
+		if err != nil {
+			log.Printf("error: rejected grpc relay: %v", err)
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+	}
+
+	r := routeFromProto(in)
+	if err := validateRoute(r); err != nil {
+		log.Printf("error: rejected grpc relay: %v", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	logWithID(r.ID, "RELAY received over grpc")
+	relaysReceived.WithLabelValues("grpc").Inc()
+	if err := g.s.hop(incomingContext(ctx), r); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &relaypb.RelayReply{}, nil
+}
+
+func (s *Server) sendGRPC(ctx context.Context, route *route.Route) error {
+	host := route.Next()
+
+	in, err := routeToProto(route)
+	if err != nil {
+		return fmt.Errorf("error: could not convert route: %v", err)
+	}
+
+	conn, err := grpc.NewClient(host, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("error: could not connect to host (%s): %v", host, err)
+	}
+	defer conn.Close()
+
+	ctx = outgoingContext(ctx)
+	if s.RelayKey.Enabled() {
+		if ctx, err = signProto(ctx, s.RelayKey, in); err != nil {
+			return fmt.Errorf("error: could not sign route: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.sendTimeout())
+	defer cancel()
+
+	if _, err := relaypb.NewRelayClient(conn).Relay(ctx, in); err != nil {
+		wrapped := fmt.Errorf("error: client could not relay to host (%s): %v", host, err)
+		// The host couldn't be reached, or it answered that it wouldn't
+		// take the route.
+		switch status.Code(err) {
+		case codes.Unavailable, codes.Unauthenticated, codes.InvalidArgument, codes.Internal:
+			return &undeliveredError{wrapped}
+		}
+		return wrapped
+	}
+	return nil
+}
+
+// signProto adds the signature of a route to the metadata of the call. The
+// route is marshalled deterministically, so that the receiving node can
+// marshal it again to check it.
+func signProto(ctx context.Context, k auth.Key, in *relaypb.Route) (context.Context, error) {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(in)
+	if err != nil {
+		return ctx, err
+	}
+
+	now := time.Now()
+	return metadata.AppendToOutgoingContext(ctx,
+		strings.ToLower(auth.TimestampHeader), strconv.FormatInt(now.UnixNano(), 10),
+		strings.ToLower(auth.SignatureHeader), k.Sign(now, b),
+	), nil
+}
+
+// verifyProto checks the signature in the metadata of a call against the
+// route.
+func verifyProto(ctx context.Context, k auth.Key, in *relaypb.Route) error {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	return k.Verify(metadataCarrier(md).Get(auth.TimestampHeader), b, metadataCarrier(md).Get(auth.SignatureHeader))
+}
+
+func routeToProto(r *route.Route) (*relaypb.Route, error) {
+	postcard, err := base64.StdEncoding.DecodeString(r.Postcard)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode postcard: %v", err)
+	}
+
+	return &relaypb.Route{
+		Id:          r.ID,
+		Nodes:       nodesToProto(r.Nodes),
+		Hops:        hopsToProto(r.Hops),
+		Total:       hopToProto(r.Total),
+		Postcard:    postcard,
+		Initialized: r.Initialized,
+		AllNodes:    nodesToProto(r.AllNodes),
+		AllHops:     hopsToProto(r.AllHops),
+		LastUpdate:  timeToProto(r.LastUpdate),
+		Status:      string(r.Status),
+		Transitions: transitionsToProto(r.Transitions),
+	}, nil
+}
+
+func routeFromProto(in *relaypb.Route) *route.Route {
+	return &route.Route{
+		ID:          in.GetId(),
+		Nodes:       nodesFromProto(in.GetNodes()),
+		Hops:        hopsFromProto(in.GetHops()),
+		Total:       hopFromProto(in.GetTotal()),
+		Postcard:    base64.StdEncoding.EncodeToString(in.GetPostcard()),
+		Initialized: in.GetInitialized(),
+		AllNodes:    nodesFromProto(in.GetAllNodes()),
+		AllHops:     hopsFromProto(in.GetAllHops()),
+		LastUpdate:  timeFromProto(in.GetLastUpdate()),
+		Status:      route.Status(in.GetStatus()),
+		Transitions: transitionsFromProto(in.GetTransitions()),
+	}
+}
+
+func transitionsToProto(transitions []route.Transition) []*relaypb.Transition {
+	var result []*relaypb.Transition
+	for _, t := range transitions {
+		result = append(result, &relaypb.Transition{
+			Status: string(t.Status),
+			At:     timeToProto(t.At),
+			Reason: t.Reason,
+		})
+	}
+	return result
+}
+
+func transitionsFromProto(transitions []*relaypb.Transition) []route.Transition {
+	var result []route.Transition
+	for _, t := range transitions {
+		result = append(result, route.Transition{
+			Status: route.Status(t.GetStatus()),
+			At:     timeFromProto(t.GetAt()),
+			Reason: t.GetReason(),
+		})
+	}
+	return result
+}
+
+func nodesToProto(nodes []route.Node) []*relaypb.Node {
+	var result []*relaypb.Node
+	for _, n := range nodes {
+		result = append(result, nodeToProto(n))
+	}
+	return result
+}
+
+func nodesFromProto(nodes []*relaypb.Node) []route.Node {
+	var result []route.Node
+	for _, n := range nodes {
+		result = append(result, nodeFromProto(n))
+	}
+	return result
+}
+
+func nodeToProto(n route.Node) *relaypb.Node {
+	return &relaypb.Node{
+		Host: &relaypb.Host{
+			Name:     n.Host.Name,
+			Endpoint: n.Host.Endpoint,
+			Private:  n.Host.Private,
+		},
+		In:      timeToProto(n.In),
+		Out:     timeToProto(n.Out),
+		Slot:    int32(n.Slot),
+		Via:     n.Via,
+		Skipped: n.Skipped,
+		Skew:    durationToProto(n.Skew),
+	}
+}
+
+func nodeFromProto(n *relaypb.Node) route.Node {
+	return route.Node{
+		Host: route.Host{
+			Name:     n.GetHost().GetName(),
+			Endpoint: n.GetHost().GetEndpoint(),
+			Private:  n.GetHost().GetPrivate(),
+		},
+		In:      timeFromProto(n.GetIn()),
+		Out:     timeFromProto(n.GetOut()),
+		Slot:    int(n.GetSlot()),
+		Via:     n.GetVia(),
+		Skipped: n.GetSkipped(),
+		Skew:    n.GetSkew().AsDuration(),
+	}
+}
+
+func hopsToProto(hops []route.Hop) []*relaypb.Hop {
+	var result []*relaypb.Hop
+	for _, h := range hops {
+		result = append(result, hopToProto(h))
+	}
+	return result
+}
+
+func hopsFromProto(hops []*relaypb.Hop) []route.Hop {
+	var result []route.Hop
+	for _, h := range hops {
+		result = append(result, hopFromProto(h))
+	}
+	return result
+}
+
+func hopToProto(h route.Hop) *relaypb.Hop {
+	return &relaypb.Hop{
+		Origin:      nodeToProto(h.Origin),
+		Destination: nodeToProto(h.Destination),
+		Duration:    durationpb.New(h.Duration),
+		Nanoseconds: h.Nanoseconds,
+		Seconds:     h.Seconds,
+		RawDuration: durationpb.New(h.RawDuration),
+		RawSeconds:  h.RawSeconds,
+		Skipped:     h.Skipped,
+	}
+}
+
+func hopFromProto(h *relaypb.Hop) route.Hop {
+	if h == nil {
+		return route.Hop{}
+	}
+	return route.Hop{
+		Origin:      nodeFromProto(h.GetOrigin()),
+		Destination: nodeFromProto(h.GetDestination()),
+		Duration:    h.GetDuration().AsDuration(),
+		Nanoseconds: h.GetNanoseconds(),
+		Seconds:     h.GetSeconds(),
+		RawDuration: h.GetRawDuration().AsDuration(),
+		RawSeconds:  h.GetRawSeconds(),
+		Skipped:     h.GetSkipped(),
+	}
+}
+
+// durationToProto leaves zero durations out, as most nodes have no skew.
+func durationToProto(d time.Duration) *durationpb.Duration {
+	if d == 0 {
+		return nil
+	}
+	return durationpb.New(d)
+}
+
+// timeToProto leaves zero times out, so that they are still zero on the
+// other side.
+func timeToProto(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func timeFromProto(t *timestamppb.Timestamp) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.AsTime()
+}
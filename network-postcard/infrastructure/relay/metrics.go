@@ -0,0 +1,71 @@
+package relay
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics that the /metrics endpoint exports.
+var (
+	hopLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gcprelay_hop_latency_seconds",
+		Help:    "Time a route spent on the wire between two nodes.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"origin", "destination"})
+
+	relaysReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcprelay_relays_received_total",
+		Help: "Routes that arrived at the node, by the transport they came over.",
+	}, []string{"via"})
+
+	relaysForwarded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcprelay_relays_forwarded_total",
+		Help: "Routes that were sent on to the next node, by transport.",
+	}, []string{"via"})
+
+	forwardFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcprelay_forward_failures_total",
+		Help: "Attempts to send a route on to the next node that failed, by transport.",
+	}, []string{"via"})
+
+	stampingErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcprelay_stamping_errors_total",
+		Help: "Errors stamping a route or its postcard, by step.",
+	}, []string{"step"})
+
+	persistenceErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gcprelay_persistence_errors_total",
+		Help: "Errors recording a route in the store.",
+	})
+
+	routeOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcprelay_route_outcomes_total",
+		Help: "Routes that this node ended, by the status they ended with.",
+	}, []string{"status"})
+
+	admissionRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcprelay_admission_rejections_total",
+		Help: "New routes that were turned away, by whether the client was over its rate or the queue was full.",
+	}, []string{"reason"})
+
+	admissionWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gcprelay_admission_wait_seconds",
+		Help:    "Time new routes waited in line before they were sent.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	})
+
+	inFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gcprelay_inflight_goroutines",
+		Help: "Goroutines started for routes that have not finished yet, by task.",
+	}, []string{"task"})
+)
+
+// spawn runs f in a goroutine that is counted as in flight until it returns.
+func spawn(task string, f func()) {
+	g := inFlight.WithLabelValues(task)
+	g.Inc()
+	go func() {
+		defer g.Dec()
+		f()
+	}()
+}
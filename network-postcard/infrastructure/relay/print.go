@@ -0,0 +1,172 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/tpryan/gcprelay/infrastructure/pdf"
+	"github.com/tpryan/gcprelay/infrastructure/persist"
+	"github.com/tpryan/gcprelay/infrastructure/printqueue"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+// handlePDF sends a completed route as a print ready PDF, so that printing
+// doesn't depend on the print settings of a browser.
+func (s *Server) handlePDF(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+
+	rt, err := s.Store.Route(id)
+	if err == persist.ErrRouteNotFound {
+		sendError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logWithID(id, "error: could not get route for pdf: %v", err)
+		sendError(w, fmt.Errorf("could not get route"), http.StatusInternalServerError)
+		return
+	}
+	if rt.Status != route.StatusCompleted {
+		sendError(w, fmt.Errorf("route is %s, only completed routes can be printed", rt.Status), http.StatusConflict)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Postcard(&buf, rt); err != nil {
+		logWithID(id, "error: could not render pdf: %v", err)
+		sendError(w, fmt.Errorf("could not render pdf"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"postcard-%s.pdf\"", id))
+	w.Write(buf.Bytes())
+}
+
+// renderPDF returns the PDF of a route for the print queue.
+func (s *Server) renderPDF(id string) ([]byte, error) {
+	rt, err := s.Store.Route(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Postcard(&buf, rt); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// print queues a route the node started to be printed, once it is over,
+// if it was completed.
+func (s *Server) print(id string) {
+	if s.prints == nil {
+		return
+	}
+
+	rt, err := s.Store.Route(id)
+	if err != nil {
+		logWithID(id, "error: could not get route to print: %v", err)
+		return
+	}
+	if rt.Status != route.StatusCompleted {
+		logWithID(id, "not printing a route that is %s", rt.Status)
+		return
+	}
+
+	if _, err := s.prints.Add(id); err != nil {
+		logWithID(id, "error: could not queue route to print: %v", err)
+		return
+	}
+	logWithID(id, "queued to print")
+}
+
+// handlePrintJobs sends every print job, oldest first.
+func (s *Server) handlePrintJobs(w http.ResponseWriter, r *http.Request) {
+	if s.prints == nil {
+		sendError(w, fmt.Errorf("the node has no printer"), http.StatusNotFound)
+		return
+	}
+	s.sendPrintJSON(w, s.prints.Jobs())
+}
+
+// handlePrintJob answers /print/jobs/{id} with the print job of a route,
+// and lets event staff reprint or cancel it with a POST to
+// /print/jobs/{id}/reprint or /print/jobs/{id}/cancel. Those need the admin
+// key.
+func (s *Server) handlePrintJob(w http.ResponseWriter, r *http.Request) {
+	if s.prints == nil {
+		sendError(w, fmt.Errorf("the node has no printer"), http.StatusNotFound)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/print/jobs/"), "/")
+	id := parts[0]
+	if id == "" || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) == 1 {
+		j, ok := s.prints.Job(id)
+		if !ok {
+			sendError(w, printqueue.ErrNotFound, http.StatusNotFound)
+			return
+		}
+		s.sendPrintJSON(w, j)
+		return
+	}
+
+	var change func(string) (printqueue.Job, error)
+	switch parts[1] {
+	case "reprint":
+		change = s.prints.Reprint
+	case "cancel":
+		change = s.prints.Cancel
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		sendError(w, fmt.Errorf("%s is not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.authorizeAdmin(r); err != nil {
+		logWithID(id, "error: rejected print %s from %s: %v", parts[1], r.RemoteAddr, err)
+		sendError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	j, err := change(id)
+	switch {
+	case err == printqueue.ErrNotFound:
+		sendError(w, err, http.StatusNotFound)
+		return
+	case errors.Is(err, printqueue.ErrBadState):
+		sendError(w, err, http.StatusConflict)
+		return
+	case err != nil:
+		logWithID(id, "error: could not %s print job: %v", parts[1], err)
+		sendError(w, fmt.Errorf("could not %s print job", parts[1]), http.StatusInternalServerError)
+		return
+	}
+
+	logWithID(id, "print job %s", parts[1])
+	s.sendPrintJSON(w, j)
+}
+
+func (s *Server) sendPrintJSON(w http.ResponseWriter, v interface{}) {
+	jsonStr, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error: could not marshal print jobs: %v", err)
+		sendError(w, fmt.Errorf("could not marshal print jobs"), http.StatusInternalServerError)
+		return
+	}
+	sendJSON(w, string(jsonStr), http.StatusOK)
+}
@@ -0,0 +1,911 @@
+// Package relay is the http server that runs on every node. It receives a
+// route.Route, stamps the postcard for the node and passes it on to the next
+// node in the route.
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tpryan/gcprelay/infrastructure/admission"
+	"github.com/tpryan/gcprelay/infrastructure/auth"
+	"github.com/tpryan/gcprelay/infrastructure/persist"
+	"github.com/tpryan/gcprelay/infrastructure/printqueue"
+	"github.com/tpryan/gcprelay/infrastructure/relaypb"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+)
+
+// Server relays postcards for a single node.
+type Server struct {
+	// Host is the identity of the node the server is running on.
+	Host route.Host
+	// Store records nodes and the progress of routes.
+	Store persist.Store
+	// LogPath is where every route that passes through is written as json.
+	// Nothing is written if it is empty.
+	LogPath string
+	// Protocol is used to talk to the other nodes. SSL adds some overhead
+	// to the relay, so it's plain old http in backend communication.
+	Protocol string
+	// Transport is how routes are sent on to the next node, either "http"
+	// for json posts, which is the default, or "grpc". Routes are accepted
+	// over both no matter what it is set to.
+	Transport string
+	// Retries is how many more times sending a route to a node is tried
+	// before the node is skipped. It defaults to 3.
+	Retries int
+	// Backoff is how long to wait before the first retry. The wait doubles
+	// with every retry after that. It defaults to 250ms.
+	Backoff time.Duration
+	// SendTimeout is how long the next node has to answer for a route. A
+	// node that doesn't answer in time may still have the route, so it is
+	// tried again, but never skipped. It defaults to 5s.
+	SendTimeout time.Duration
+	// Heartbeat is how often the node registers itself again, so that it
+	// isn't left out of new routes. It defaults to 20s.
+	Heartbeat time.Duration
+	// MaxInFlight is how many routes started by the node can be on their
+	// way at once. Any more wait in line for their turn, so that a burst of
+	// postcards doesn't slow down the ring and the hop times with it. 0 is
+	// no limit.
+	MaxInFlight int
+	// QueueSize is how many routes can wait in line. It defaults to 100.
+	QueueSize int
+	// RateLimit is how many routes a minute a client can start, and
+	// RateBurst how many it can start at once. 0 is no limit.
+	RateLimit float64
+	RateBurst int
+	// ProxyHops is how many proxies in front of the node, like load
+	// balancers, add the address they got a request from to
+	// X-Forwarded-For. Clients are held to RateLimit by the address the
+	// outermost of them saw. If it is 0, the header is ignored.
+	ProxyHops int
+	// Deadline is how long a route can go without progress before Watch
+	// times it out. It defaults to 2m.
+	Deadline time.Duration
+	// RenderAnimations has the node render the animations of the routes it
+	// finishes straight away, rather than the first time they are asked
+	// for. Rendering takes the same CPU the node stamps routes with, so it
+	// is off by default.
+	RenderAnimations bool
+	// Printer prints the routes the node started once they are completed.
+	// Nothing is printed if it is nil.
+	Printer printqueue.Driver
+	// RelayKey signs the routes sent to other nodes, and routes from other
+	// nodes are rejected unless they are signed with it. Routes are neither
+	// signed nor checked if it is empty.
+	RelayKey auth.Key
+	// TokenKey checks the tokens that clients need to start a route. Any
+	// client can start a route if it is empty.
+	TokenKey auth.Key
+	// AdminKey is what operators send to cancel routes and print jobs. If
+	// it is empty, only a node without a TokenKey allows them.
+	AdminKey auth.Key
+
+	// forwarding tracks the routes that are still being sent on.
+	forwarding sync.WaitGroup
+	// clocks is how far off the clocks of the other nodes are.
+	clocks clocks
+	// replays are the signatures of the routes the node has accepted and
+	// the tokens that started routes, arrivals the routes themselves, and
+	// ended the routes the node cancelled or timed out. They are set up by
+	// Handler.
+	replays  *auth.Replays
+	arrivals *arrivals
+	ended    *arrivals
+	// queue admits the routes the node starts, and limiter holds clients
+	// to RateLimit. They are set up by Handler.
+	queue   *admission.Controller
+	limiter *admission.Limiter
+	// animations are the animations of finished routes the node has
+	// rendered. They are set up by Handler.
+	animations *animations
+	// prints is the print queue of Printer. It is set up by Handler.
+	prints *printqueue.Queue
+	// feeds sends the routes that are being watched to their watchers. It
+	// is set up by Handler.
+	feeds *feeds
+}
+
+const (
+	defaultRetries     = 3
+	defaultBackoff     = 250 * time.Millisecond
+	defaultSendTimeout = 5 * time.Second
+	defaultHeartbeat   = 20 * time.Second
+	defaultQueueSize   = 100
+)
+
+// Handler returns the routes the server answers. gRPC requests are served
+// on the same port as everything else.
+func (s *Server) Handler() http.Handler {
+	queueSize := s.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultQueueSize
+	}
+	s.queue = admission.NewController(s.MaxInFlight, queueSize)
+	s.limiter = admission.NewLimiter(s.RateLimit, s.RateBurst)
+	s.animations = newAnimations()
+	s.feeds = newFeeds(s.Store, feedPoll)
+	s.replays = auth.NewReplays()
+	s.arrivals = newArrivals()
+	s.ended = newArrivals()
+	if s.Printer != nil {
+		prints, err := printqueue.New(s.Printer, s.renderPDF, s.Store)
+		if err != nil {
+			// Without the record of what was printed, routes could be
+			// printed again.
+			log.Printf("error: printing is off: %v", err)
+		}
+		s.prints = prints
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/favicon.ico", s.handleIcon)
+	mux.HandleFunc("/list", s.handleList)
+	mux.HandleFunc("/clock", s.handleClock)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/relay", s.handleRelay)
+	mux.HandleFunc("/routes/", s.handleRoutes)
+	mux.HandleFunc("/print/jobs", s.handlePrintJobs)
+	mux.HandleFunc("/print/jobs/", s.handlePrintJob)
+	mux.HandleFunc("/stats/links", s.handleLinks)
+	mux.HandleFunc("/stats/matrix", s.handleMatrix)
+	mux.HandleFunc("/", s.handleHealth)
+
+	g := grpc.NewServer()
+	relaypb.RegisterRelayServer(g, &grpcRelay{s: s})
+
+	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			g.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}), &http2.Server{})
+}
+
+// Register records the node in the store, so that it is included in new
+// routes.
+func (s *Server) Register() error {
+	return s.Store.Register(&s.Host)
+}
+
+// Deregister removes the node from the store, so that new routes leave it
+// out.
+func (s *Server) Deregister() error {
+	return s.Store.Deregister(s.Host.Name)
+}
+
+// Beat registers the node again every Heartbeat, and reaps the nodes that
+// have stopped doing so, until stop is closed.
+func (s *Server) Beat(stop <-chan struct{}) {
+	interval := s.Heartbeat
+	if interval == 0 {
+		interval = defaultHeartbeat
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		if err := s.Register(); err != nil {
+			log.Printf("error: could not send heartbeat: %v", err)
+		}
+
+		reaped, err := s.Store.Reap()
+		if err != nil {
+			log.Printf("error: could not reap stale nodes: %v", err)
+		}
+		for _, name := range reaped {
+			log.Printf("reaped stale node %s", name)
+		}
+	}
+}
+
+// Wait blocks until the routes that the node is still sending on have left
+// it.
+func (s *Server) Wait() {
+	s.forwarding.Wait()
+}
+
+func (s *Server) handleIcon(w http.ResponseWriter, r *http.Request) {}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	route, err := s.defaultRoute()
+	if err != nil {
+		log.Printf("error: could not get default route: %v", err)
+		sendError(w, fmt.Errorf("could not get route"), http.StatusServiceUnavailable)
+		return
+	}
+
+	jsonStr, err := json.MarshalIndent(route, "", "    ")
+	if err != nil {
+		log.Printf("error: could not marshall default route: %v", err)
+		sendError(w, fmt.Errorf("could not marshal route"), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, string(jsonStr), http.StatusOK)
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "ok")
+}
+
+func (s *Server) firstHop(w http.ResponseWriter, r *http.Request, id, image string) {
+	var route *route.Route
+	var err error
+	logWithID(id, "FIRST received")
+	logWithID(id, "Image received")
+
+	// The trace of the whole trip starts here, unless the caller started it.
+	ctx, span := tracer.Start(requestContext(r), "first-hop", trace.WithAttributes(nodeKey.String(s.Host.Name)))
+	defer span.End()
+
+	ticket, err := s.queue.Enqueue(id)
+	if err != nil {
+		logWithID(id, "error: could not admit route: %v", err)
+		admissionRejections.WithLabelValues("queue").Inc()
+		status := http.StatusConflict
+		if err == admission.ErrQueueFull {
+			status = http.StatusServiceUnavailable
+			w.Header().Set("Retry-After", "10")
+		}
+		sendError(w, err, status)
+		return
+	}
+
+	if route, err = s.defaultRoute(); err != nil {
+		logWithID(id, "error: could not get route: %v", err)
+		fail(span, err)
+		s.queue.Done(id)
+		sendError(w, fmt.Errorf("could not get route"), http.StatusServiceUnavailable)
+		return
+	}
+
+	route.Postcard = image
+	// route.MatteImage()
+
+	rtype := r.URL.Query().Get("type")
+
+	latencies, err := s.latencies(rtype)
+	if err != nil {
+		logWithID(id, "error: could not get route history: %v", err)
+	}
+
+	if err := route.Plan(rtype, latencies); err != nil {
+		logWithID(id, "error: could not plan %s route: %v", rtype, err)
+		if unknownStrategy(err) {
+			s.queue.Done(id)
+			sendError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	route.ID = id
+	span.SetAttributes(routeKey.String(route.ID))
+
+	route.SetVia(s.transport())
+
+	position, _ := s.queue.Position(route.ID)
+	if err := setPending(route, position); err != nil {
+		logWithID(id, "error: could not set status: %v", err)
+	}
+
+	// A route that has to wait its turn is recorded as pending, so that it
+	// can be followed while it waits.
+	if position > 0 {
+		logWithID(id, "queued at position %d", position)
+		if err := s.save(ctx, route); err != nil {
+			logWithID(id, "error: could not write route to firestore: %v", err)
+		}
+		spawn("queue", func() { s.launch(ctx, route, ticket) })
+		sendJSON(w, fmt.Sprintf(`{"id": %q, "status": %q, "position": %d}`, route.ID, route.Status, position), http.StatusAccepted)
+		return
+	}
+
+	s.launch(ctx, route, ticket)
+
+	jsonStr, err := json.MarshalIndent(route, "", "    ")
+	if err != nil {
+		logWithID(id, "error: could not marshall route: %v", err)
+	}
+
+	sendJSON(w, string(jsonStr), http.StatusOK)
+}
+
+func (s *Server) relayHop(w http.ResponseWriter, r *http.Request) {
+	var route *route.Route
+
+	body, err := readBody(w, r)
+	if err != nil {
+		log.Printf("error: could not read incoming json: %v", err)
+		sendError(w, err, statusOf(err))
+		return
+	}
+
+	if s.RelayKey.Enabled() {
+		err := s.RelayKey.VerifyRequest(r.Header, body)
+		if err == nil {
+			err = s.replays.Check(r.Header.Get(auth.SignatureHeader))
+		}
+		if err != nil {
+			log.Printf("error: rejected relay from %s: %v", r.RemoteAddr, err)
+			sendError(w, err, http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if route, err = parseRoute(body); err != nil {
+		log.Printf("error: could not parse incoming json: %v", err)
+		sendError(w, err, statusOf(err))
+		return
+	}
+	logWithID(route.ID, "RELAY received")
+	relaysReceived.WithLabelValues("http").Inc()
+	if err := s.hop(requestContext(r), route); err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+	sendJSON(w, `{"status": "ok"}`, http.StatusOK)
+
+}
+
+// hop does the work of the node on a route that has arrived. The route is
+// stamped before hop returns, so that the node can answer whether it took
+// the route, and passing it on and recording it is left to the background.
+// A route that got to the node before is left alone. ctx carries the trace of
+// the route.
+func (s *Server) hop(ctx context.Context, route *route.Route) error {
+	arrival := route.ID + "/" + s.Host.Name
+	if !s.arrivals.arrive(arrival) {
+		logWithID(route.ID, "route got here already, not stamping it again")
+		return nil
+	}
+
+	ctx, span := tracer.Start(ctx, "hop", trace.WithAttributes(routeKey.String(route.ID), nodeKey.String(s.Host.Name)))
+
+	stopped := s.stopped(route.ID)
+
+	if err := s.stamp(ctx, route); err != nil {
+		logWithID(route.ID, "error: %v", err)
+		fail(span, err)
+		span.End()
+		s.arrivals.forget(arrival)
+		return err
+	}
+
+	s.forwarding.Add(1)
+	spawn("hop", func() {
+		defer s.forwarding.Done()
+		defer span.End()
+		s.passOn(ctx, route, stopped)
+	})
+	return nil
+}
+
+// stamp stamps the route in and out of the node, and the postcard with the
+// stamp of the node.
+func (s *Server) stamp(ctx context.Context, route *route.Route) error {
+	log.Println("stamped in ")
+	_, step := tracer.Start(ctx, "stamp-in")
+	if err := route.Stamp("in"); err != nil {
+		return stampFailed(step, "stamp-in", fmt.Errorf("could not stamp incoming json: %v", err))
+	}
+	step.End()
+
+	logWithID(route.ID, "stamped image ")
+	_, step = tracer.Start(ctx, "StampImage")
+	if err := route.StampImage(s.Host.Name); err != nil {
+		return stampFailed(step, "StampImage", fmt.Errorf("could not stamp incoming image file: %v", err))
+	}
+	step.End()
+
+	// Encoding is part of the work the node does, so it is done before the
+	// route is stamped out and doesn't count as time on the wire.
+	_, step = tracer.Start(ctx, "EncodePostcard")
+	if err := route.EncodePostcard(); err != nil {
+		return stampFailed(step, "EncodePostcard", fmt.Errorf("could not encode postcard: %v", err))
+	}
+	step.End()
+
+	logWithID(route.ID, "stamped out ")
+	_, step = tracer.Start(ctx, "stamp-out")
+	if err := route.Stamp("out"); err != nil {
+		return stampFailed(step, "stamp-out", fmt.Errorf("could not stamp outgoing json: %v", err))
+	}
+	step.End()
+	return nil
+}
+
+// stampFailed records that a step of stamping a route failed, and returns
+// err.
+func stampFailed(step trace.Span, name string, err error) error {
+	stampingErrors.WithLabelValues(name).Inc()
+	fail(step, err)
+	step.End()
+	return err
+}
+
+// passOn records the skew and hops of a route the node has stamped, then
+// sends it on, or finishes it, unless it was ended on its way. stopped
+// answers whether it was.
+func (s *Server) passOn(ctx context.Context, route *route.Route, stopped <-chan bool) {
+	span := trace.SpanFromContext(ctx)
+
+	s.recordSkew(route, s.Host.Name)
+
+	logWithID(route.ID, "calculate route hops")
+	if err := route.CalculateHops(); err != nil {
+		logWithID(route.ID, "error: could not calculate hops: %v", err)
+	}
+
+	// The time the route spent getting here, as opposed to being worked on.
+	if h, ok := incomingHop(route, s.Host.Name); ok {
+		span.SetAttributes(wireKey.Float64(h.Seconds))
+		hopLatency.WithLabelValues(h.Origin.Host.Name, h.Destination.Host.Name).Observe(h.Seconds)
+	}
+
+	if <-stopped {
+		logWithID(route.ID, "route was ended while it was on its way, not passing it on")
+		span.AddEvent("stopped")
+		return
+	}
+
+	if route.Done() {
+		s.finish(route)
+	}
+
+	// The frame is taken once the node is done drawing, and the completed
+	// route is animated once the last frame is saved.
+	frame, done, status, stamped := route.Frame(s.Host.Name), route.Done(), route.Status, len(route.Visited())
+	spawn("frame", func() {
+		s.saveFrame(route.ID, frame)
+		if done && s.RenderAnimations {
+			s.animate(route.ID, status, stamped)
+		}
+	})
+
+	if !route.Done() {
+		route.SetVia(s.transport())
+		logWithID(route.ID, "calling %s sendToNextHost", s.transport())
+		s.forwarding.Add(1)
+		spawn("forward", func() { s.forward(ctx, route) })
+	}
+
+	spawn("disk", func() {
+		logWithID(route.ID, "save to disk")
+		if err := s.saveToDisk(route); err != nil {
+			log.Printf("error: could not write route to disk: %v", err)
+		}
+	})
+
+	spawn("persist", func() {
+		logWithID(route.ID, "save to firestore")
+		if err := s.save(ctx, route); err != nil {
+			logWithID(route.ID, "error: could not write route to firestore: %v", err)
+		}
+	})
+}
+
+// incomingHop returns the hop that brought the route to the named node.
+func incomingHop(r *route.Route, name string) (route.Hop, bool) {
+	i := r.CurrentNode(name)
+	if i == 0 || i > len(r.Hops) || r.Hops[i-1].Skipped {
+		return route.Hop{}, false
+	}
+	return r.Hops[i-1], true
+}
+
+func (s *Server) handleRelay(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		sendError(w, fmt.Errorf("%s is not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	init := r.URL.Query().Get("init")
+
+	if init != "" {
+		id := r.URL.Query().Get("id")
+		if id != "" {
+			if err := validateID(id); err != nil {
+				logWithID(id, "error: rejected new route: %v", err)
+				sendError(w, err, statusOf(err))
+				return
+			}
+		}
+		if err := s.authorizeInit(r); err != nil {
+			logWithID(id, "error: rejected new route from %s: %v", r.RemoteAddr, err)
+			sendError(w, err, http.StatusUnauthorized)
+			return
+		}
+		if ok, wait := s.limiter.Allow(s.client(r)); !ok {
+			logWithID(id, "error: %s is starting routes too fast", s.client(r))
+			admissionRejections.WithLabelValues("rate").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			sendError(w, fmt.Errorf("too many routes, try again in %v", wait.Round(time.Second)), http.StatusTooManyRequests)
+			return
+		}
+		if id == "" {
+			id = route.NewID(32)
+		}
+		image, err := parseImage(w, r)
+		if err != nil {
+			logWithID(id, "error: could not decode image: %v", err)
+			sendError(w, err, statusOf(err))
+			return
+		}
+		s.firstHop(w, r, id, image)
+		return
+
+	}
+
+	s.relayHop(w, r)
+
+}
+
+// authorizeInit checks the token a client sent to start a route. It is taken
+// from the token query parameter, or a bearer Authorization header, and can
+// only start one route.
+func (s *Server) authorizeInit(r *http.Request) error {
+	if !s.TokenKey.Enabled() {
+		return nil
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return s.TokenKey.UseToken(token, s.replays)
+}
+
+// authorizeAdmin checks that an operator action, like cancelling a route or
+// a print job, was sent with the AdminKey in a bearer Authorization header.
+func (s *Server) authorizeAdmin(r *http.Request) error {
+	if !s.AdminKey.Enabled() {
+		if s.TokenKey.Enabled() {
+			return fmt.Errorf("operator actions are turned off, the node has no admin key")
+		}
+		return nil
+	}
+
+	return s.AdminKey.VerifySecret(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+func (s *Server) defaultRoute() (*route.Route, error) {
+
+	// The store has already put the live nodes in the order of the layout.
+	r, err := s.Store.DefaultRoute()
+	if err != nil {
+		return r, fmt.Errorf("failed to get defaultRoute from agent: %v", err)
+	}
+
+	r.AllNodes = r.Nodes
+	r.ConvertAllNodesToHops()
+	return r, nil
+}
+
+// latencies fetches the measured latencies between nodes when the route
+// strategy needs them.
+func (s *Server) latencies(strategy string) (route.Latencies, error) {
+	if strategy != "fastest" {
+		return nil, nil
+	}
+
+	history, err := s.Store.History()
+	if err != nil {
+		return nil, err
+	}
+	return route.MeanLatencies(history), nil
+}
+
+func (s *Server) save(ctx context.Context, r *route.Route) error {
+	_, span := tracer.Start(ctx, "persist")
+	defer span.End()
+
+	if err := s.Store.RecordRoute(s.Host.Name, r); err != nil {
+		persistenceErrors.Inc()
+		fail(span, err)
+		return err
+	}
+	s.feeds.notify(r.ID)
+	return nil
+}
+
+func (s *Server) sendTimeout() time.Duration {
+	if s.SendTimeout == 0 {
+		return defaultSendTimeout
+	}
+	return s.SendTimeout
+}
+
+func (s *Server) transport() string {
+	if s.Transport == "" {
+		return "http"
+	}
+	return s.Transport
+}
+
+// finish adds the totals to a route that has no more nodes to go to. It is
+// completed, unless no node could be reached at all.
+func (s *Server) finish(r *route.Route) {
+	status, reason := route.StatusCompleted, ""
+	if len(r.Visited()) == 0 {
+		status, reason = route.StatusFailed, "no node could be reached"
+	}
+	if err := r.SetStatus(status, reason); err != nil {
+		logWithID(r.ID, "error: could not set status: %v", err)
+	} else {
+		routeOutcomes.WithLabelValues(string(status)).Inc()
+	}
+
+	if err := r.CalculateTotal(); err != nil {
+		logWithID(r.ID, "error: could not calculate total: %v", err)
+	}
+	if err := r.LastStamp(); err != nil {
+		logWithID(r.ID, "error: could not add last stamp: %v", err)
+	}
+	if err := r.EncodePostcard(); err != nil {
+		logWithID(r.ID, "error: could not encode postcard: %v", err)
+	}
+}
+
+// forward passes the route on to the next node. A node that still can't be
+// reached after retrying, or that refuses the route, is skipped, and the
+// route goes to the node after it. If every node left is skipped, this node
+// finishes the route. A node that was sent the route but didn't answer in
+// time is never skipped, since it may be passing the route on already.
+func (s *Server) forward(ctx context.Context, r *route.Route) {
+	defer s.forwarding.Done()
+
+	ctx, span := tracer.Start(ctx, "forward", trace.WithAttributes(routeKey.String(r.ID), nodeKey.String(s.Host.Name)))
+	defer span.End()
+
+	for {
+		err := s.sendWithRetries(ctx, r)
+		if err == nil {
+			return
+		}
+		logWithID(r.ID, "error: could not pass on json: %v", err)
+		fail(span, err)
+		if !undelivered(err) {
+			logWithID(r.ID, "%s may have the route, not skipping it", r.Next())
+			return
+		}
+
+		// The route is still being saved by the node, so the skip is made
+		// on a copy of it.
+		r = r.Clone()
+		node, err := r.Skip()
+		if err != nil {
+			logWithID(r.ID, "error: could not skip node: %v", err)
+			return
+		}
+		logWithID(r.ID, "skipped unreachable node %s", node.Host.Name)
+		span.AddEvent("skipped", trace.WithAttributes(nextKey.String(node.Host.Name)))
+
+		if err := r.CalculateHops(); err != nil {
+			logWithID(r.ID, "error: could not calculate hops: %v", err)
+		}
+
+		if r.Done() {
+			s.finish(r)
+		}
+
+		if err := s.save(ctx, r); err != nil {
+			logWithID(r.ID, "error: could not write route to firestore: %v", err)
+		}
+
+		if r.Done() {
+			return
+		}
+		r.SetVia(s.transport())
+	}
+}
+
+// undeliveredError is a send that the next node can't have acted on, since
+// it couldn't be reached or it refused the route.
+type undeliveredError struct {
+	err error
+}
+
+func (e *undeliveredError) Error() string {
+	return e.err.Error()
+}
+
+// undelivered answers if the route can't have got to the next node.
+func undelivered(err error) bool {
+	var ue *undeliveredError
+	return errors.As(err, &ue)
+}
+
+// sendWithRetries sends the route to the next node, backing off between
+// tries.
+func (s *Server) sendWithRetries(ctx context.Context, r *route.Route) error {
+	retries, backoff := s.Retries, s.Backoff
+	if retries == 0 {
+		retries = defaultRetries
+	}
+	if backoff == 0 {
+		backoff = defaultBackoff
+	}
+
+	var err error
+	for try := 0; try <= retries; try++ {
+		if try > 0 {
+			logWithID(r.ID, "retrying %s in %v: %v", r.Next(), backoff, err)
+			trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(nextKey.String(r.Next())))
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = s.sendToNextHost(ctx, r); err == nil {
+			relaysForwarded.WithLabelValues(s.transport()).Inc()
+			return nil
+		}
+		forwardFailures.WithLabelValues(s.transport()).Inc()
+	}
+	return err
+}
+
+// sendToNextHost sends the route on, along with the trace context in ctx.
+func (s *Server) sendToNextHost(ctx context.Context, route *route.Route) error {
+	if s.transport() == "grpc" {
+		return s.sendGRPC(ctx, route)
+	}
+
+	host := route.Next()
+
+	url := s.Protocol + "://" + host + "/relay"
+
+	jsonStr, err := json.Marshal(route)
+	if err != nil {
+		return fmt.Errorf("error: could not marshal %v", err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConns:        50,
+			IdleConnTimeout:     15 * time.Second,
+			DisableCompression:  true,
+			DisableKeepAlives:   true,
+			TLSHandshakeTimeout: 2 * time.Second,
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		},
+		Timeout: s.sendTimeout()}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonStr))
+	if err != nil {
+		return fmt.Errorf("error: could not create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.RelayKey.Enabled() {
+		s.RelayKey.SignRequest(req.Header, jsonStr)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		var op *net.OpError
+		notSent := errors.As(err, &op) && op.Op == "dial"
+		err = fmt.Errorf("error: client could not relay post to host (%s): %v %v", host, err, resp)
+		// Nothing was sent if the connection couldn't be made.
+		if notSent {
+			return &undeliveredError{err}
+		}
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return &undeliveredError{fmt.Errorf("error: host (%s) would not take relay: %s", host, resp.Status)}
+	}
+
+	resp.Body.Close()
+
+	return nil
+}
+
+func (s *Server) saveToDisk(r *route.Route) error {
+	if s.LogPath == "" {
+		return nil
+	}
+
+	jsonStr, err := json.MarshalIndent(r, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	fname := fmt.Sprintf("%s/%s_%s.json", s.LogPath, r.ID, strconv.Itoa(r.CurrentNode(s.Host.Name)))
+
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("error: could not open log file: %v", err)
+	}
+	defer f.Close()
+
+	if _, err = f.Write(jsonStr); err != nil {
+		return fmt.Errorf("error: could not write to log file: %v", err)
+	}
+	f.Close()
+	return nil
+}
+
+// parseRoute decodes a relayed route, and checks that it can be stamped.
+func parseRoute(body []byte) (*route.Route, error) {
+	var rt *route.Route
+	if err := json.Unmarshal(body, &rt); err != nil {
+		return nil, badRequest("could not decode route: %v", err)
+	}
+	if err := validateRoute(rt); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// parseImage reads the base64 encoded postcard a client sent to start a
+// route, and checks that it is an image that can be stamped.
+func parseImage(w http.ResponseWriter, r *http.Request) (string, error) {
+	body, err := readBody(w, r)
+	if err != nil {
+		return "", err
+	}
+
+	// Query strings and form posts turn the + of base64 into spaces.
+	image := strings.Replace(strings.TrimSpace(string(body)), " ", "+", -1)
+	if image == "" {
+		return "", badRequest("no image was sent")
+	}
+	if err := validateImage(image); err != nil {
+		return "", err
+	}
+	if err := decodeImage(image); err != nil {
+		return "", err
+	}
+	return image, nil
+}
+
+func sendJSON(w http.ResponseWriter, content string, status int) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprint(w, content)
+}
+
+func logWithID(id, format string, a ...interface{}) {
+	if id == "" {
+		id = "NO ID"
+	}
+	log.Printf(id+" - "+format, a...)
+
+}
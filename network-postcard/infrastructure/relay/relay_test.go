@@ -0,0 +1,1254 @@
+package relay
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/auth"
+	"github.com/tpryan/gcprelay/infrastructure/persist"
+	"github.com/tpryan/gcprelay/infrastructure/printqueue"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+	"github.com/tpryan/gcprelay/infrastructure/stats"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRelayRing(t *testing.T) {
+	for _, transport := range []string{"http", "grpc"} {
+		testRelayRing(t, transport)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	testRelayRing(t, "http")
+
+	s := &Server{Store: persist.NewMemory(), Protocol: "http"}
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("could not get metrics: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read metrics: %v", err)
+	}
+
+	for _, want := range []string{
+		`gcprelay_hop_latency_seconds_count{destination="asia-northeast1-a",origin="asia-east1-a"}`,
+		`gcprelay_relays_received_total{via="http"}`,
+		`gcprelay_relays_forwarded_total{via="http"}`,
+		`gcprelay_inflight_goroutines{task="forward"}`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics are missing %s", want)
+		}
+	}
+}
+
+func TestRelayTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer tp.Shutdown(context.Background())
+
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	for _, transport := range []string{"http", "grpc"} {
+		testRelayRing(t, transport)
+
+		var spans []sdktrace.ReadOnlySpan
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			spans = routeSpans(recorder.Ended(), "ring-"+transport)
+			if count(spans, "hop") == 3 && count(spans, "forward") == 3 {
+				break
+			}
+		}
+
+		if count(spans, "first-hop") != 1 || count(spans, "hop") != 3 {
+			t.Fatalf("%s: got %d first-hop and %d hop spans, want 1 and 3", transport, count(spans, "first-hop"), count(spans, "hop"))
+		}
+
+		forwards := make(map[string]bool)
+		for _, span := range spans {
+			if span.SpanContext().TraceID() != spans[0].SpanContext().TraceID() {
+				t.Errorf("%s: %s span is not part of the route trace", transport, span.Name())
+			}
+			if span.Name() == "forward" {
+				forwards[span.SpanContext().SpanID().String()] = true
+			}
+		}
+		for _, span := range spans {
+			if span.Name() == "hop" && !forwards[span.Parent().SpanID().String()] {
+				t.Errorf("%s: hop span is not a child of the forward span that sent it", transport)
+			}
+		}
+	}
+}
+
+// routeSpans returns the spans that are tagged with the route id.
+func routeSpans(spans []sdktrace.ReadOnlySpan, id string) []sdktrace.ReadOnlySpan {
+	var result []sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		for _, a := range span.Attributes() {
+			if a.Key == routeKey && a.Value.AsString() == id {
+				result = append(result, span)
+			}
+		}
+	}
+	return result
+}
+
+func count(spans []sdktrace.ReadOnlySpan, name string) int {
+	n := 0
+	for _, span := range spans {
+		if span.Name() == name {
+			n++
+		}
+	}
+	return n
+}
+
+func testRelayRing(t *testing.T, transport string) {
+	store := persist.NewMemory()
+	names := []string{"asia-east1-a", "asia-northeast1-a", "australia-southeast1-a"}
+
+	entry := startRing(t, store, transport, names, -1)
+	startRoute(t, entry, "ring-"+transport)
+	r := waitForRoute(t, store, "ring-"+transport)
+
+	if len(r.Hops) != len(names)-1 {
+		t.Errorf("%s: wrong number of hops, expected %d got %d", transport, len(names)-1, len(r.Hops))
+	}
+
+	for i, hop := range r.Hops {
+		if hop.Seconds <= 0 {
+			t.Errorf("%s: hop %d %s -> %s got %f seconds, want more than 0", transport, i, hop.Origin.Host.Name, hop.Destination.Host.Name, hop.Seconds)
+		}
+		if hop.Destination.Via != transport {
+			t.Errorf("%s: hop %d arrived via %s", transport, i, hop.Destination.Via)
+		}
+	}
+}
+
+func TestRelaySkipsDeadNode(t *testing.T) {
+	names := []string{"asia-east1-a", "asia-northeast1-a", "australia-southeast1-a", "europe-west2-b"}
+
+	cases := []struct {
+		dead int
+		last string
+	}{
+		{2, "europe-west2-b"},
+		{3, "australia-southeast1-a"},
+	}
+
+	for _, c := range cases {
+		store := persist.NewMemory()
+
+		entry := startRing(t, store, "http", names, c.dead)
+		startRoute(t, entry, "dead")
+		r := waitForRoute(t, store, "dead")
+
+		if !r.Nodes[c.dead].Skipped {
+			t.Errorf("dead %d: node was not skipped: %+v", c.dead, r.Nodes[c.dead])
+		}
+		if len(r.Hops) != len(names)-1 || !r.Hops[c.dead-1].Skipped {
+			t.Errorf("dead %d: skipped hop was not recorded: %+v", c.dead, r.Hops)
+		}
+		for i, hop := range r.Hops {
+			if !hop.Skipped && hop.Seconds <= 0 {
+				t.Errorf("dead %d: hop %d got %f seconds, want more than 0", c.dead, i, hop.Seconds)
+			}
+		}
+		if r.Total.Destination.Host.Name != c.last {
+			t.Errorf("dead %d: route finished on %s, want %s", c.dead, r.Total.Destination.Host.Name, c.last)
+		}
+	}
+}
+
+func TestRelayAfterReap(t *testing.T) {
+	store := persist.NewMemory()
+	names := []string{"asia-east1-a", "asia-northeast1-a", "australia-southeast1-a"}
+	entry := startRing(t, store, "http", names, 1)
+
+	// The node is removed the way Beat removes one that stopped sending
+	// heartbeats, while its zone stays in the layout.
+	if err := store.Deregister(names[1]); err != nil {
+		t.Fatalf("could not reap %s: %v", names[1], err)
+	}
+
+	startRoute(t, entry, "reaped")
+	r := waitForRoute(t, store, "reaped")
+
+	if len(r.Nodes) != 2 || r.CurrentNode(names[1]) != len(r.Nodes) {
+		t.Errorf("reaped node is still on the route: %+v", r.Nodes)
+	}
+	if r.Total.Destination.Host.Name != names[2] {
+		t.Errorf("route finished on %s, want %s", r.Total.Destination.Host.Name, names[2])
+	}
+}
+
+func TestRelaySlowNode(t *testing.T) {
+	store := &countingStore{Store: persist.NewMemory()}
+	names := []string{"asia-east1-a", "asia-northeast1-a", "australia-southeast1-a"}
+
+	old := route.CurrentLayout()
+	t.Cleanup(func() { route.SetLayout(old) })
+	l := route.CurrentLayout()
+	l.Order = names
+	if err := route.SetLayout(l); err != nil {
+		t.Fatalf("could not set layout: %v", err)
+	}
+
+	// The second node takes every route it is sent, but answers long after
+	// the first node has stopped waiting, and the last counts the routes
+	// it is sent.
+	var mu sync.Mutex
+	copies := 0
+	var entry string
+	for i, name := range names {
+		s := &Server{Store: store, Protocol: "http", Backoff: time.Millisecond}
+		if i == 0 {
+			s.SendTimeout = 100 * time.Millisecond
+		}
+		h := s.Handler()
+		switch i {
+		case 1:
+			next := h
+			h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				next.ServeHTTP(w, r)
+				time.Sleep(300 * time.Millisecond)
+			})
+		case 2:
+			next := h
+			h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/relay" {
+					mu.Lock()
+					copies++
+					mu.Unlock()
+				}
+				next.ServeHTTP(w, r)
+			})
+		}
+		ts := httptest.NewServer(h)
+		t.Cleanup(ts.Close)
+
+		addr := strings.TrimPrefix(ts.URL, "http://")
+		s.Host = route.Host{Name: name, Endpoint: addr, Private: addr}
+		if err := s.Register(); err != nil {
+			t.Fatalf("could not register %s: %v", name, err)
+		}
+		if entry == "" {
+			entry = ts.URL
+		}
+	}
+
+	startRoute(t, entry, "slow")
+	r := waitForRoute(t, store, "slow")
+	if r.Nodes[1].Skipped || r.Nodes[1].Out.IsZero() {
+		t.Errorf("slow node was skipped: %+v", r.Nodes[1])
+	}
+
+	// Give any copies that were made time to get around.
+	time.Sleep(time.Second)
+	mu.Lock()
+	defer mu.Unlock()
+	if copies != 1 {
+		t.Errorf("last node was sent the route %d times, want 1", copies)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.finishes != 1 {
+		t.Errorf("route was finished %d times, want 1", store.finishes)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	store := persist.NewMemory()
+	names := []string{"asia-east1-a", "asia-northeast1-a", "australia-southeast1-a", "europe-west2-b"}
+	entry := startRing(t, store, "http", names, 2)
+
+	// The stream is opened before the route exists, like the frontend does.
+	resp, err := http.Get(entry + "/routes/events-test/events")
+	if err != nil {
+		t.Fatalf("could not open events: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("got content type %s, want text/event-stream", got)
+	}
+
+	startRoute(t, entry, "events-test")
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read events: %v", err)
+	}
+
+	var hops []HopEvent
+	var done *DoneEvent
+	for _, block := range strings.Split(strings.TrimSpace(string(body)), "\n\n") {
+		lines := strings.Split(block, "\n")
+		if len(lines) != 3 {
+			t.Fatalf("malformed event: %q", block)
+		}
+		data := []byte(strings.TrimPrefix(lines[2], "data: "))
+
+		switch lines[0] {
+		case "event: hop":
+			var e HopEvent
+			if err := json.Unmarshal(data, &e); err != nil {
+				t.Fatalf("could not decode hop event: %v", err)
+			}
+			hops = append(hops, e)
+		case "event: done":
+			done = &DoneEvent{}
+			if err := json.Unmarshal(data, done); err != nil {
+				t.Fatalf("could not decode done event: %v", err)
+			}
+		default:
+			t.Errorf("unexpected event: %q", block)
+		}
+	}
+
+	if len(hops) != len(names) {
+		t.Errorf("got %d hop events, want %d", len(hops), len(names))
+	}
+	for _, e := range hops {
+		if e.Skipped != (e.Step == 2) {
+			t.Errorf("hop event %d got skipped %t", e.Step, e.Skipped)
+		}
+	}
+
+	if done == nil || done.Steps != len(names) || done.Seconds <= 0 {
+		t.Fatalf("got done event %+v", done)
+	}
+
+	img, err := http.Get(entry + done.Postcard)
+	if err != nil {
+		t.Fatalf("could not get postcard: %v", err)
+	}
+	defer img.Body.Close()
+	if _, err := png.Decode(img.Body); err != nil {
+		t.Errorf("postcard is not a png: %v", err)
+	}
+
+	missing, err := http.Get(entry + "/routes/missing/postcard")
+	if err != nil {
+		t.Fatalf("could not get missing postcard: %v", err)
+	}
+	missing.Body.Close()
+	if missing.StatusCode != http.StatusNotFound {
+		t.Errorf("missing postcard got %s, want 404", missing.Status)
+	}
+}
+
+// countingStore counts the routes that are read from it, and the finished
+// routes that are recorded in it.
+type countingStore struct {
+	persist.Store
+	mu       sync.Mutex
+	reads    int
+	finishes int
+}
+
+func (c *countingStore) Route(id string) (*route.Route, error) {
+	c.mu.Lock()
+	c.reads++
+	c.mu.Unlock()
+	return c.Store.Route(id)
+}
+
+func (c *countingStore) RecordRoute(name string, r *route.Route) error {
+	if r.Done() {
+		c.mu.Lock()
+		c.finishes++
+		c.mu.Unlock()
+	}
+	return c.Store.RecordRoute(name, r)
+}
+
+func TestFeeds(t *testing.T) {
+	store := &countingStore{Store: persist.NewMemory()}
+	f := newFeeds(store, time.Hour)
+
+	r := &route.Route{ID: "watched"}
+	if err := store.RecordRoute("asia-east1-a", r); err != nil {
+		t.Fatalf("could not record route: %v", err)
+	}
+
+	var watchers []<-chan *route.Route
+	for i := 0; i < 10; i++ {
+		updates, cancel := f.subscribe("watched")
+		defer cancel()
+		watchers = append(watchers, updates)
+	}
+	for i, updates := range watchers {
+		if got := <-updates; got.ID != "watched" {
+			t.Fatalf("watcher %d got route %s", i, got.ID)
+		}
+	}
+
+	r = &route.Route{ID: "watched"}
+	r.AddNode(route.Node{Host: route.Host{Name: "asia-east1-a"}})
+	if err := store.RecordRoute("asia-east1-a", r); err != nil {
+		t.Fatalf("could not record route: %v", err)
+	}
+	f.notify("watched")
+	for i, updates := range watchers {
+		if got := <-updates; len(got.Nodes) != 1 {
+			t.Errorf("watcher %d got %d nodes, want 1", i, len(got.Nodes))
+		}
+	}
+
+	// Every watcher shares the reads, rather than polling for itself.
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.reads > 3 {
+		t.Errorf("10 watchers read the route %d times", store.reads)
+	}
+}
+
+func TestStats(t *testing.T) {
+	store := persist.NewMemory()
+	names := []string{"asia-east1-a", "asia-northeast1-a", "australia-southeast1-a"}
+	entry := startRing(t, store, "http", names, -1)
+
+	for _, id := range []string{"stats-1", "stats-2"} {
+		startRoute(t, entry, id)
+		waitForRoute(t, store, id)
+	}
+
+	var links []stats.Link
+	getJSON(t, entry+"/stats/links?origin=asia-east1", &links)
+	if len(links) != 1 || links[0].Destination != "asia-northeast1-a" || links[0].Count != 2 {
+		t.Errorf("got links %+v, want 2 hops from asia-east1-a to asia-northeast1-a", links)
+	}
+
+	var m stats.Matrix
+	getJSON(t, entry+"/stats/matrix", &m)
+	if len(m.Zones) != len(names) || m.Mean[0][1] == nil || m.Mean[1][0] != nil {
+		t.Errorf("got matrix %+v", m)
+	}
+}
+
+func getJSON(t *testing.T, url string, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("could not get %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("could not decode %s: %v", url, err)
+	}
+}
+
+func TestRelayAuth(t *testing.T) {
+	relayKey, tokenKey := auth.Key("relay secret"), auth.Key("token secret")
+	names := []string{"asia-east1-a", "asia-northeast1-a", "australia-southeast1-a"}
+
+	for _, transport := range []string{"http", "grpc"} {
+		store := persist.NewMemory()
+		entry := startRing(t, store, transport, names, -1, func(s *Server) {
+			s.RelayKey = relayKey
+			s.TokenKey = tokenKey
+		})
+
+		cases := []struct {
+			label string
+			token string
+			want  int
+		}{
+			{"no token", "", http.StatusUnauthorized},
+			{"expired token", tokenKey.Token(-time.Minute), http.StatusUnauthorized},
+			{"forged token", relayKey.Token(time.Minute), http.StatusUnauthorized},
+		}
+		for _, c := range cases {
+			if got := postRoute(t, entry+"/relay?init=true&id=auth&token="+c.token); got != c.want {
+				t.Errorf("%s %s: got %d, want %d", transport, c.label, got, c.want)
+			}
+		}
+
+		token := tokenKey.Token(time.Minute)
+		startRoute(t, entry, "auth-"+transport+"&token="+token)
+		waitForRoute(t, store, "auth-"+transport)
+
+		// A token only starts one route.
+		if got := postRoute(t, entry+"/relay?init=true&id=auth-again&token="+token); got != http.StatusUnauthorized {
+			t.Errorf("%s used token: got %d, want %d", transport, got, http.StatusUnauthorized)
+		}
+	}
+
+	// A route that isn't signed is turned away before it is stamped.
+	store := persist.NewMemory()
+	entry := startRing(t, store, "http", names, -1, func(s *Server) { s.RelayKey = relayKey })
+
+	r, err := store.DefaultRoute()
+	if err != nil {
+		t.Fatalf("could not get route: %v", err)
+	}
+	r.ID = "forged"
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("could not marshal route: %v", err)
+	}
+
+	resp, err := http.Post(entry+"/relay", "application/json", strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatalf("could not post route: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned relay got %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if _, err := store.Route("forged"); err != persist.ErrRouteNotFound {
+		t.Errorf("unsigned relay was recorded: %v", err)
+	}
+
+	// A signed route can only be sent once.
+	r.ID = "replayed"
+	if b, err = json.Marshal(r); err != nil {
+		t.Fatalf("could not marshal route: %v", err)
+	}
+	req, _ := http.NewRequest("POST", entry+"/relay", strings.NewReader(string(b)))
+	relayKey.SignRequest(req.Header, b)
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		req.Body = ioutil.NopCloser(strings.NewReader(string(b)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("could not post route: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("signed relay %d got %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+	waitForRoute(t, store, "replayed")
+}
+
+func TestValidation(t *testing.T) {
+	names := []string{"asia-east1-a", "asia-northeast1-a"}
+	store := persist.NewMemory()
+	startRing(t, store, "http", names, -1)
+
+	img, err := ioutil.ReadFile(route.ImagePath + "/postcard.png")
+	if err != nil {
+		t.Fatalf("could not open base image: %v", err)
+	}
+	postcard := base64.StdEncoding.EncodeToString(img)
+	truncated := base64.StdEncoding.EncodeToString(img[:len(img)/2])
+
+	var wide strings.Builder
+	if err := png.Encode(base64.NewEncoder(base64.StdEncoding, &wide), image.NewGray(image.Rect(0, 0, maxPostcardSide+1, 1))); err != nil {
+		t.Fatalf("could not encode wide postcard: %v", err)
+	}
+
+	relayed := func(change func(r *route.Route)) string {
+		r, err := store.DefaultRoute()
+		if err != nil {
+			t.Fatalf("could not get route: %v", err)
+		}
+		r.ID = "valid"
+		r.Postcard = postcard
+		change(r)
+		b, err := json.Marshal(r)
+		if err != nil {
+			t.Fatalf("could not marshal route: %v", err)
+		}
+		return string(b)
+	}
+
+	cases := []struct {
+		label  string
+		method string
+		url    string
+		body   string
+		want   int
+	}{
+		{"get", "GET", "/relay", "", http.StatusMethodNotAllowed},
+		{"path in id", "POST", "/relay?init=true&id=../../etc", postcard, http.StatusBadRequest},
+		{"no image", "POST", "/relay?init=true", "", http.StatusBadRequest},
+		{"not base64", "POST", "/relay?init=true", "!!!!", http.StatusBadRequest},
+		{"not an image", "POST", "/relay?init=true", base64.StdEncoding.EncodeToString([]byte("<html></html>")), http.StatusUnsupportedMediaType},
+		{"too wide", "POST", "/relay?init=true", wide.String(), http.StatusBadRequest},
+		{"truncated", "POST", "/relay?init=true", truncated, http.StatusUnsupportedMediaType},
+		{"too big", "POST", "/relay?init=true", strings.Repeat("A", maxBodyBytes+1), http.StatusRequestEntityTooLarge},
+		{"unknown strategy", "POST", "/relay?init=true&type=sideways", postcard, http.StatusBadRequest},
+		{"not json", "POST", "/relay", "{", http.StatusBadRequest},
+		{"null route", "POST", "/relay", "null", http.StatusBadRequest},
+		{"no id", "POST", "/relay", relayed(func(r *route.Route) { r.ID = "" }), http.StatusBadRequest},
+		{"no nodes", "POST", "/relay", relayed(func(r *route.Route) { r.Nodes = nil }), http.StatusBadRequest},
+		{"no postcard", "POST", "/relay", relayed(func(r *route.Route) { r.Postcard = "" }), http.StatusBadRequest},
+		{"all stamped", "POST", "/relay", relayed(func(r *route.Route) {
+			for i := range r.Nodes {
+				r.Nodes[i].Skipped = true
+			}
+		}), http.StatusBadRequest},
+		// The node isn't on the route, so it can't stamp it.
+		{"not on route", "POST", "/relay", relayed(func(r *route.Route) {}), http.StatusInternalServerError},
+	}
+
+	s := &Server{Store: store, Protocol: "http"}
+	h := s.Handler()
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(c.method, c.url, strings.NewReader(c.body)))
+
+		if w.Code != c.want {
+			t.Errorf("%s: got %d, want %d: %s", c.label, w.Code, c.want, w.Body)
+			continue
+		}
+		var reply struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || reply.Error == "" {
+			t.Errorf("%s: error body is not json: %q", c.label, w.Body)
+		}
+	}
+
+	// A node that can't get a route can't start one.
+	w := httptest.NewRecorder()
+	empty := &Server{Store: persist.NewMemory(), Protocol: "http"}
+	empty.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/relay?init=true", strings.NewReader(postcard)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("no nodes: got %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestRouteStatus(t *testing.T) {
+	names := []string{"asia-east1-a", "asia-northeast1-a"}
+	store := persist.NewMemory()
+	entry := startRing(t, store, "http", names, -1)
+
+	startRoute(t, entry, "finished")
+	if r := waitForRoute(t, store, "finished"); r.Status != route.StatusCompleted {
+		t.Errorf("got status %s, want %s", r.Status, route.StatusCompleted)
+	}
+
+	// Routes that were left in flight long enough ago to time out, and one
+	// that is cancelled first.
+	for _, id := range []string{"stuck", "slow", "cancel"} {
+		r, err := store.DefaultRoute()
+		if err != nil {
+			t.Fatalf("could not get route: %v", err)
+		}
+		r.ID = id
+		r.SetStatus(route.StatusPending, "")
+		r.SetStatus(route.StatusInFlight, "")
+		if err := store.RecordRoute(names[0], r); err != nil {
+			t.Fatalf("could not record route: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := store.SetStatus("slow", route.StatusInFlight, ""); !errors.Is(err, route.ErrBadTransition) {
+		t.Fatalf("in flight route could go in flight again: %v", err)
+	}
+
+	s := &Server{Store: store, Deadline: 50 * time.Millisecond}
+	h := s.Handler()
+
+	cases := []struct {
+		label string
+		url   string
+		want  int
+	}{
+		{"cancel", "/routes/cancel/cancel", http.StatusOK},
+		{"cancel again", "/routes/cancel/cancel", http.StatusConflict},
+		{"cancel missing", "/routes/missing/cancel", http.StatusNotFound},
+	}
+	// A node that checks tokens, but has no admin key, doesn't let anyone
+	// cancel.
+	locked := &Server{Store: store, TokenKey: auth.Key("token secret")}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/routes/cancel/cancel", nil)
+	req.Header.Set("Authorization", "Bearer "+locked.TokenKey.Token(time.Minute))
+	locked.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("cancel without admin key: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", c.url, nil))
+		if w.Code != c.want {
+			t.Errorf("%s: got %d, want %d: %s", c.label, w.Code, c.want, w.Body)
+		}
+	}
+
+	s.timeOut(s.Deadline)
+
+	for id, want := range map[string]route.Status{
+		"finished": route.StatusCompleted,
+		"stuck":    route.StatusTimedOut,
+		"slow":     route.StatusTimedOut,
+		"cancel":   route.StatusCancelled,
+	} {
+		var reply StatusReply
+		getJSON(t, entry+"/routes/"+id+"/status", &reply)
+		if reply.Status != want {
+			t.Errorf("%s: got status %s, want %s", id, reply.Status, want)
+		}
+		if last := reply.Transitions[len(reply.Transitions)-1]; last.Status != want || last.At.IsZero() {
+			t.Errorf("%s: last transition is %+v", id, last)
+		}
+	}
+
+	// A route that is on its way when it is cancelled isn't passed on.
+	passed := false
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { passed = true }))
+	defer next.Close()
+
+	r, err := store.Route("cancel")
+	if err != nil {
+		t.Fatalf("could not get route: %v", err)
+	}
+	r.Nodes[1].Host.Private = strings.TrimPrefix(next.URL, "http://")
+	s.Protocol = "http"
+	s.Host = r.Nodes[0].Host
+	if err := r.SetPostcard(image.NewRGBA(image.Rect(0, 0, 600, 400))); err != nil {
+		t.Fatalf("could not set postcard: %v", err)
+	}
+	if err := s.hop(context.Background(), r); err != nil {
+		t.Fatalf("could not stamp cancelled route: %v", err)
+	}
+	s.Wait()
+	if passed {
+		t.Errorf("cancelled route was passed on")
+	}
+}
+
+// blockedStore doesn't answer reads of routes until release is closed, like
+// a store that is slow or down.
+type blockedStore struct {
+	persist.Store
+	release chan struct{}
+}
+
+func (b blockedStore) Route(id string) (*route.Route, error) {
+	<-b.release
+	return b.Store.Route(id)
+}
+
+func TestStopped(t *testing.T) {
+	store := persist.NewMemory()
+	for _, id := range []string{"going", "cancelled"} {
+		r := &route.Route{ID: id}
+		r.SetStatus(route.StatusPending, "")
+		r.SetStatus(route.StatusInFlight, "")
+		if err := store.RecordRoute("asia-east1-a", r); err != nil {
+			t.Fatalf("could not record route: %v", err)
+		}
+	}
+	if err := store.SetStatus("cancelled", route.StatusCancelled, ""); err != nil {
+		t.Fatalf("could not cancel route: %v", err)
+	}
+
+	s := &Server{Store: store}
+	s.Handler()
+	for id, want := range map[string]bool{"going": false, "cancelled": true, "missing": false} {
+		if got := <-s.stopped(id); got != want {
+			t.Errorf("%s: got stopped %v, want %v", id, got, want)
+		}
+	}
+
+	// A store that doesn't answer doesn't hold the route up for long.
+	blocked := blockedStore{Store: store, release: make(chan struct{})}
+	defer close(blocked.release)
+	s = &Server{Store: blocked}
+	s.Handler()
+	start := time.Now()
+	if <-s.stopped("cancelled") {
+		t.Errorf("route was taken to be stopped without an answer from the store")
+	}
+	if waited := time.Since(start); waited > 2*stoppedTimeout {
+		t.Errorf("waited %v for the store", waited)
+	}
+
+	// A route the node ended itself is known without asking.
+	if err := s.setStatus("going", route.StatusCancelled, ""); err != nil {
+		t.Fatalf("could not cancel route: %v", err)
+	}
+	if !<-s.stopped("going") {
+		t.Errorf("route the node cancelled is not stopped")
+	}
+}
+
+func TestAnimation(t *testing.T) {
+	names := []string{"asia-east1-a", "asia-northeast1-a", "australia-southeast1-a"}
+	store := persist.NewMemory()
+	entry := startRing(t, store, "http", names, 1, func(s *Server) { s.RenderAnimations = true })
+
+	startRoute(t, entry, "animated")
+	waitForRoute(t, store, "animated")
+
+	// The start, and every node that stamped it, but not the dead one.
+	var frames []route.Frame
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && len(frames) < 3; time.Sleep(20 * time.Millisecond) {
+		frames, _ = store.Frames("animated")
+	}
+	if len(frames) != 3 || frames[0].Index != 0 || frames[1].Node != names[0] || frames[2].Node != names[2] {
+		t.Fatalf("got frames %+v", frames)
+	}
+	// Frames are kept no wider than they are animated at.
+	for _, f := range frames {
+		img, _, err := image.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(f.Postcard)))
+		if err != nil {
+			t.Fatalf("could not decode frame %d: %v", f.Index, err)
+		}
+		if w := img.Bounds().Dx(); w > route.AnimationWidth {
+			t.Errorf("frame %d is %d wide, want at most %d", f.Index, w, route.AnimationWidth)
+		}
+	}
+
+	resp, err := http.Get(entry + "/routes/animated/animation.gif")
+	if err != nil {
+		t.Fatalf("could not get gif: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/gif" {
+		t.Fatalf("got %d %s, want a gif", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	g, err := gif.DecodeAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not decode gif: %v", err)
+	}
+	if len(g.Image) != 3 {
+		t.Errorf("got %d frames in gif, want 3", len(g.Image))
+	}
+
+	// A route that is still on its way can't be animated yet.
+	r, err := store.DefaultRoute()
+	if err != nil {
+		t.Fatalf("could not get route: %v", err)
+	}
+	r.ID = "moving"
+	r.SetStatus(route.StatusInFlight, "")
+	if err := store.RecordRoute(names[0], r); err != nil {
+		t.Fatalf("could not record route: %v", err)
+	}
+
+	cases := map[string]int{
+		"/routes/moving/animation.png":   http.StatusConflict,
+		"/routes/missing/animation.png":  http.StatusNotFound,
+		"/routes/animated/animation.png": http.StatusOK,
+	}
+	for path, want := range cases {
+		resp, err := http.Get(entry + path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: got %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+
+	// A completed route whose last frame isn't saved yet is asked for
+	// again, rather than animated without it.
+	r, err = store.Route("animated")
+	if err != nil {
+		t.Fatalf("could not get route: %v", err)
+	}
+	r.ID = "partial"
+	if err := store.RecordRoute(names[2], r); err != nil {
+		t.Fatalf("could not record route: %v", err)
+	}
+	for _, f := range frames[:2] {
+		if err := store.SaveFrame("partial", f); err != nil {
+			t.Fatalf("could not save frame: %v", err)
+		}
+	}
+	resp, err = http.Get(entry + "/routes/partial/animation.gif")
+	if err != nil {
+		t.Fatalf("could not get gif: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("route missing a frame got %d, want %d with Retry-After", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	if err := store.SaveFrame("partial", frames[2]); err != nil {
+		t.Fatalf("could not save frame: %v", err)
+	}
+	resp, err = http.Get(entry + "/routes/partial/animation.gif")
+	if err != nil {
+		t.Fatalf("could not get gif: %v", err)
+	}
+	defer resp.Body.Close()
+	if g, err := gif.DecodeAll(resp.Body); err != nil || len(g.Image) != 3 {
+		t.Errorf("route with every frame got %v, want 3 frames", err)
+	}
+}
+
+func TestPDF(t *testing.T) {
+	names := []string{"asia-east1-a", "asia-northeast1-a"}
+	store := persist.NewMemory()
+	entry := startRing(t, store, "http", names, -1)
+
+	startRoute(t, entry, "printed")
+	waitForRoute(t, store, "printed")
+
+	resp, err := http.Get(entry + "/routes/printed/postcard.pdf")
+	if err != nil {
+		t.Fatalf("could not get pdf: %v", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("could not read pdf: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/pdf" || !strings.HasPrefix(string(b), "%PDF-") {
+		t.Errorf("got %d %s, want a pdf", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	r, err := store.DefaultRoute()
+	if err != nil {
+		t.Fatalf("could not get route: %v", err)
+	}
+	r.ID = "moving"
+	r.SetStatus(route.StatusInFlight, "")
+	if err := store.RecordRoute(names[0], r); err != nil {
+		t.Fatalf("could not record route: %v", err)
+	}
+
+	for path, want := range map[string]int{
+		"/routes/moving/postcard.pdf":  http.StatusConflict,
+		"/routes/missing/postcard.pdf": http.StatusNotFound,
+	} {
+		resp, err := http.Get(entry + path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: got %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestPrintQueue(t *testing.T) {
+	names := []string{"asia-east1-a", "asia-northeast1-a"}
+	tokenKey, adminKey := auth.Key("token secret"), auth.Key("admin secret")
+	dir := t.TempDir()
+	store := persist.NewMemory()
+	entry := startRing(t, store, "http", names, -1, func(s *Server) {
+		s.TokenKey = tokenKey
+		s.AdminKey = adminKey
+		s.Printer = &printqueue.Dir{Path: dir}
+	})
+
+	startRoute(t, entry, "printed&token="+tokenKey.Token(time.Minute))
+	waitForRoute(t, store, "printed")
+
+	// The route is printed once it is over, without anyone asking.
+	waitForPrint(t, entry, "printed", 1)
+	b, err := ioutil.ReadFile(dir + "/postcard-printed-1.pdf")
+	if err != nil || !strings.HasPrefix(string(b), "%PDF-") {
+		t.Errorf("printer didn't get a pdf: %v", err)
+	}
+
+	var jobs []printqueue.Job
+	getJSON(t, entry+"/print/jobs", &jobs)
+	if len(jobs) != 1 || jobs[0].ID != "printed" {
+		t.Errorf("got jobs %+v", jobs)
+	}
+
+	admin := "Bearer " + string(adminKey)
+	cases := []struct {
+		label  string
+		method string
+		path   string
+		auth   string
+		want   int
+	}{
+		{"reprint without key", "POST", "/print/jobs/printed/reprint", "", http.StatusUnauthorized},
+		{"reprint with client token", "POST", "/print/jobs/printed/reprint", "Bearer " + tokenKey.Token(time.Minute), http.StatusUnauthorized},
+		{"reprint", "POST", "/print/jobs/printed/reprint", admin, http.StatusOK},
+		{"get reprint", "GET", "/print/jobs/printed/reprint", admin, http.StatusMethodNotAllowed},
+		{"reprint missing", "POST", "/print/jobs/missing/reprint", admin, http.StatusNotFound},
+		{"unknown action", "POST", "/print/jobs/printed/staple", admin, http.StatusNotFound},
+		{"missing", "GET", "/print/jobs/missing", "", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, entry+c.path, nil)
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", c.label, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Errorf("%s: got %d, want %d", c.label, resp.StatusCode, c.want)
+		}
+	}
+	waitForPrint(t, entry, "printed", 2)
+
+	// A node without a printer has no queue.
+	h := (&Server{Store: store}).Handler()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/print/jobs", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("node without a printer got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	names := []string{"asia-east1-a", "asia-northeast1-a"}
+	store := persist.NewMemory()
+	entry := startRing(t, store, "http", names, -1, func(s *Server) {
+		s.MaxInFlight = 1
+		s.QueueSize = 2
+	})
+
+	cases := []struct {
+		id   string
+		want int
+	}{
+		{"first", http.StatusOK},
+		{"second", http.StatusAccepted},
+		{"third", http.StatusAccepted},
+		{"fourth", http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		if got := postRoute(t, entry+"/relay?init=true&id="+c.id); got != c.want {
+			t.Errorf("%s: got %d, want %d", c.id, got, c.want)
+		}
+	}
+
+	var reply StatusReply
+	getJSON(t, entry+"/routes/second/status", &reply)
+	if reply.Status != route.StatusPending || reply.Position != 1 {
+		t.Errorf("waiting route got status %s at position %d", reply.Status, reply.Position)
+	}
+
+	// A route that is cancelled while it waits gives up its place.
+	resp, err := http.Post(entry+"/routes/third/cancel", "", nil)
+	if err != nil {
+		t.Fatalf("could not cancel: %v", err)
+	}
+	resp.Body.Close()
+	if got := postRoute(t, entry+"/relay?init=true&id=fourth"); got != http.StatusAccepted {
+		t.Errorf("fourth after third was cancelled: got %d, want %d", got, http.StatusAccepted)
+	}
+
+	first := waitForRoute(t, store, "first")
+	second := waitForRoute(t, store, "second")
+	waitForRoute(t, store, "fourth")
+	if third, err := store.Route("third"); err != nil || third.Status != route.StatusCancelled || len(third.Transitions) != 2 {
+		t.Errorf("cancelled route was sent: %+v, %v", third, err)
+	}
+
+	// The wait is recorded, but isn't part of the time the route took.
+	finished := first.Transitions[len(first.Transitions)-1].At
+	started := second.Transitions[1]
+	if started.Status != route.StatusInFlight || started.At.Before(finished) {
+		t.Errorf("second route didn't wait for the first to finish at %v: %+v", finished, second.Transitions)
+	}
+	waited := started.At.Sub(second.Transitions[0].At)
+	if total := time.Duration(second.Total.Seconds * float64(time.Second)); total >= waited {
+		t.Errorf("total of %v includes the wait of %v", total, waited)
+	}
+
+	// Clients are held to their rate.
+	entry = startRing(t, persist.NewMemory(), "http", names, -1, func(s *Server) {
+		s.RateLimit = 1
+		s.RateBurst = 1
+	})
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if got := postRoute(t, entry+"/relay?init=true"); got != want {
+			t.Errorf("route %d: got %d, want %d", i, got, want)
+		}
+	}
+
+	// Behind a proxy, a client can't get more by making up addresses in
+	// front of the one the proxy adds. There is no postcard, so requests
+	// that get past the limit are turned away after it.
+	s := &Server{Store: persist.NewMemory(), RateLimit: 1, RateBurst: 1, ProxyHops: 1}
+	h := s.Handler()
+	for i, c := range []struct {
+		forwarded string
+		want      int
+	}{
+		{"203.0.113.7", http.StatusBadRequest},
+		{"10.0.0.1, 203.0.113.7", http.StatusTooManyRequests},
+		{"10.0.0.2, 203.0.113.7", http.StatusTooManyRequests},
+		{"203.0.113.8", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("POST", "/relay?init=true", strings.NewReader("x"))
+		req.Header.Set("X-Forwarded-For", c.forwarded)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.want {
+			t.Errorf("request %d from %s: got %d, want %d", i, c.forwarded, w.Code, c.want)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	cases := []struct {
+		hops      int
+		forwarded []string
+		want      string
+	}{
+		{0, []string{"203.0.113.7"}, "192.0.2.1"},
+		{1, nil, "192.0.2.1"},
+		{1, []string{"forged, 203.0.113.7"}, "203.0.113.7"},
+		{2, []string{"forged, 203.0.113.7, 10.0.0.1"}, "203.0.113.7"},
+		{2, []string{"forged, 203.0.113.7", "10.0.0.1"}, "203.0.113.7"},
+		{3, []string{"203.0.113.7, 10.0.0.1"}, "192.0.2.1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, f := range c.forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		if got := (&Server{ProxyHops: c.hops}).client(r); got != c.want {
+			t.Errorf("%d hops, %q: got %s, want %s", c.hops, c.forwarded, got, c.want)
+		}
+	}
+}
+
+func TestNTPOffset(t *testing.T) {
+	sent := time.Date(2017, 12, 17, 1, 0, 0, 0, time.UTC)
+
+	// The remote clock is a second ahead, and the probe takes 50ms each way.
+	receive := sent.Add(time.Second + 50*time.Millisecond)
+	transmit := receive.Add(10 * time.Millisecond)
+	received := sent.Add(110 * time.Millisecond)
+
+	offset, delay := ntpOffset(sent, receive, transmit, received)
+	if offset != time.Second {
+		t.Errorf("got offset %v, want 1s", offset)
+	}
+	if delay != 100*time.Millisecond {
+		t.Errorf("got delay %v, want 100ms", delay)
+	}
+}
+
+func TestProbeClock(t *testing.T) {
+	s := &Server{Store: persist.NewMemory(), Protocol: "http"}
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	offset, delay, err := s.probeClock(strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatalf("could not probe clock: %v", err)
+	}
+
+	// Both ends share a clock, so the offset is only as far out as the
+	// network made it, however slow the machine is.
+	if offset > delay/2 || offset < -delay/2 {
+		t.Errorf("got offset %v from the same clock, with a delay of %v", offset, delay)
+	}
+}
+
+// startRing starts a relay server for each name, and sets the layout to go
+// around them in order. The server at index dead is stopped before the route
+// gets to it, unless dead is -1. opts are applied to every server. It
+// returns the url of the first server.
+func startRing(t *testing.T, store persist.Store, transport string, names []string, dead int, opts ...func(*Server)) string {
+	old := route.CurrentLayout()
+	t.Cleanup(func() { route.SetLayout(old) })
+
+	l := route.CurrentLayout()
+	l.Order = names
+	if err := route.SetLayout(l); err != nil {
+		t.Fatalf("could not set layout: %v", err)
+	}
+
+	var entry string
+	for i, name := range names {
+		s := &Server{Store: store, Protocol: "http", Transport: transport, Backoff: time.Millisecond}
+		for _, opt := range opts {
+			opt(s)
+		}
+		ts := httptest.NewServer(s.Handler())
+		t.Cleanup(ts.Close)
+
+		addr := strings.TrimPrefix(ts.URL, "http://")
+		s.Host = route.Host{Name: name, Endpoint: addr, Private: addr}
+		if err := s.Register(); err != nil {
+			t.Fatalf("could not register %s: %v", name, err)
+		}
+		if i == dead {
+			ts.Close()
+		}
+		if entry == "" {
+			entry = ts.URL
+		}
+	}
+	return entry
+}
+
+// startRoute sends the blank postcard to the entry server.
+func startRoute(t *testing.T, entry, id string) {
+	if code := postRoute(t, entry+"/relay?init=true&id="+id); code != http.StatusOK {
+		t.Fatalf("could not start route: %d", code)
+	}
+}
+
+// postRoute sends the blank postcard to url, and returns the status code.
+func postRoute(t *testing.T, url string) int {
+	img, err := ioutil.ReadFile(route.ImagePath + "/postcard.png")
+	if err != nil {
+		t.Fatalf("could not open base image: %v", err)
+	}
+
+	body := strings.NewReader(base64.StdEncoding.EncodeToString(img))
+	resp, err := http.Post(url, "text/plain", body)
+	if err != nil {
+		t.Fatalf("could not start route: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// waitForPrint waits for the print job of a route to have been printed
+// times.
+func waitForPrint(t *testing.T, entry, id string, times int) {
+	var j printqueue.Job
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		getJSON(t, entry+"/print/jobs/"+id, &j)
+		if j.Status == printqueue.StatusPrinted && j.Printed == times {
+			return
+		}
+	}
+	t.Fatalf("%s: got job %+v, want it printed %d times", id, j, times)
+}
+
+// waitForRoute waits for the route to be finished in the store.
+func waitForRoute(t *testing.T, store persist.Store, id string) *route.Route {
+	var r *route.Route
+	var err error
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		r, err = store.Route(id)
+		if err == nil && r.Done() && !r.Total.Destination.Out.IsZero() {
+			return r
+		}
+	}
+	t.Fatalf("%s: route did not finish: %+v", id, r)
+	return nil
+}
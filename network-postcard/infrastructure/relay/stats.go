@@ -0,0 +1,64 @@
+package relay
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/tpryan/gcprelay/infrastructure/stats"
+)
+
+// handleLinks sends the statistics for every link between two zones. The
+// origin and destination query parameters narrow them down to the links
+// whose zones start with them, so that "asia-east1" matches every zone in
+// the region. Only the hops in the history are counted, so every link says
+// when the oldest of them was made.
+func (s *Server) handleLinks(w http.ResponseWriter, r *http.Request) {
+	links, err := s.links()
+	if err != nil {
+		log.Printf("error: could not get route history: %v", err)
+		sendJSON(w, `{"error": "could not get route history"}`, http.StatusInternalServerError)
+		return
+	}
+
+	origin := r.URL.Query().Get("origin")
+	destination := r.URL.Query().Get("destination")
+
+	result := []stats.Link{}
+	for _, l := range links {
+		if strings.HasPrefix(l.Origin, origin) && strings.HasPrefix(l.Destination, destination) {
+			result = append(result, l)
+		}
+	}
+
+	jsonStr, err := json.MarshalIndent(result, "", "    ")
+	if err != nil {
+		log.Printf("error: could not marshall links: %v", err)
+	}
+	sendJSON(w, string(jsonStr), http.StatusOK)
+}
+
+// handleMatrix sends the statistics laid out as a zone to zone grid.
+func (s *Server) handleMatrix(w http.ResponseWriter, r *http.Request) {
+	links, err := s.links()
+	if err != nil {
+		log.Printf("error: could not get route history: %v", err)
+		sendJSON(w, `{"error": "could not get route history"}`, http.StatusInternalServerError)
+		return
+	}
+
+	jsonStr, err := json.MarshalIndent(stats.NewMatrix(links), "", "    ")
+	if err != nil {
+		log.Printf("error: could not marshall matrix: %v", err)
+	}
+	sendJSON(w, string(jsonStr), http.StatusOK)
+}
+
+func (s *Server) links() ([]stats.Link, error) {
+	history, err := s.Store.History()
+	if err != nil {
+		return nil, err
+	}
+	return stats.Links(history), nil
+}
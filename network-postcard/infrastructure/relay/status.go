@@ -0,0 +1,205 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/persist"
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+const (
+	// defaultDeadline is how long a route can go without progress before
+	// the watchdog times it out.
+	defaultDeadline = 2 * time.Minute
+	// stoppedTimeout is how long a node waits to hear from the store if a
+	// route was ended, before it carries on as if it wasn't.
+	stoppedTimeout = 500 * time.Millisecond
+)
+
+// StatusReply is the answer to /routes/{id}/status.
+type StatusReply struct {
+	ID          string             `json:"id"`
+	Status      route.Status       `json:"status"`
+	Transitions []route.Transition `json:"transitions"`
+	LastUpdate  time.Time          `json:"lastupdate"`
+	// Position is the route's place in line, if it is waiting to start.
+	Position int `json:"position,omitempty"`
+}
+
+// Watch times out the routes that have made no progress for Deadline, until
+// stop is closed. It only needs to run on one node, but running it on more
+// does no harm.
+func (s *Server) Watch(stop <-chan struct{}) {
+	deadline := s.deadline()
+	t := time.NewTicker(deadline / 4)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		s.timeOut(deadline)
+	}
+}
+
+func (s *Server) deadline() time.Duration {
+	if s.Deadline == 0 {
+		return defaultDeadline
+	}
+	return s.Deadline
+}
+
+// timeOut times out the active routes that have made no progress for
+// deadline.
+func (s *Server) timeOut(deadline time.Duration) {
+	active, err := s.Store.Active()
+	if err != nil {
+		log.Printf("error: could not get active routes: %v", err)
+		return
+	}
+
+	for _, r := range active {
+		if time.Since(r.Progressed()) < deadline {
+			continue
+		}
+
+		err := s.setStatus(r.ID, route.StatusTimedOut, fmt.Sprintf("no progress for %v", deadline))
+		if errors.Is(err, route.ErrBadTransition) {
+			// It finished or was cancelled since it was read.
+			continue
+		}
+		if err != nil {
+			logWithID(r.ID, "error: could not time out route: %v", err)
+			continue
+		}
+		logWithID(r.ID, "timed out after no progress for %v", deadline)
+		routeOutcomes.WithLabelValues(string(route.StatusTimedOut)).Inc()
+	}
+}
+
+// setStatus moves a route in the store to a new status, and lets its
+// watchers know.
+func (s *Server) setStatus(id string, st route.Status, reason string) error {
+	if err := s.Store.SetStatus(id, st, reason); err != nil {
+		return err
+	}
+	if st.Final() && st != route.StatusCompleted && s.ended != nil {
+		s.ended.arrive(id)
+	}
+	s.feeds.notify(id)
+	return nil
+}
+
+// stopped checks in the background if the route has been ended while it was
+// on its way, so that the check doesn't add to the time the node takes with
+// it. Routes this node ended are known straight away. Otherwise the store is
+// asked, and if it doesn't answer within stoppedTimeout the route is taken
+// to still be going.
+func (s *Server) stopped(id string) <-chan bool {
+	result := make(chan bool, 1)
+	if s.ended != nil && s.ended.has(id) {
+		result <- true
+		return result
+	}
+
+	stored := make(chan bool, 1)
+	go func() {
+		r, err := s.Store.Route(id)
+		if err != nil && err != persist.ErrRouteNotFound {
+			logWithID(id, "error: could not check route status: %v", err)
+		}
+		stored <- r != nil && r.Status.Final() && r.Status != route.StatusCompleted
+	}()
+	go func() {
+		t := time.NewTimer(stoppedTimeout)
+		defer t.Stop()
+		select {
+		case stopped := <-stored:
+			result <- stopped
+		case <-t.C:
+			logWithID(id, "could not check route status in %v, carrying on", stoppedTimeout)
+			result <- false
+		}
+	}()
+	return result
+}
+
+// handleStatus sends the status of a route, and how it got there.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request, id string) {
+	rt, err := s.Store.Route(id)
+	if err == persist.ErrRouteNotFound {
+		sendError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logWithID(id, "error: could not get route for status: %v", err)
+		sendError(w, fmt.Errorf("could not get route"), http.StatusInternalServerError)
+		return
+	}
+
+	reply := StatusReply{
+		ID:          rt.ID,
+		Status:      rt.Status,
+		Transitions: rt.Transitions,
+		LastUpdate:  rt.LastUpdate,
+	}
+	if reply.Transitions == nil {
+		reply.Transitions = []route.Transition{}
+	}
+	if s.queue != nil {
+		reply.Position, _ = s.queue.Position(id)
+	}
+
+	jsonStr, err := json.Marshal(reply)
+	if err != nil {
+		logWithID(id, "error: could not marshal status: %v", err)
+		sendError(w, fmt.Errorf("could not marshal status"), http.StatusInternalServerError)
+		return
+	}
+	sendJSON(w, string(jsonStr), http.StatusOK)
+}
+
+// handleCancel cancels a route. It is an operator action, and needs the
+// admin key.
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		sendError(w, fmt.Errorf("%s is not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.authorizeAdmin(r); err != nil {
+		logWithID(id, "error: rejected cancel from %s: %v", r.RemoteAddr, err)
+		sendError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	err := s.setStatus(id, route.StatusCancelled, "cancelled by client")
+	switch {
+	case err == persist.ErrRouteNotFound:
+		sendError(w, err, http.StatusNotFound)
+		return
+	case errors.Is(err, route.ErrBadTransition):
+		sendError(w, err, http.StatusConflict)
+		return
+	case err != nil:
+		logWithID(id, "error: could not cancel route: %v", err)
+		sendError(w, fmt.Errorf("could not cancel route"), http.StatusInternalServerError)
+		return
+	}
+
+	// A route that is waiting its turn gives its place to the next one.
+	if s.queue != nil && s.queue.Cancel(id) {
+		logWithID(id, "taken out of line")
+	}
+
+	logWithID(id, "cancelled")
+	routeOutcomes.WithLabelValues(string(route.StatusCancelled)).Inc()
+	s.handleStatus(w, r, id)
+}
@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+var tracer = otel.Tracer("github.com/tpryan/gcprelay/infrastructure/relay")
+
+// Attributes that are added to the spans of a route.
+const (
+	routeKey = attribute.Key("gcprelay.route.id")
+	nodeKey  = attribute.Key("gcprelay.node")
+	nextKey  = attribute.Key("gcprelay.next")
+	wireKey  = attribute.Key("gcprelay.hop.wire_seconds")
+)
+
+// fail records an error on a span.
+func fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// requestContext returns a context with the trace of the node that sent the
+// request. It is not cancelled with the request, because the route is still
+// being worked on after the request has been answered.
+func requestContext(r *http.Request) context.Context {
+	return otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(r.Header))
+}
+
+// metadataCarrier lets the trace context be passed along in gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	v := metadata.MD(c).Get(key)
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// incomingContext returns a context with the trace of the node that sent a
+// gRPC call.
+func incomingContext(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return otel.GetTextMapPropagator().Extract(context.Background(), metadataCarrier(md))
+}
+
+// outgoingContext adds the trace in ctx to the metadata of a gRPC call.
+func outgoingContext(ctx context.Context) context.Context {
+	md := metadata.MD{}
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md)
+}
@@ -0,0 +1,155 @@
+package relay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+const (
+	// maxBodyBytes is the most that is read from a request to /relay. The
+	// postcard is a few hundred kilobytes, even with every stamp on it.
+	maxBodyBytes = 8 << 20
+	// maxNodes is the most nodes a relayed route can have.
+	maxNodes = 64
+	// maxPostcardSide is the widest or tallest a postcard can be, in pixels.
+	maxPostcardSide = 4096
+)
+
+// idPattern is what a route ID has to look like. IDs end up in file names,
+// so nothing that can walk a path is let through.
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// requestError is a request that can't be handled, with the status code to
+// answer it with.
+type requestError struct {
+	status int
+	err    error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(format string, a ...interface{}) error {
+	return &requestError{http.StatusBadRequest, fmt.Errorf(format, a...)}
+}
+
+// statusOf returns the status code to answer a failed request with.
+func statusOf(err error) int {
+	var re *requestError
+	if errors.As(err, &re) {
+		return re.status
+	}
+	return http.StatusInternalServerError
+}
+
+// sendError answers a request with err as a json error body.
+func sendError(w http.ResponseWriter, err error, status int) {
+	body, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+	sendJSON(w, string(body), status)
+}
+
+// unknownStrategy answers if a route couldn't be planned because the client
+// asked for a strategy that doesn't exist.
+func unknownStrategy(err error) bool {
+	return errors.Is(err, route.ErrUnknownStrategy)
+}
+
+// readBody reads the body of a request to /relay, up to maxBodyBytes.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			return nil, &requestError{http.StatusRequestEntityTooLarge, fmt.Errorf("body is larger than %d bytes", maxBodyBytes)}
+		}
+		return nil, badRequest("could not read body: %v", err)
+	}
+	return body, nil
+}
+
+// validateID checks that a route ID is safe to use.
+func validateID(id string) error {
+	if !idPattern.MatchString(id) {
+		return badRequest("route id '%s' is not 1 to 64 letters, digits, '-' or '_'", id)
+	}
+	return nil
+}
+
+// validateRoute checks that a relayed route is one that can be stamped.
+func validateRoute(r *route.Route) error {
+	if r == nil {
+		return badRequest("route is empty")
+	}
+	if err := validateID(r.ID); err != nil {
+		return err
+	}
+
+	if len(r.Nodes) == 0 {
+		return badRequest("route has no nodes")
+	}
+	if len(r.Nodes) > maxNodes {
+		return badRequest("route has %d nodes, more than %d", len(r.Nodes), maxNodes)
+	}
+	for i, n := range r.Nodes {
+		if n.Host.Name == "" {
+			return badRequest("node %d has no name", i)
+		}
+	}
+	if r.Done() {
+		return badRequest("route has no nodes left to stamp")
+	}
+
+	if r.Postcard == "" {
+		return badRequest("route has no postcard")
+	}
+	return validateImage(r.Postcard)
+}
+
+// validateImage checks that a base64 encoded image is a format that can be
+// stamped, and not too big to stamp, without decoding all of it.
+func validateImage(encoded string) error {
+	raw := base64.NewDecoder(base64.StdEncoding, strings.NewReader(encoded))
+	head := make([]byte, 512)
+	n, err := io.ReadFull(raw, head)
+	if n == 0 {
+		return badRequest("postcard is not base64: %v", err)
+	}
+
+	if kind := http.DetectContentType(head[:n]); !strings.HasPrefix(kind, "image/") {
+		return &requestError{http.StatusUnsupportedMediaType, fmt.Errorf("postcard is %s, not an image", kind)}
+	}
+
+	config, format, err := image.DecodeConfig(base64.NewDecoder(base64.StdEncoding, strings.NewReader(encoded)))
+	if err != nil {
+		return &requestError{http.StatusUnsupportedMediaType, fmt.Errorf("could not decode postcard: %v", err)}
+	}
+	if config.Width > maxPostcardSide || config.Height > maxPostcardSide {
+		return badRequest("%s postcard is %dx%d, larger than %dx%d", format, config.Width, config.Height, maxPostcardSide, maxPostcardSide)
+	}
+	return nil
+}
+
+// decodeImage checks that all of a base64 encoded image decodes, and not
+// just its header. It is only done with the postcards that clients send,
+// once validateImage has checked that they aren't too big. Relayed postcards
+// were drawn by the node before, and decoding them again would count as
+// time on the wire.
+func decodeImage(encoded string) error {
+	if _, _, err := image.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(encoded))); err != nil {
+		return &requestError{http.StatusUnsupportedMediaType, fmt.Errorf("could not decode postcard: %v", err)}
+	}
+	return nil
+}
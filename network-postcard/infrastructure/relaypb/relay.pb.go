@@ -0,0 +1,632 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        v5.29.3
+// source: relay.proto
+
+// Schema for passing a route between relay nodes over gRPC. It mirrors the
+// json that the http transport sends, except that the postcard is sent as
+// raw png bytes instead of base64.
+//
+// Regenerate with:
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative relay.proto
+
+package relaypb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Host represents the networking endpoints of an individual machine.
+type Host struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Endpoint      string                 `protobuf:"bytes,2,opt,name=endpoint,proto3" json:"endpoint,omitempty"`
+	Private       string                 `protobuf:"bytes,3,opt,name=private,proto3" json:"private,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Host) Reset() {
+	*x = Host{}
+	mi := &file_relay_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Host) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Host) ProtoMessage() {}
+
+func (x *Host) ProtoReflect() protoreflect.Message {
+	mi := &file_relay_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Host.ProtoReflect.Descriptor instead.
+func (*Host) Descriptor() ([]byte, []int) {
+	return file_relay_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Host) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Host) GetEndpoint() string {
+	if x != nil {
+		return x.Endpoint
+	}
+	return ""
+}
+
+func (x *Host) GetPrivate() string {
+	if x != nil {
+		return x.Private
+	}
+	return ""
+}
+
+// Node is a stop along the route.
+type Node struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Host          *Host                  `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+	In            *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=in,proto3" json:"in,omitempty"`
+	Out           *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=out,proto3" json:"out,omitempty"`
+	Slot          int32                  `protobuf:"varint,4,opt,name=slot,proto3" json:"slot,omitempty"`
+	Via           string                 `protobuf:"bytes,5,opt,name=via,proto3" json:"via,omitempty"`
+	Skipped       bool                   `protobuf:"varint,6,opt,name=skipped,proto3" json:"skipped,omitempty"`
+	Skew          *durationpb.Duration   `protobuf:"bytes,7,opt,name=skew,proto3" json:"skew,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Node) Reset() {
+	*x = Node{}
+	mi := &file_relay_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Node) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Node) ProtoMessage() {}
+
+func (x *Node) ProtoReflect() protoreflect.Message {
+	mi := &file_relay_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Node.ProtoReflect.Descriptor instead.
+func (*Node) Descriptor() ([]byte, []int) {
+	return file_relay_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Node) GetHost() *Host {
+	if x != nil {
+		return x.Host
+	}
+	return nil
+}
+
+func (x *Node) GetIn() *timestamppb.Timestamp {
+	if x != nil {
+		return x.In
+	}
+	return nil
+}
+
+func (x *Node) GetOut() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Out
+	}
+	return nil
+}
+
+func (x *Node) GetSlot() int32 {
+	if x != nil {
+		return x.Slot
+	}
+	return 0
+}
+
+func (x *Node) GetVia() string {
+	if x != nil {
+		return x.Via
+	}
+	return ""
+}
+
+func (x *Node) GetSkipped() bool {
+	if x != nil {
+		return x.Skipped
+	}
+	return false
+}
+
+func (x *Node) GetSkew() *durationpb.Duration {
+	if x != nil {
+		return x.Skew
+	}
+	return nil
+}
+
+// Hop is a path on the route from origin node to destination node.
+type Hop struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Origin        *Node                  `protobuf:"bytes,1,opt,name=origin,proto3" json:"origin,omitempty"`
+	Destination   *Node                  `protobuf:"bytes,2,opt,name=destination,proto3" json:"destination,omitempty"`
+	Duration      *durationpb.Duration   `protobuf:"bytes,3,opt,name=duration,proto3" json:"duration,omitempty"`
+	Nanoseconds   int64                  `protobuf:"varint,4,opt,name=nanoseconds,proto3" json:"nanoseconds,omitempty"`
+	Seconds       float64                `protobuf:"fixed64,5,opt,name=seconds,proto3" json:"seconds,omitempty"`
+	Skipped       bool                   `protobuf:"varint,6,opt,name=skipped,proto3" json:"skipped,omitempty"`
+	RawDuration   *durationpb.Duration   `protobuf:"bytes,7,opt,name=raw_duration,json=rawDuration,proto3" json:"raw_duration,omitempty"`
+	RawSeconds    float64                `protobuf:"fixed64,8,opt,name=raw_seconds,json=rawSeconds,proto3" json:"raw_seconds,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Hop) Reset() {
+	*x = Hop{}
+	mi := &file_relay_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Hop) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Hop) ProtoMessage() {}
+
+func (x *Hop) ProtoReflect() protoreflect.Message {
+	mi := &file_relay_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Hop.ProtoReflect.Descriptor instead.
+func (*Hop) Descriptor() ([]byte, []int) {
+	return file_relay_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Hop) GetOrigin() *Node {
+	if x != nil {
+		return x.Origin
+	}
+	return nil
+}
+
+func (x *Hop) GetDestination() *Node {
+	if x != nil {
+		return x.Destination
+	}
+	return nil
+}
+
+func (x *Hop) GetDuration() *durationpb.Duration {
+	if x != nil {
+		return x.Duration
+	}
+	return nil
+}
+
+func (x *Hop) GetNanoseconds() int64 {
+	if x != nil {
+		return x.Nanoseconds
+	}
+	return 0
+}
+
+func (x *Hop) GetSeconds() float64 {
+	if x != nil {
+		return x.Seconds
+	}
+	return 0
+}
+
+func (x *Hop) GetSkipped() bool {
+	if x != nil {
+		return x.Skipped
+	}
+	return false
+}
+
+func (x *Hop) GetRawDuration() *durationpb.Duration {
+	if x != nil {
+		return x.RawDuration
+	}
+	return nil
+}
+
+func (x *Hop) GetRawSeconds() float64 {
+	if x != nil {
+		return x.RawSeconds
+	}
+	return 0
+}
+
+// Route is the path the postcard takes through the network.
+type Route struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Nodes         []*Node                `protobuf:"bytes,2,rep,name=nodes,proto3" json:"nodes,omitempty"`
+	Hops          []*Hop                 `protobuf:"bytes,3,rep,name=hops,proto3" json:"hops,omitempty"`
+	Total         *Hop                   `protobuf:"bytes,4,opt,name=total,proto3" json:"total,omitempty"`
+	Postcard      []byte                 `protobuf:"bytes,5,opt,name=postcard,proto3" json:"postcard,omitempty"`
+	Initialized   bool                   `protobuf:"varint,6,opt,name=initialized,proto3" json:"initialized,omitempty"`
+	AllNodes      []*Node                `protobuf:"bytes,7,rep,name=all_nodes,json=allNodes,proto3" json:"all_nodes,omitempty"`
+	AllHops       []*Hop                 `protobuf:"bytes,8,rep,name=all_hops,json=allHops,proto3" json:"all_hops,omitempty"`
+	LastUpdate    *timestamppb.Timestamp `protobuf:"bytes,9,opt,name=last_update,json=lastUpdate,proto3" json:"last_update,omitempty"`
+	Status        string                 `protobuf:"bytes,10,opt,name=status,proto3" json:"status,omitempty"`
+	Transitions   []*Transition          `protobuf:"bytes,11,rep,name=transitions,proto3" json:"transitions,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Route) Reset() {
+	*x = Route{}
+	mi := &file_relay_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Route) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Route) ProtoMessage() {}
+
+func (x *Route) ProtoReflect() protoreflect.Message {
+	mi := &file_relay_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Route.ProtoReflect.Descriptor instead.
+func (*Route) Descriptor() ([]byte, []int) {
+	return file_relay_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Route) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Route) GetNodes() []*Node {
+	if x != nil {
+		return x.Nodes
+	}
+	return nil
+}
+
+func (x *Route) GetHops() []*Hop {
+	if x != nil {
+		return x.Hops
+	}
+	return nil
+}
+
+func (x *Route) GetTotal() *Hop {
+	if x != nil {
+		return x.Total
+	}
+	return nil
+}
+
+func (x *Route) GetPostcard() []byte {
+	if x != nil {
+		return x.Postcard
+	}
+	return nil
+}
+
+func (x *Route) GetInitialized() bool {
+	if x != nil {
+		return x.Initialized
+	}
+	return false
+}
+
+func (x *Route) GetAllNodes() []*Node {
+	if x != nil {
+		return x.AllNodes
+	}
+	return nil
+}
+
+func (x *Route) GetAllHops() []*Hop {
+	if x != nil {
+		return x.AllHops
+	}
+	return nil
+}
+
+func (x *Route) GetLastUpdate() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastUpdate
+	}
+	return nil
+}
+
+func (x *Route) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *Route) GetTransitions() []*Transition {
+	if x != nil {
+		return x.Transitions
+	}
+	return nil
+}
+
+type Transition struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	At            *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=at,proto3" json:"at,omitempty"`
+	Reason        string                 `protobuf:"bytes,3,opt,name=reason,proto3" json:"reason,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Transition) Reset() {
+	*x = Transition{}
+	mi := &file_relay_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Transition) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Transition) ProtoMessage() {}
+
+func (x *Transition) ProtoReflect() protoreflect.Message {
+	mi := &file_relay_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Transition.ProtoReflect.Descriptor instead.
+func (*Transition) Descriptor() ([]byte, []int) {
+	return file_relay_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Transition) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *Transition) GetAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.At
+	}
+	return nil
+}
+
+func (x *Transition) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+type RelayReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RelayReply) Reset() {
+	*x = RelayReply{}
+	mi := &file_relay_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RelayReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RelayReply) ProtoMessage() {}
+
+func (x *RelayReply) ProtoReflect() protoreflect.Message {
+	mi := &file_relay_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RelayReply.ProtoReflect.Descriptor instead.
+func (*RelayReply) Descriptor() ([]byte, []int) {
+	return file_relay_proto_rawDescGZIP(), []int{5}
+}
+
+var File_relay_proto protoreflect.FileDescriptor
+
+const file_relay_proto_rawDesc = "" +
+	"\n" +
+	"\vrelay.proto\x12\bgcprelay\x1a\x1egoogle/protobuf/duration.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"P\n" +
+	"\x04Host\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x1a\n" +
+	"\bendpoint\x18\x02 \x01(\tR\bendpoint\x12\x18\n" +
+	"\aprivate\x18\x03 \x01(\tR\aprivate\"\xf3\x01\n" +
+	"\x04Node\x12\"\n" +
+	"\x04host\x18\x01 \x01(\v2\x0e.gcprelay.HostR\x04host\x12*\n" +
+	"\x02in\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\x02in\x12,\n" +
+	"\x03out\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\x03out\x12\x12\n" +
+	"\x04slot\x18\x04 \x01(\x05R\x04slot\x12\x10\n" +
+	"\x03via\x18\x05 \x01(\tR\x03via\x12\x18\n" +
+	"\askipped\x18\x06 \x01(\bR\askipped\x12-\n" +
+	"\x04skew\x18\a \x01(\v2\x19.google.protobuf.DurationR\x04skew\"\xcb\x02\n" +
+	"\x03Hop\x12&\n" +
+	"\x06origin\x18\x01 \x01(\v2\x0e.gcprelay.NodeR\x06origin\x120\n" +
+	"\vdestination\x18\x02 \x01(\v2\x0e.gcprelay.NodeR\vdestination\x125\n" +
+	"\bduration\x18\x03 \x01(\v2\x19.google.protobuf.DurationR\bduration\x12 \n" +
+	"\vnanoseconds\x18\x04 \x01(\x03R\vnanoseconds\x12\x18\n" +
+	"\aseconds\x18\x05 \x01(\x01R\aseconds\x12\x18\n" +
+	"\askipped\x18\x06 \x01(\bR\askipped\x12<\n" +
+	"\fraw_duration\x18\a \x01(\v2\x19.google.protobuf.DurationR\vrawDuration\x12\x1f\n" +
+	"\vraw_seconds\x18\b \x01(\x01R\n" +
+	"rawSeconds\"\xa7\x03\n" +
+	"\x05Route\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12$\n" +
+	"\x05nodes\x18\x02 \x03(\v2\x0e.gcprelay.NodeR\x05nodes\x12!\n" +
+	"\x04hops\x18\x03 \x03(\v2\r.gcprelay.HopR\x04hops\x12#\n" +
+	"\x05total\x18\x04 \x01(\v2\r.gcprelay.HopR\x05total\x12\x1a\n" +
+	"\bpostcard\x18\x05 \x01(\fR\bpostcard\x12 \n" +
+	"\vinitialized\x18\x06 \x01(\bR\vinitialized\x12+\n" +
+	"\tall_nodes\x18\a \x03(\v2\x0e.gcprelay.NodeR\ballNodes\x12(\n" +
+	"\ball_hops\x18\b \x03(\v2\r.gcprelay.HopR\aallHops\x12;\n" +
+	"\vlast_update\x18\t \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"lastUpdate\x12\x16\n" +
+	"\x06status\x18\n" +
+	" \x01(\tR\x06status\x126\n" +
+	"\vtransitions\x18\v \x03(\v2\x14.gcprelay.TransitionR\vtransitions\"h\n" +
+	"\n" +
+	"Transition\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\x12*\n" +
+	"\x02at\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\x02at\x12\x16\n" +
+	"\x06reason\x18\x03 \x01(\tR\x06reason\"\f\n" +
+	"\n" +
+	"RelayReply27\n" +
+	"\x05Relay\x12.\n" +
+	"\x05Relay\x12\x0f.gcprelay.Route\x1a\x14.gcprelay.RelayReplyB3Z1github.com/tpryan/gcprelay/infrastructure/relaypbb\x06proto3"
+
+var (
+	file_relay_proto_rawDescOnce sync.Once
+	file_relay_proto_rawDescData []byte
+)
+
+func file_relay_proto_rawDescGZIP() []byte {
+	file_relay_proto_rawDescOnce.Do(func() {
+		file_relay_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_relay_proto_rawDesc), len(file_relay_proto_rawDesc)))
+	})
+	return file_relay_proto_rawDescData
+}
+
+var file_relay_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_relay_proto_goTypes = []any{
+	(*Host)(nil),                  // 0: gcprelay.Host
+	(*Node)(nil),                  // 1: gcprelay.Node
+	(*Hop)(nil),                   // 2: gcprelay.Hop
+	(*Route)(nil),                 // 3: gcprelay.Route
+	(*Transition)(nil),            // 4: gcprelay.Transition
+	(*RelayReply)(nil),            // 5: gcprelay.RelayReply
+	(*timestamppb.Timestamp)(nil), // 6: google.protobuf.Timestamp
+	(*durationpb.Duration)(nil),   // 7: google.protobuf.Duration
+}
+var file_relay_proto_depIdxs = []int32{
+	0,  // 0: gcprelay.Node.host:type_name -> gcprelay.Host
+	6,  // 1: gcprelay.Node.in:type_name -> google.protobuf.Timestamp
+	6,  // 2: gcprelay.Node.out:type_name -> google.protobuf.Timestamp
+	7,  // 3: gcprelay.Node.skew:type_name -> google.protobuf.Duration
+	1,  // 4: gcprelay.Hop.origin:type_name -> gcprelay.Node
+	1,  // 5: gcprelay.Hop.destination:type_name -> gcprelay.Node
+	7,  // 6: gcprelay.Hop.duration:type_name -> google.protobuf.Duration
+	7,  // 7: gcprelay.Hop.raw_duration:type_name -> google.protobuf.Duration
+	1,  // 8: gcprelay.Route.nodes:type_name -> gcprelay.Node
+	2,  // 9: gcprelay.Route.hops:type_name -> gcprelay.Hop
+	2,  // 10: gcprelay.Route.total:type_name -> gcprelay.Hop
+	1,  // 11: gcprelay.Route.all_nodes:type_name -> gcprelay.Node
+	2,  // 12: gcprelay.Route.all_hops:type_name -> gcprelay.Hop
+	6,  // 13: gcprelay.Route.last_update:type_name -> google.protobuf.Timestamp
+	4,  // 14: gcprelay.Route.transitions:type_name -> gcprelay.Transition
+	6,  // 15: gcprelay.Transition.at:type_name -> google.protobuf.Timestamp
+	3,  // 16: gcprelay.Relay.Relay:input_type -> gcprelay.Route
+	5,  // 17: gcprelay.Relay.Relay:output_type -> gcprelay.RelayReply
+	17, // [17:18] is the sub-list for method output_type
+	16, // [16:17] is the sub-list for method input_type
+	16, // [16:16] is the sub-list for extension type_name
+	16, // [16:16] is the sub-list for extension extendee
+	0,  // [0:16] is the sub-list for field type_name
+}
+
+func init() { file_relay_proto_init() }
+func file_relay_proto_init() {
+	if File_relay_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_relay_proto_rawDesc), len(file_relay_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_relay_proto_goTypes,
+		DependencyIndexes: file_relay_proto_depIdxs,
+		MessageInfos:      file_relay_proto_msgTypes,
+	}.Build()
+	File_relay_proto = out.File
+	file_relay_proto_goTypes = nil
+	file_relay_proto_depIdxs = nil
+}
@@ -0,0 +1,334 @@
+package route
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Frame is the postcard as it was when a node finished with it. Index 0 is
+// the postcard before any node stamped it, and Index i the postcard after the
+// node at i-1 in the route did. Seconds is how long the hop to that node
+// took.
+type Frame struct {
+	Index    int     `json:"index"`
+	Node     string  `json:"node,omitempty"`
+	Seconds  float64 `json:"seconds,omitempty"`
+	Postcard string  `json:"postcard"`
+
+	// img is the postcard already decoded, when the route it was taken from
+	// had it, so that Shrink doesn't have to decode it again.
+	img *image.RGBA
+}
+
+// Frame returns the postcard as the named node left it. The postcard should
+// have been encoded first. An empty name is the postcard before the route
+// starts.
+func (r *Route) Frame(name string) Frame {
+	f := Frame{Postcard: r.Postcard}
+	if r.canvas != nil && r.canvas.source == r.Postcard {
+		f.img = copyRGBA(r.canvas.img)
+	}
+	if name == "" {
+		return f
+	}
+
+	i := r.CurrentNode(name)
+	f.Index, f.Node = i+1, name
+	if i > 0 && i <= len(r.Hops) && !r.Hops[i-1].Skipped {
+		f.Seconds = r.Hops[i-1].Seconds
+	}
+	return f
+}
+
+// Shrink returns the frame with its postcard made width wide, if it is any
+// wider, keeping its shape. Animations are only AnimationWidth wide, so a
+// frame doesn't need to be any wider, and is a lot smaller to store. If it
+// can't be shrunk, the frame is returned as it is.
+func (f Frame) Shrink(width int) (Frame, error) {
+	var img image.Image
+	if f.img != nil {
+		img, f.img = f.img, nil
+	} else {
+		var err error
+		img, _, err = image.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(f.Postcard)))
+		if err != nil {
+			return f, fmt.Errorf("could not decode frame %d: %v", f.Index, err)
+		}
+	}
+	b := img.Bounds()
+	if b.Dx() <= width {
+		return f, nil
+	}
+
+	// This is a lot quicker than imaging, and the frame is resized to the
+	// same width again when it is animated.
+	small := image.NewRGBA(image.Rect(0, 0, width, width*b.Dy()/b.Dx()))
+	xdraw.ApproxBiLinear.Scale(small, small.Bounds(), img, b, xdraw.Src, nil)
+	encoded, err := encodePNG(small)
+	if err != nil {
+		return f, fmt.Errorf("could not encode frame %d: %v", f.Index, err)
+	}
+	f.Postcard = encoded
+	return f, nil
+}
+
+var (
+	// AnimationWidth is how wide animations are, so that they are small
+	// enough to share. The height keeps the shape of the postcard.
+	AnimationWidth = 640
+	// FrameDelay is how long every stamp is shown for, and FinalDelay how
+	// long the finished postcard is, before the animation starts over.
+	FrameDelay = 800 * time.Millisecond
+	FinalDelay = 3 * time.Second
+)
+
+// captionStyle is the text with the node and hop time on every frame.
+var captionStyle = Style{Font: "gobold", Size: 14, Color: "#000000"}
+
+// Animation is the frames of a route decoded into images of the same size,
+// with the node and hop time over the bottom of each one. Decoding is most of
+// the work, so it is done once for every format the animation is encoded in.
+type Animation []*image.RGBA
+
+// NewAnimation decodes frames into an Animation.
+func NewAnimation(frames []Frame) (Animation, error) {
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("there are no frames to animate")
+	}
+
+	var result Animation
+	var size image.Point
+	for _, f := range frames {
+		img, _, err := image.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(f.Postcard)))
+		if err != nil {
+			return nil, fmt.Errorf("could not decode frame %d: %v", f.Index, err)
+		}
+
+		if size == (image.Point{}) {
+			b := img.Bounds()
+			size = image.Pt(AnimationWidth, AnimationWidth*b.Dy()/b.Dx())
+		}
+		img = imaging.Resize(img, size.X, size.Y, imaging.Linear)
+
+		// Every frame is made opaque, so that they all encode the same way.
+		rgba := image.NewRGBA(image.Rectangle{Max: size})
+		draw.Draw(rgba, rgba.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(rgba, rgba.Bounds(), img, image.Point{}, draw.Over)
+
+		if err := caption(rgba, f); err != nil {
+			return nil, fmt.Errorf("could not caption frame %d: %v", f.Index, err)
+		}
+		result = append(result, rgba)
+	}
+	return result, nil
+}
+
+// caption draws the node a frame was made at, and how long the hop to it
+// took, on a band across the bottom of the frame.
+func caption(img *image.RGBA, f Frame) error {
+	if f.Node == "" {
+		return nil
+	}
+
+	text := fmt.Sprintf("%d. %s", f.Index, f.Node)
+	if f.Seconds > 0 {
+		text += fmt.Sprintf("  %.3fs", f.Seconds)
+	}
+
+	scale := float64(img.Bounds().Dx()) / float64(AnimationWidth)
+	d, err := captionStyle.drawer(img, scale)
+	if err != nil {
+		return err
+	}
+
+	height := int(captionStyle.Size * 2 * scale)
+	band := image.Rect(0, img.Bounds().Dy()-height, img.Bounds().Dx(), img.Bounds().Dy())
+	draw.Draw(img, band, image.NewUniform(color.NRGBA{255, 255, 255, 200}), image.Point{}, draw.Over)
+
+	x := align(d, text, 0, img.Bounds().Dx(), "center")
+	drawString(d, text, x, band.Max.Y-int(captionStyle.Size*0.6*scale))
+	return nil
+}
+
+// delay returns how long the frame at i of n is shown.
+func delay(i, n int) time.Duration {
+	if i == n-1 {
+		return FinalDelay
+	}
+	return FrameDelay
+}
+
+// EncodeGIF writes the animation as a gif that loops forever.
+func (a Animation) EncodeGIF(w io.Writer) error {
+	anim := &gif.GIF{}
+	for i, img := range a {
+		anim.Image = append(anim.Image, quantize(img))
+		anim.Delay = append(anim.Delay, int(delay(i, len(a))/(10*time.Millisecond)))
+	}
+
+	if err := gif.EncodeAll(w, anim); err != nil {
+		return fmt.Errorf("could not encode gif: %v", err)
+	}
+	return nil
+}
+
+// quantize maps an image onto the web safe palette, with Floyd-Steinberg
+// dithering. The palette is a 6x6x6 cube, so the nearest colour is found by
+// rounding every channel, which is a lot faster than searching the palette
+// like draw.FloydSteinberg does.
+func quantize(img *image.RGBA) *image.Paletted {
+	b := img.Bounds()
+	p := image.NewPaletted(b, palette.WebSafe)
+
+	// The error carried to this row and the next, 16 times over, with a
+	// column to spare on either side.
+	w := b.Dx()
+	this, next := make([][3]int32, w+2), make([][3]int32, w+2)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := 0; x < w; x++ {
+			pix := img.Pix[img.PixOffset(b.Min.X+x, y):]
+			var index uint8
+			for c := 0; c < 3; c++ {
+				v := int32(pix[c]) + this[x+1][c]/16
+				if v < 0 {
+					v = 0
+				} else if v > 255 {
+					v = 255
+				}
+				level := (v + 25) / 51
+				index = index*6 + uint8(level)
+
+				e := v - level*51
+				this[x+2][c] += e * 7
+				next[x][c] += e * 3
+				next[x+1][c] += e * 5
+				next[x+2][c] += e
+			}
+			p.Pix[p.PixOffset(b.Min.X+x, y)] = index
+		}
+		this, next = next, this
+		for i := range next {
+			next[i] = [3]int32{}
+		}
+	}
+	return p
+}
+
+// pngSignature starts every png file.
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// EncodeAPNG writes the animation as an animated png that loops forever.
+// Each frame is encoded as a png, and its image data is moved into the frame
+// chunks that animated pngs add.
+func (a Animation) EncodeAPNG(w io.Writer) error {
+	out := &chunkWriter{w: w}
+	out.write(pngSignature)
+
+	var seq uint32
+	for i, img := range a {
+		var buf bytes.Buffer
+		if err := encoder.Encode(&buf, img); err != nil {
+			return fmt.Errorf("could not encode frame %d: %v", i, err)
+		}
+		chunks, err := readChunks(buf.Bytes())
+		if err != nil {
+			return fmt.Errorf("could not read frame %d: %v", i, err)
+		}
+
+		if i == 0 {
+			out.chunk("IHDR", chunks["IHDR"][0])
+			// The number of frames, and 0 to loop forever.
+			out.chunk("acTL", be32(uint32(len(a))), be32(0))
+		}
+
+		size := img.Bounds().Size()
+		ms := uint16(delay(i, len(a)) / time.Millisecond)
+		out.chunk("fcTL",
+			be32(seq), be32(uint32(size.X)), be32(uint32(size.Y)),
+			be32(0), be32(0), be16(ms), be16(1000),
+			// Leave the frame as it is, and replace what was there.
+			[]byte{0, 0},
+		)
+		seq++
+
+		for _, data := range chunks["IDAT"] {
+			if i == 0 {
+				out.chunk("IDAT", data)
+				continue
+			}
+			out.chunk("fdAT", be32(seq), data)
+			seq++
+		}
+	}
+	out.chunk("IEND")
+
+	if out.err != nil {
+		return fmt.Errorf("could not write apng: %v", out.err)
+	}
+	return nil
+}
+
+// readChunks returns the data of the chunks in a png by their type.
+func readChunks(b []byte) (map[string][][]byte, error) {
+	if !bytes.HasPrefix(b, pngSignature) {
+		return nil, fmt.Errorf("not a png")
+	}
+	b = b[len(pngSignature):]
+
+	chunks := make(map[string][][]byte)
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return nil, fmt.Errorf("chunk is cut short")
+		}
+		n := binary.BigEndian.Uint32(b)
+		if uint32(len(b)-12) < n {
+			return nil, fmt.Errorf("chunk is cut short")
+		}
+		kind := string(b[4:8])
+		chunks[kind] = append(chunks[kind], b[8:8+n])
+		b = b[12+n:]
+	}
+	return chunks, nil
+}
+
+// chunkWriter writes png chunks, and keeps the first error.
+type chunkWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (c *chunkWriter) write(b []byte) {
+	if c.err == nil {
+		_, c.err = c.w.Write(b)
+	}
+}
+
+// chunk writes a chunk of the kind, with the parts as its data.
+func (c *chunkWriter) chunk(kind string, parts ...[]byte) {
+	data := append([]byte(kind), bytes.Join(parts, nil)...)
+	c.write(be32(uint32(len(data) - 4)))
+	c.write(data)
+	c.write(be32(crc32.ChecksumIEEE(data)))
+}
+
+func be32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func be16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
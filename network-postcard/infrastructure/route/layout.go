@@ -0,0 +1,135 @@
+package route
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LayoutFile is the name of the file, next to the stamps in ImagePath, that
+// describes the order of the zones.
+const LayoutFile = "layout.json"
+
+var layout = DefaultLayout()
+
+// Layout describes the postcard: the order the zones are visited in.
+// Coordinates place zones or regions on the map for route planning, and
+// TimeZones give them the IANA time zone their postmarks are dated in, in
+// addition to the regions that are already known. Stamps are placed around
+// the border of the postcard by Place.
+type Layout struct {
+	Order       []string              `json:"order"`
+	Coordinates map[string]Coordinate `json:"coordinates,omitempty"`
+	TimeZones   map[string]string     `json:"timezones,omitempty"`
+}
+
+// DefaultLayout is the layout used when there is no layout file.
+func DefaultLayout() Layout {
+	return Layout{
+		Order: []string{
+			"asia-east1-a",
+			"asia-northeast1-a",
+			"australia-southeast1-a",
+			"us-west1-a",
+			"us-central1-f",
+			"us-east4-a",
+			"europe-west2-b",
+			"europe-west3-a",
+			"southamerica-east1-a",
+		},
+	}
+}
+
+// CurrentLayout returns the layout that routes are using.
+func CurrentLayout() Layout {
+	return layout
+}
+
+// SetLayout replaces the layout that routes use. It is not safe to call
+// while routes are being ordered or stamped.
+func SetLayout(l Layout) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	layout = l
+	return nil
+}
+
+// LoadLayout reads a layout from a json file. Fields that Layout doesn't
+// have are an error, so that settings a layout no longer has, like the
+// stamp slots that Place replaced, aren't silently ignored.
+func LoadLayout(path string) (Layout, error) {
+	var l Layout
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return l, fmt.Errorf("could not read layout '%s': %v", path, err)
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&l); err != nil {
+		return l, fmt.Errorf("could not decode layout '%s': %v", path, err)
+	}
+
+	if err := l.Validate(); err != nil {
+		return l, fmt.Errorf("invalid layout '%s': %v", path, err)
+	}
+
+	return l, nil
+}
+
+// loadLayout sets the layout from the layout file in imagePath, and keeps the
+// default layout if there isn't one.
+func loadLayout(imagePath string) error {
+	path := filepath.Join(imagePath, LayoutFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	l, err := LoadLayout(path)
+	if err != nil {
+		return err
+	}
+	layout = l
+	return nil
+}
+
+// Validate reports the first problem with the layout.
+func (l Layout) Validate() error {
+	seen := make(map[string]bool)
+	for _, name := range l.Order {
+		if seen[name] {
+			return fmt.Errorf("zone %s is in the order more than once", name)
+		}
+		seen[name] = true
+	}
+
+	for name, tz := range l.TimeZones {
+		if _, err := time.LoadLocation(tz); err != nil {
+			return fmt.Errorf("zone %s has an unknown time zone: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// ordered answers if the zone has a place in the configured order.
+func (l Layout) ordered(name string) bool {
+	for _, n := range l.Order {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Size is the size of a postcard, or a stamp, in pixels.
+type Size struct {
+	Width  int
+	Height int
+}
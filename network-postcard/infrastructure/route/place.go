@@ -0,0 +1,216 @@
+package route
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"math"
+	"math/rand"
+)
+
+const (
+	// MaxTilt is how far a stamp can be turned either way, in degrees.
+	MaxTilt = 30.0
+
+	// placementMargin keeps stamps off the very edge of the postcard, and
+	// placementGap apart from each other.
+	placementMargin = 8
+	placementGap    = 6
+)
+
+// Placement is where a stamp goes on a postcard.
+type Placement struct {
+	// X and Y are the top left corner of the stamp once it is turned.
+	X int
+	Y int
+	// Width and Height are the size the stamp is scaled to before it is
+	// turned.
+	Width  int
+	Height int
+	// Angle is how far the stamp is turned anticlockwise, in degrees.
+	Angle float64
+}
+
+// Bounds is the area of the postcard the turned stamp covers.
+func (p Placement) Bounds() image.Rectangle {
+	w, h := rotatedSize(p.Width, p.Height, p.Angle)
+	return image.Rect(p.X, p.Y, p.X+w, p.Y+h)
+}
+
+// Place lays out stamps of the given sizes around the border of a postcard,
+// in order, clockwise from the top left, so that none of them overlap. Each
+// stamp is turned up to MaxTilt either way. When they don't all fit, every
+// stamp is scaled down by the same amount until they do, and if they still
+// don't by the time they are a hundredth of their size, it gives up. The same
+// seed always gives the same placements.
+func Place(seed int64, card Size, stamps []Size) ([]Placement, error) {
+	rnd := rand.New(rand.NewSource(seed))
+
+	angles := make([]float64, len(stamps))
+	for i := range angles {
+		angles[i] = rnd.Float64()*2*MaxTilt - MaxTilt
+	}
+
+	for scale := 1.0; scale >= 0.01; scale *= 0.95 {
+		placements := make([]Placement, len(stamps))
+		for i, s := range stamps {
+			placements[i] = Placement{
+				Width:  int(math.Max(1, math.Round(float64(s.Width)*scale))),
+				Height: int(math.Max(1, math.Round(float64(s.Height)*scale))),
+				Angle:  angles[i],
+			}
+		}
+		if pack(placements, card, rnd) {
+			return placements, nil
+		}
+	}
+	return nil, fmt.Errorf("%d stamps don't fit on a %dx%d postcard", len(stamps), card.Width, card.Height)
+}
+
+// pack places stamps on the four sides of the postcard, in proportion to
+// how long each side is, and spreads them out along it. It answers false if
+// they don't fit.
+func pack(placements []Placement, card Size, rnd *rand.Rand) bool {
+	// The top and bottom run the whole width of the postcard, and the
+	// sides run between them.
+	thickness := 0
+	for _, p := range placements {
+		b := p.Bounds()
+		if b.Dx() > thickness {
+			thickness = b.Dx()
+		}
+		if b.Dy() > thickness {
+			thickness = b.Dy()
+		}
+	}
+	across := card.Width - 2*placementMargin
+	down := card.Height - 2*placementMargin - 2*(thickness+placementGap)
+	if across < 2*thickness+placementGap || down < 0 {
+		return false
+	}
+
+	// top, right, bottom, left
+	lengths := []int{across, down, across, down}
+	counts := share(len(placements), lengths)
+
+	next := 0
+	for side, count := range counts {
+		stamps := placements[next : next+count]
+		next += count
+
+		// Stamps take up their width along the top and bottom, and their
+		// height along the sides. What they take up across the side is
+		// their depth.
+		extents := make([]int, count)
+		depths := make([]int, count)
+		used := placementGap * (count - 1)
+		for i, p := range stamps {
+			b := p.Bounds()
+			extents[i], depths[i] = b.Dx(), b.Dy()
+			if side == 1 || side == 3 {
+				extents[i], depths[i] = b.Dy(), b.Dx()
+			}
+			used += extents[i]
+		}
+		if used > lengths[side] {
+			return false
+		}
+
+		// What is left over is split at random into the spaces before,
+		// between and after the stamps.
+		spaces := make([]float64, count+1)
+		total := 0.0
+		for i := range spaces {
+			spaces[i] = rnd.Float64()
+			total += spaces[i]
+		}
+		slack := float64(lengths[side] - used)
+
+		along := 0.0
+		for i := range stamps {
+			along += slack * spaces[i] / total
+			offset := int(along)
+			b := stamps[i].Bounds()
+			inset := placementMargin + rnd.Intn(thickness-depths[i]+1)
+
+			p := &stamps[i]
+			switch side {
+			case 0:
+				p.X, p.Y = placementMargin+offset, inset
+			case 1:
+				p.X, p.Y = card.Width-inset-b.Dx(), placementMargin+thickness+placementGap+offset
+			case 2:
+				p.X, p.Y = card.Width-placementMargin-offset-b.Dx(), card.Height-inset-b.Dy()
+			case 3:
+				p.X, p.Y = inset, card.Height-placementMargin-thickness-placementGap-offset-b.Dy()
+			}
+			along += float64(extents[i] + placementGap)
+		}
+	}
+	return true
+}
+
+// share splits n stamps between sides in proportion to their lengths,
+// giving the ones that are left over to the sides that were closest to
+// getting another.
+func share(n int, lengths []int) []int {
+	total := 0
+	for _, l := range lengths {
+		total += l
+	}
+
+	counts := make([]int, len(lengths))
+	rest := make([]float64, len(lengths))
+	given := 0
+	for i, l := range lengths {
+		exact := float64(n) * float64(l) / float64(total)
+		counts[i] = int(exact)
+		rest[i] = exact - float64(counts[i])
+		given += counts[i]
+	}
+	for ; given < n; given++ {
+		most := 0
+		for i := range rest {
+			if rest[i] > rest[most] {
+				most = i
+			}
+		}
+		counts[most]++
+		rest[most] = -1
+	}
+	return counts
+}
+
+// rotatedSize is the size of a w by h image turned by angle degrees, worked
+// out the same way imaging.Rotate does.
+func rotatedSize(w, h int, angle float64) (int, int) {
+	if w <= 0 || h <= 0 {
+		return 0, 0
+	}
+
+	sin, cos := math.Sincos(math.Pi * angle / 180)
+	corners := [][2]float64{{0, 0}, {float64(w - 1), 0}, {float64(w - 1), float64(h - 1)}, {0, float64(h - 1)}}
+	minX, maxX, minY, maxY := 0.0, 0.0, 0.0, 0.0
+	for _, c := range corners {
+		x, y := c[0]*cos-c[1]*sin, c[0]*sin+c[1]*cos
+		minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+	}
+
+	width, height := maxX-minX+1, maxY-minY+1
+	if width-math.Floor(width) > 0.1 {
+		width++
+	}
+	if height-math.Floor(height) > 0.1 {
+		height++
+	}
+	return int(width), int(height)
+}
+
+// placementSeed is the seed a route's stamps are placed with, so that every
+// node places them the same way.
+func placementSeed(id string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return int64(h.Sum64())
+}
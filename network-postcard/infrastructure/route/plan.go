@@ -0,0 +1,268 @@
+package route
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Coordinate is a spot on the globe in degrees.
+type Coordinate struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// place is where a Google Cloud region is, roughly, the city and country it
+// is named for on its stamp, and the IANA time zone it is postmarked in.
+type place struct {
+	Coordinate
+	City     string
+	Country  string
+	TimeZone string
+}
+
+// regions are the Google Cloud regions. Zones are looked up by their region,
+// and the layout can add to or override where they are.
+var regions = map[string]place{
+	"asia-east1":              {Coordinate{24.05, 120.52}, "Changhua County", "Taiwan", "Asia/Taipei"},
+	"asia-east2":              {Coordinate{22.32, 114.17}, "Hong Kong", "Hong Kong", "Asia/Hong_Kong"},
+	"asia-northeast1":         {Coordinate{35.68, 139.69}, "Tokyo", "Japan", "Asia/Tokyo"},
+	"asia-northeast2":         {Coordinate{34.69, 135.50}, "Osaka", "Japan", "Asia/Tokyo"},
+	"asia-northeast3":         {Coordinate{37.57, 126.98}, "Seoul", "South Korea", "Asia/Seoul"},
+	"asia-south1":             {Coordinate{19.08, 72.88}, "Mumbai", "India", "Asia/Kolkata"},
+	"asia-south2":             {Coordinate{28.70, 77.10}, "Delhi", "India", "Asia/Kolkata"},
+	"asia-southeast1":         {Coordinate{1.34, 103.71}, "Jurong West", "Singapore", "Asia/Singapore"},
+	"asia-southeast2":         {Coordinate{-6.21, 106.85}, "Jakarta", "Indonesia", "Asia/Jakarta"},
+	"australia-southeast1":    {Coordinate{-33.87, 151.21}, "Sydney", "Australia", "Australia/Sydney"},
+	"australia-southeast2":    {Coordinate{-37.81, 144.96}, "Melbourne", "Australia", "Australia/Melbourne"},
+	"europe-central2":         {Coordinate{52.23, 21.01}, "Warsaw", "Poland", "Europe/Warsaw"},
+	"europe-north1":           {Coordinate{60.57, 27.20}, "Hamina", "Finland", "Europe/Helsinki"},
+	"europe-west1":            {Coordinate{50.45, 3.82}, "St. Ghislain", "Belgium", "Europe/Brussels"},
+	"europe-west2":            {Coordinate{51.51, -0.13}, "London", "United Kingdom", "Europe/London"},
+	"europe-west3":            {Coordinate{50.11, 8.68}, "Frankfurt", "Germany", "Europe/Berlin"},
+	"europe-west4":            {Coordinate{53.44, 6.83}, "Eemshaven", "Netherlands", "Europe/Amsterdam"},
+	"europe-west6":            {Coordinate{47.37, 8.54}, "Zurich", "Switzerland", "Europe/Zurich"},
+	"me-west1":                {Coordinate{32.09, 34.78}, "Tel Aviv", "Israel", "Asia/Jerusalem"},
+	"northamerica-northeast1": {Coordinate{45.50, -73.57}, "Montreal", "Canada", "America/Toronto"},
+	"northamerica-northeast2": {Coordinate{43.65, -79.38}, "Toronto", "Canada", "America/Toronto"},
+	"southamerica-east1":      {Coordinate{-23.55, -46.63}, "Sao Paulo", "Brazil", "America/Sao_Paulo"},
+	"southamerica-west1":      {Coordinate{-33.45, -70.67}, "Santiago", "Chile", "America/Santiago"},
+	"us-central1":             {Coordinate{41.26, -95.86}, "Council Bluffs", "United States", "America/Chicago"},
+	"us-east1":                {Coordinate{33.20, -80.01}, "Moncks Corner", "United States", "America/New_York"},
+	"us-east4":                {Coordinate{39.04, -77.49}, "Ashburn", "United States", "America/New_York"},
+	"us-west1":                {Coordinate{45.59, -121.18}, "The Dalles", "United States", "America/Los_Angeles"},
+	"us-west2":                {Coordinate{34.05, -118.24}, "Los Angeles", "United States", "America/Los_Angeles"},
+	"us-west3":                {Coordinate{40.76, -111.89}, "Salt Lake City", "United States", "America/Denver"},
+	"us-west4":                {Coordinate{36.17, -115.14}, "Las Vegas", "United States", "America/Los_Angeles"},
+}
+
+// earthRadius is the mean radius of the earth in kilometers.
+const earthRadius = 6371.0
+
+// fiberSpeed is roughly how many kilometers light covers in fiber in a
+// second. It turns a distance into a guess at a latency when there is no
+// measured one.
+const fiberSpeed = 200000.0
+
+// Region returns the region a zone is in, "us-west1-a" is in "us-west1".
+func Region(zone string) string {
+	i := strings.LastIndex(zone, "-")
+	if i < 0 || len(zone)-i != 2 {
+		return zone
+	}
+	return zone[:i]
+}
+
+// Locate returns the coordinate of a zone, from the layout if it is there,
+// or from the region table.
+func Locate(zone string) (Coordinate, bool) {
+	for _, name := range []string{zone, Region(zone)} {
+		if c, ok := layout.Coordinates[name]; ok {
+			return c, true
+		}
+		if p, ok := regions[name]; ok {
+			return p.Coordinate, true
+		}
+	}
+	return Coordinate{}, false
+}
+
+// Distance is the great circle distance between two coordinates in
+// kilometers.
+func Distance(a, b Coordinate) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Latencies are the mean measured seconds from one host to another, keyed by
+// origin name and then destination name.
+type Latencies map[string]map[string]float64
+
+// MeanLatencies averages the durations of hops between each pair of hosts.
+func MeanLatencies(hops []Hop) Latencies {
+	sums := make(map[string]map[string]float64)
+	counts := make(map[string]map[string]int)
+
+	for _, h := range hops {
+		o, d := h.Origin.Host.Name, h.Destination.Host.Name
+		if o == "" || d == "" || h.Seconds <= 0 {
+			continue
+		}
+		if sums[o] == nil {
+			sums[o] = make(map[string]float64)
+			counts[o] = make(map[string]int)
+		}
+		sums[o][d] += h.Seconds
+		counts[o][d]++
+	}
+
+	l := make(Latencies)
+	for o, dests := range sums {
+		l[o] = make(map[string]float64)
+		for d, sum := range dests {
+			l[o][d] = sum / float64(counts[o][d])
+		}
+	}
+	return l
+}
+
+// Plan arranges the route with the named strategy. The strategies that plan
+// a trip keep the first node of the route where it is, and reorder the rest.
+//
+//   - "" or "order" keeps the route as it is.
+//   - "random" shuffles all of the nodes, the first one included.
+//   - "nearest" makes the shortest trip it can by distance.
+//   - "longest" makes the longest trip it can by distance.
+//   - "fastest" makes the quickest trip it can using the measured latencies,
+//     falling back to distance for pairs that have never been measured.
+func (r *Route) Plan(strategy string, l Latencies) error {
+	var cost func(a, b Node) float64
+	shortest := true
+
+	switch strategy {
+	case "", "order":
+		return nil
+	case "random":
+		return r.Shuffle()
+	case "nearest":
+		cost = distanceCost
+	case "longest":
+		cost = distanceCost
+		shortest = false
+	case "fastest":
+		cost = l.cost
+	default:
+		return fmt.Errorf("%w '%s'", ErrUnknownStrategy, strategy)
+	}
+
+	if len(r.Nodes) < 3 {
+		return nil
+	}
+
+	// Nodes that can not be placed on the map can not be planned, so they
+	// are tacked on the end.
+	var nodes, unplaced []Node
+	for i, n := range r.Nodes {
+		if _, ok := Locate(n.Host.Name); ok || i == 0 {
+			nodes = append(nodes, n)
+			continue
+		}
+		unplaced = append(unplaced, n)
+	}
+
+	better := func(a, b float64) bool { return a < b }
+	if !shortest {
+		better = func(a, b float64) bool { return a > b }
+	}
+
+	nodes = greedyTour(nodes, cost, better)
+	nodes = twoOpt(nodes, cost, better)
+
+	r.Nodes = append(nodes, unplaced...)
+	return r.UpdateHops()
+}
+
+// distanceCost is the distance between two nodes, or zero if either is not
+// on the map.
+func distanceCost(a, b Node) float64 {
+	ca, ok := Locate(a.Host.Name)
+	if !ok {
+		return 0
+	}
+	cb, ok := Locate(b.Host.Name)
+	if !ok {
+		return 0
+	}
+	return Distance(ca, cb)
+}
+
+// cost is the measured latency between two nodes, or a guess from the
+// distance between them.
+func (l Latencies) cost(a, b Node) float64 {
+	if s, ok := l[a.Host.Name][b.Host.Name]; ok {
+		return s
+	}
+	return distanceCost(a, b) / fiberSpeed
+}
+
+// greedyTour starts at the first node and always goes to the best next node
+// that hasn't been visited yet.
+func greedyTour(nodes []Node, cost func(a, b Node) float64, better func(a, b float64) bool) []Node {
+	tour := []Node{nodes[0]}
+	left := append([]Node{}, nodes[1:]...)
+
+	for len(left) > 0 {
+		last := tour[len(tour)-1]
+		best := 0
+		for i := 1; i < len(left); i++ {
+			if better(cost(last, left[i]), cost(last, left[best])) {
+				best = i
+			}
+		}
+		tour = append(tour, left[best])
+		left = append(left[:best], left[best+1:]...)
+	}
+	return tour
+}
+
+// twoOpt improves a tour by reversing stretches of it for as long as that
+// makes it better. The first node is never moved.
+func twoOpt(tour []Node, cost func(a, b Node) float64, better func(a, b float64) bool) []Node {
+	total := tourCost(tour, cost)
+
+	for improved := true; improved; {
+		improved = false
+		for i := 1; i < len(tour)-1; i++ {
+			for j := i + 1; j < len(tour); j++ {
+				reverse(tour, i, j)
+				if c := tourCost(tour, cost); better(c, total) {
+					total = c
+					improved = true
+					continue
+				}
+				reverse(tour, i, j)
+			}
+		}
+	}
+	return tour
+}
+
+func tourCost(tour []Node, cost func(a, b Node) float64) float64 {
+	total := 0.0
+	for i := 1; i < len(tour); i++ {
+		total += cost(tour[i-1], tour[i])
+	}
+	return total
+}
+
+func reverse(nodes []Node, i, j int) {
+	for ; i < j; i, j = i+1, j-1 {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+}
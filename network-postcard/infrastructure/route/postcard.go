@@ -0,0 +1,128 @@
+package route
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"strings"
+	"sync"
+)
+
+// canvas is the decoded postcard. It is kept between operations on a route,
+// so that the postcard only has to be decoded when it arrives at a node and
+// encoded when it leaves.
+type canvas struct {
+	img *image.RGBA
+	// source is the encoded Postcard the image was decoded from, or last
+	// encoded to.
+	source string
+	// dirty is set when the image has been drawn on since it was decoded or
+	// encoded.
+	dirty bool
+}
+
+var encoder = png.Encoder{
+	CompressionLevel: png.BestSpeed,
+	BufferPool:       &bufferPool{},
+}
+
+// bufferPool lets the png encoder reuse its buffers between postcards.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func (p *bufferPool) Get() *png.EncoderBuffer {
+	b, _ := p.pool.Get().(*png.EncoderBuffer)
+	return b
+}
+
+func (p *bufferPool) Put(b *png.EncoderBuffer) {
+	p.pool.Put(b)
+}
+
+// Image returns the postcard as an image that can be drawn on. The postcard
+// is only decoded the first time it is asked for, or when Postcard has been
+// replaced since. Call EncodePostcard to write any drawing back to Postcard.
+func (r *Route) Image() (*image.RGBA, error) {
+	if r.canvas != nil && r.canvas.source == r.Postcard {
+		return r.canvas.img, nil
+	}
+
+	img := base64.NewDecoder(base64.StdEncoding, strings.NewReader(r.Postcard))
+	postcard, _, err := image.Decode(img)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode image %v", err)
+	}
+
+	r.canvas = &canvas{img: toRGBA(postcard), source: r.Postcard}
+	return r.canvas.img, nil
+}
+
+// touch marks the postcard as drawn on.
+func (r *Route) touch() {
+	if r.canvas != nil {
+		r.canvas.dirty = true
+	}
+}
+
+// EncodePostcard writes the postcard image back into Postcard if it has been
+// drawn on. It should be called before the route leaves the node.
+func (r *Route) EncodePostcard() error {
+	if r.canvas == nil || !r.canvas.dirty || r.canvas.source != r.Postcard {
+		return nil
+	}
+
+	encoded, err := encodePNG(r.canvas.img)
+	if err != nil {
+		return err
+	}
+
+	r.Postcard = encoded
+	r.canvas.source = encoded
+	r.canvas.dirty = false
+	return nil
+}
+
+// SetPostcard sets the image in both encoded and binary version. The image
+// is copied, so drawing on the postcard never changes img.
+func (r *Route) SetPostcard(img image.Image) error {
+	rgba := copyRGBA(img)
+
+	encoded, err := encodePNG(rgba)
+	if err != nil {
+		return err
+	}
+
+	r.Postcard = encoded
+	r.canvas = &canvas{img: rgba, source: encoded}
+	return nil
+}
+
+func encodePNG(img image.Image) (string, error) {
+	buf := new(bytes.Buffer)
+
+	if err := encoder.Encode(buf, img); err != nil {
+		return "", fmt.Errorf("could not encode image: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// toRGBA returns an image as an RGBA that starts at the origin, only copying
+// it if it has to.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	return copyRGBA(img)
+}
+
+// copyRGBA copies an image to an RGBA that starts at the origin.
+func copyRGBA(img image.Image) *image.RGBA {
+	zed := image.Point{0, 0}
+	rgba := image.NewRGBA(image.Rectangle{zed, zed.Add(img.Bounds().Size())})
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
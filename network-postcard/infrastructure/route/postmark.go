@@ -0,0 +1,238 @@
+package route
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+	// Nodes may not have a time zone database, and postmarks need one.
+	_ "time/tzdata"
+
+	"github.com/disintegration/imaging"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// postmarkRadius is the radius of the outside ring of a postmark.
+	postmarkRadius = 46
+	postmarkWidth  = 250
+	postmarkHeight = 2*postmarkRadius + 12
+)
+
+// postmarkInk is the colour postmarks are inked in.
+var postmarkInk = color.NRGBA{0x1d, 0x23, 0x40, 0xd8}
+
+// TimeZone returns the time zone a zone is postmarked in, from the layout if
+// it is there, or from the region table. Zones that neither know are
+// postmarked in UTC.
+func TimeZone(zone string) *time.Location {
+	for _, name := range []string{zone, Region(zone)} {
+		tz, ok := layout.TimeZones[name]
+		if !ok {
+			p, known := regions[name]
+			tz, ok = p.TimeZone, known
+		}
+		if !ok {
+			continue
+		}
+		if loc, err := time.LoadLocation(tz); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+// postmarkText returns what a postmark says: the zone around the top, the
+// city around the bottom, and the date and time where the zone is across
+// the middle.
+func postmarkText(zone string, t time.Time) (top, bottom, date, clock string) {
+	local := t.In(TimeZone(zone))
+	return strings.ToUpper(zone),
+		strings.ToUpper(regions[Region(zone)].City),
+		strings.ToUpper(local.Format("2 Jan 2006")),
+		local.Format("15:04 MST")
+}
+
+// Postmark draws the postmark of a zone at a time: two rings with the zone
+// around the top and the city around the bottom, the local date and time in
+// the middle, and wavy cancellation lines running off to the right. The
+// center of the rings is postmarkRadius+6 from the left, halfway down. It is
+// inked unevenly, and a little differently for every rnd.
+func Postmark(zone string, t time.Time, rnd *rand.Rand) (*image.NRGBA, error) {
+	mask := image.NewAlpha(image.Rect(0, 0, postmarkWidth, postmarkHeight))
+	c := image.Pt(postmarkRadius+6, postmarkHeight/2)
+	outer := float64(postmarkRadius)
+	inner := outer - 15
+
+	ring(mask, c, outer, 2.5)
+	ring(mask, c, inner, 1.2)
+
+	top, bottom, date, clock := postmarkText(zone, t)
+	f, err := parsedFont("gobold")
+	if err != nil {
+		return nil, err
+	}
+	arcText(mask, f, top, c, inner+3, true, rnd)
+	arcText(mask, f, bottom, c, outer-4, false, rnd)
+
+	width := int(2*inner) - 8
+	for i, line := range []string{date, clock} {
+		d, _, err := fitText(mask, Style{"gomonobold", 9, "#000000"}, line, width, 1)
+		if err != nil {
+			return nil, err
+		}
+		drawString(d, line, align(d, line, c.X-width/2, width, "center"), c.Y-1+i*11)
+	}
+
+	// The cancellation lines are each a little out of step.
+	for i := -2; i <= 2; i++ {
+		wave(mask, c.X+int(outer)+3, postmarkWidth-4, float64(c.Y+i*11), rnd.Float64()*0.8)
+	}
+
+	return ink(mask, postmarkInk, rnd), nil
+}
+
+// arcText draws text along a circle of radius r around c, centered on the
+// top of the circle, or the bottom, so that it reads left to right either
+// way. r is the radius of the baseline, and the letters stand outward from
+// it on the top, and inward on the bottom. Text that is too long for most of
+// half the circle is made smaller. Every letter is set a little crooked.
+func arcText(dst *image.Alpha, f *truetype.Font, text string, c image.Point, r float64, top bool, rnd *rand.Rand) {
+	const spacing = 1.0
+	runes := []rune(text)
+	advances := make([]float64, len(runes))
+
+	var face font.Face
+	for size := 9.0; ; size -= 0.5 {
+		face = truetype.NewFace(f, &truetype.Options{Size: size})
+		total := 0.0
+		for i, ch := range runes {
+			a, _ := face.GlyphAdvance(ch)
+			advances[i] = float64(a)/64 + spacing
+			total += advances[i]
+		}
+		if total/r < math.Pi*0.9 || size <= 5 {
+			break
+		}
+	}
+
+	total := 0.0
+	for _, a := range advances {
+		total += a
+	}
+
+	// Angles go anticlockwise from the right, so the top reads clockwise,
+	// and the bottom anticlockwise.
+	direction, angle, upright := -1.0, math.Pi/2+total/r/2, math.Pi/2
+	if !top {
+		direction, angle, upright = 1.0, 3*math.Pi/2-total/r/2, 3*math.Pi/2
+	}
+
+	side := face.Metrics().Height.Ceil() * 2
+	for i, ch := range runes {
+		mid := angle + direction*advances[i]/r/2
+		angle += direction * advances[i] / r
+
+		// The letter is drawn with the middle of its baseline in the middle
+		// of the image, which is turned and put on the circle.
+		glyph := image.NewAlpha(image.Rect(0, 0, side, side))
+		d := &font.Drawer{Dst: glyph, Src: image.Opaque, Face: face}
+		d.Dot = fixed.Point26_6{
+			X: fixed.I(side/2) - fixed.Int26_6((advances[i]-spacing)*32),
+			Y: fixed.I(side / 2),
+		}
+		d.DrawString(string(ch))
+
+		turn := (mid-upright)*180/math.Pi + rnd.Float64()*6 - 3
+		turned := imaging.Rotate(glyph, turn, color.Transparent)
+
+		radius := r + rnd.Float64() - 0.5
+		x := float64(c.X) + radius*math.Cos(mid)
+		y := float64(c.Y) - radius*math.Sin(mid)
+		b := turned.Bounds()
+		at := image.Pt(int(math.Round(x))-b.Dx()/2, int(math.Round(y))-b.Dy()/2)
+		draw.Draw(dst, b.Add(at), turned, b.Min, draw.Over)
+	}
+}
+
+// ring draws a circle of radius r around c, width wide.
+func ring(dst *image.Alpha, c image.Point, r, width float64) {
+	reach := int(r+width) + 1
+	b := image.Rect(c.X-reach, c.Y-reach, c.X+reach, c.Y+reach).Intersect(dst.Bounds())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			d := math.Abs(math.Hypot(float64(x-c.X)+0.5, float64(y-c.Y)+0.5) - r)
+			plot(dst, x, y, width/2-d+0.5)
+		}
+	}
+}
+
+// wave draws a cancellation line from x0 to x1, waving around y.
+func wave(dst *image.Alpha, x0, x1 int, y, phase float64) {
+	const amplitude, period, width = 3.5, 34.0, 2.0
+	for x := x0; x < x1; x++ {
+		middle := y + amplitude*math.Sin(2*math.Pi*float64(x)/period+phase)
+		for py := int(middle - width - 1); py <= int(middle+width+1); py++ {
+			d := math.Abs(float64(py) + 0.5 - middle)
+			plot(dst, x, py, width/2-d+0.5)
+		}
+	}
+}
+
+// plot inks a pixel of the mask by a, from 0 to 1, if it isn't inked more
+// already.
+func plot(dst *image.Alpha, x, y int, a float64) {
+	if a <= 0 || !image.Pt(x, y).In(dst.Bounds()) {
+		return
+	}
+	v := uint8(math.Min(a, 1) * 255)
+	if v > dst.AlphaAt(x, y).A {
+		dst.SetAlpha(x, y, color.Alpha{v})
+	}
+}
+
+// ink inks a mask in a colour the way a rubber stamp would: darker in some
+// places than others, and with specks that didn't take any ink.
+func ink(mask *image.Alpha, col color.NRGBA, rnd *rand.Rand) *image.NRGBA {
+	b := mask.Bounds()
+
+	// How much ink there is changes smoothly between the corners of a grid
+	// of cells.
+	const cell = 12
+	cols, rows := b.Dx()/cell+2, b.Dy()/cell+2
+	grid := make([]float64, cols*rows)
+	for i := range grid {
+		grid[i] = rnd.Float64()
+	}
+	at := func(x, y int) float64 { return grid[y*cols+x] }
+
+	out := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			a := mask.AlphaAt(x, y).A
+			if a == 0 {
+				continue
+			}
+
+			fx, fy := float64(x-b.Min.X)/cell, float64(y-b.Min.Y)/cell
+			gx, gy := int(fx), int(fy)
+			tx, ty := fx-float64(gx), fy-float64(gy)
+			n := (at(gx, gy)*(1-tx)+at(gx+1, gy)*tx)*(1-ty) +
+				(at(gx, gy+1)*(1-tx)+at(gx+1, gy+1)*tx)*ty
+
+			strength := 0.45 + 0.55*n
+			if rnd.Float64() < 0.05 {
+				strength *= 0.25
+			}
+			c := col
+			c.A = uint8(float64(a) * float64(col.A) / 255 * strength)
+			out.SetNRGBA(x, y, c)
+		}
+	}
+	return out
+}
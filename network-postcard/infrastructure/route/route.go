@@ -5,30 +5,20 @@
 package route
 
 import (
-	"bytes"
-	"encoding/base64"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
-	"image/png"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
-	"golang.org/x/image/font"
-	"golang.org/x/image/font/gofont/gobold"
-	"golang.org/x/image/font/gofont/gobolditalic"
-	"golang.org/x/image/font/gofont/gomonoitalic"
-	"golang.org/x/image/font/gofont/goregular"
-	"golang.org/x/image/math/fixed"
-
 	"github.com/disintegration/imaging"
-	"github.com/golang/freetype/truetype"
 	"github.com/tpryan/gcprelay/infrastructure/gcloud"
 )
 
@@ -38,11 +28,13 @@ var (
 	ErrNoMoreToStamp = fmt.Errorf("There are no more entries to stamp")
 	// ErrNoOpEntered is an error that means that an operation wasn't entered
 	ErrNoOpEntered = fmt.Errorf("no operation selected")
+	// ErrUnknownStrategy means a route was asked to be planned with a
+	// strategy that doesn't exist.
+	ErrUnknownStrategy = fmt.Errorf("unknown route strategy")
 	// ImagePath is the filesystem location where the images for stamping
 	// are located
 	ImagePath string
 	images    = make(map[string]image.Image)
-	self      string
 )
 
 func init() {
@@ -53,19 +45,26 @@ func init() {
 	if err := loadImages(ImagePath); err != nil {
 		log.Printf("could not get load images: %v", err)
 	}
-
-	var err error
-	self, err = gcloud.Metadata("name")
-	if err != nil {
-		log.Printf("could not get host name: %v", err)
+	if err := loadLayout(ImagePath); err != nil {
+		log.Printf("could not load layout: %v", err)
+	}
+	if err := loadFonts(ImagePath); err != nil {
+		log.Printf("could not load fonts: %v", err)
+	}
+	if err := loadTemplate(ImagePath); err != nil {
+		log.Printf("could not load template: %v", err)
 	}
 }
 
 // GetImage returns an image from the package pre loaded images. This allows
-// us to only call images from the filesystem on startup
+// us to only call images from the filesystem on startup. Zones that have no
+// stamp among them get one generated.
 func GetImage(name string) (image.Image, error) {
 	result, ok := images[name]
 	if !ok {
+		if Region(name) != name {
+			return generatedStamp(name, time.Now())
+		}
 		return nil, fmt.Errorf("image '%s' does not exist", name)
 	}
 
@@ -120,13 +119,43 @@ type Host struct {
 	Private  string `json:"private,omitempty"`
 }
 
+// NewHost returns the Host for the machine that the provider describes.
+func NewHost(p gcloud.Provider) (Host, error) {
+	var host Host
+	var err error
+
+	if host.Name, err = p.Metadata("name"); err != nil {
+		return host, err
+	}
+
+	if host.Endpoint, err = p.Metadata("external-ip"); err != nil {
+		return host, err
+	}
+
+	if host.Private, err = p.Metadata("private-ip"); err != nil {
+		return host, err
+	}
+
+	return host, nil
+}
+
 // Node is a stop along the route. It consists of a host and a time in and
 // time out.
 type Node struct {
 	Host Host      `json:"host,omitempty"`
 	In   time.Time `json:"in,omitempty"`
 	Out  time.Time `json:"out,omitempty"`
-	Slot int       `json:"slot,omitempty"`
+	// Slot is where the node's stamp goes among the stamps around the
+	// border of the postcard, counting clockwise from the top left.
+	Slot int `json:"slot,omitempty"`
+	// Via is the transport that brought the route to the node.
+	Via string `json:"via,omitempty"`
+	// Skipped is set when the node could not be reached, and the route went
+	// on without it.
+	Skipped bool `json:"skipped,omitempty"`
+	// Skew is how far the node's clock is ahead of the clock of the node
+	// that sent it the route, as far as the node could tell.
+	Skew time.Duration `json:"skew,omitempty"`
 }
 
 // Done answers if the node has had the route pass through it yet.
@@ -148,16 +177,73 @@ type Route struct {
 	AllNodes    []Node    `json:"allnodes,omitempty"`
 	AllHops     []Hop     `json:"allhops,omitempty"`
 	LastUpdate  time.Time `json:"lastupdate,omitempty"`
+	// Status is where the route is in its life, and Transitions are the
+	// changes it has gone through to get there.
+	Status      Status       `json:"status,omitempty"`
+	Transitions []Transition `json:"transitions,omitempty"`
+
+	canvas *canvas
 }
 
 // Next returns the next Node that to which we need to relay
 func (r *Route) Next() string {
+	if i := r.next(); i < len(r.Nodes) {
+		return r.Nodes[i].Host.Private
+	}
+	return ""
+}
+
+// next returns the index of the next node the route has to visit.
+func (r *Route) next() int {
+	for i, n := range r.Nodes {
+		if n.In.IsZero() && !n.Skipped {
+			return i
+		}
+	}
+	return len(r.Nodes)
+}
+
+// SetVia records the transport the route is being sent to the next node with.
+func (r *Route) SetVia(transport string) {
+	if i := r.next(); i < len(r.Nodes) {
+		r.Nodes[i].Via = transport
+	}
+}
+
+// Skip marks the next node as skipped, so that the route goes on to the node
+// after it, and returns the skipped node.
+func (r *Route) Skip() (Node, error) {
+	i := r.next()
+	if i == len(r.Nodes) {
+		return Node{}, ErrNoMoreToStamp
+	}
+	r.Nodes[i].Skipped = true
+	r.LastUpdate = time.Now()
+	return r.Nodes[i], nil
+}
+
+// Clone returns a copy of the route that can be changed without changing r.
+// The copy decodes its own postcard the first time it is drawn on.
+func (r *Route) Clone() *Route {
+	c := *r
+	c.Nodes = append([]Node(nil), r.Nodes...)
+	c.Hops = append([]Hop(nil), r.Hops...)
+	c.AllNodes = append([]Node(nil), r.AllNodes...)
+	c.AllHops = append([]Hop(nil), r.AllHops...)
+	c.Transitions = append([]Transition(nil), r.Transitions...)
+	c.canvas = nil
+	return &c
+}
+
+// Visited returns the nodes the route has actually passed through.
+func (r *Route) Visited() []Node {
+	var result []Node
 	for _, n := range r.Nodes {
-		if n.In.IsZero() {
-			return n.Host.Private
+		if !n.Skipped && !n.In.IsZero() {
+			result = append(result, n)
 		}
 	}
-	return ""
+	return result
 }
 
 // AddNode handles adding a Node to the route, and handles adding the Hop.
@@ -186,35 +272,73 @@ func (r *Route) CurrentNode(name string) int {
 
 // JustStarted answers true if the route hasn't been passed around yet.
 func (r *Route) JustStarted() bool {
-	return !r.Nodes[0].Done()
+	for _, n := range r.Nodes {
+		if n.Done() || n.Skipped {
+			return false
+		}
+	}
+	return true
 }
 
-// CalculateLastHop sets the duration of the last hop in the route.
-func (r *Route) CalculateLastHop() error {
-	r.Hops[r.LastHop()].CalculateDuration()
+// CalculateLastHop sets the duration of the last hop in the route. The
+// provider identifies the machine the hop ended on.
+func (r *Route) CalculateLastHop(p gcloud.Provider) error {
+	i, err := r.LastHop(p)
+	if err != nil {
+		return err
+	}
+	if i < len(r.Hops) {
+		r.Hops[i].CalculateDuration()
+	}
 	return nil
 }
 
-// LastHop returns the index of the last hop in the route.
-func (r *Route) LastHop() int {
+// LastHop returns the index of the last hop in the route, which is the hop
+// that ends at the machine the provider describes.
+func (r *Route) LastHop(p gcloud.Provider) (int, error) {
+	self, err := p.Metadata("name")
+	if err != nil {
+		return 0, fmt.Errorf("could not get host name: %v", err)
+	}
+
 	for i := 1; i < len(r.Hops); i++ {
 		if r.Hops[i].Destination.Host.Name == self {
-			return i
+			return i, nil
 		}
 	}
-	return 0
+	return 0, nil
 }
 
 // CalculateHops spins through the nodes, and calculates the duration of
-// all of the hops
+// all of the hops. A hop to a skipped node is kept, marked skipped, and the
+// hop after it is measured from the last node the route passed through.
 func (r *Route) CalculateHops() error {
 	r.Hops = []Hop{}
+	if len(r.Nodes) == 0 {
+		return nil
+	}
+	o := -1
+	if !r.Nodes[0].Skipped {
+		o = 0
+	}
 	for i := 1; i < len(r.Nodes); i++ {
 		d := r.Nodes[i]
-		o := r.Nodes[i-1]
-		if d.Done() && o.Done() {
-			r.Hops = append(r.Hops, NewHop(o, d))
+		switch {
+		case d.Skipped:
+			r.Hops = append(r.Hops, Hop{Origin: r.Nodes[i-1], Destination: d, Skipped: true})
+			continue
+		case !d.Done():
+			return nil
+		case o < 0:
+			// Nothing before this node was reached, so there is nothing to
+			// measure the hop from.
+			r.Hops = append(r.Hops, Hop{Origin: r.Nodes[i-1], Destination: d, Skipped: true})
+		case r.Nodes[o].Done():
+			r.Hops = append(r.Hops, NewHop(r.Nodes[o], d))
+		default:
+			return nil
 		}
+		o = i
 	}
 	return nil
 }
@@ -251,7 +375,7 @@ func (r *Route) Stamp(io string) error {
 
 	if io == "in" {
 		for i, n := range r.Nodes {
-			if n.In.IsZero() {
+			if n.In.IsZero() && !n.Skipped {
 				n.In = time.Now()
 				r.LastUpdate = time.Now()
 				r.Nodes[i] = n
@@ -261,7 +385,7 @@ func (r *Route) Stamp(io string) error {
 	}
 	if io == "out" {
 		for i, n := range r.Nodes {
-			if n.Out.IsZero() {
+			if n.Out.IsZero() && !n.Skipped {
 				n.Out = time.Now()
 
 				r.Nodes[i] = n
@@ -272,23 +396,38 @@ func (r *Route) Stamp(io string) error {
 	return ErrNoMoreToStamp
 }
 
-// Done reports true when all of the nodes in the route are marked done.
+// Done reports true when all of the nodes in the route are marked done or
+// skipped.
 func (r *Route) Done() bool {
 	for _, n := range r.Nodes {
-		if n.Out.IsZero() {
+		if n.Out.IsZero() && !n.Skipped {
 			return false
 		}
 	}
 	return true
 }
 
-// CalculateTotal generates a hop for the first to last node.
+// CalculateTotal generates a hop for the first to last node the route passed
+// through.
 func (r *Route) CalculateTotal() error {
+	visited := r.Visited()
+	if len(visited) == 0 {
+		return fmt.Errorf("route %s did not pass through any nodes", r.ID)
+	}
+
 	var h Hop
 
-	h.Origin = r.Nodes[0]
-	h.Destination = r.Nodes[len(r.Nodes)-1]
+	h.Origin = visited[0]
+	h.Destination = visited[len(visited)-1]
 	h.CalculateDuration()
+
+	// The total crosses the clock of every node on the way, not just the
+	// clock of the last one.
+	var skew time.Duration
+	for _, n := range visited[1:] {
+		skew += n.Skew
+	}
+	h.setDuration(h.RawDuration - skew)
 	r.Total = h
 
 	return nil
@@ -299,6 +438,9 @@ func (r *Route) CalculateTotal() error {
 func (r *Route) CalculateTransitTime() float64 {
 	result := float64(0)
 	for i, hop := range r.Hops {
+		if hop.Skipped {
+			continue
+		}
 		if hop.Seconds == 0 {
 			hop.CalculateDuration()
 		}
@@ -308,16 +450,6 @@ func (r *Route) CalculateTransitTime() float64 {
 	return result
 }
 
-func randomFloat(min, max float64) float64 {
-	rand.Seed(time.Now().UnixNano())
-	return rand.Float64()*(max-min) + min
-}
-
-func randomInt(min, max int) int {
-	rand.Seed(time.Now().UnixNano())
-	return rand.Intn(max-min) + min
-}
-
 // Shuffle creates a route that has a random set of routes.
 func (r *Route) Shuffle() error {
 	count := len(r.Nodes)
@@ -338,42 +470,46 @@ func (r *Route) Shuffle() error {
 	return nil
 }
 
-// Order sets up a particular order for the route.
-// australia-southeast1-a
-// asia-east1-a
-// asia-northeast1-a
-// us-west1-a
-// southamerica-east1-a
-// us-central1-f
-// us-east4-a
-// europe-west2-b
-// europe-west3-a
-func (r *Route) Order() error {
+// Order sets up the order for the route from the layout. Zones in the layout
+// come first in the configured order, followed by any other nodes in the
+// order they were added. Every zone in the layout must be in the route,
+// unless it is one of down, the zones whose node is known to be down. It is
+// an error for there to be no nodes at all.
+func (r *Route) Order(down ...string) error {
 	var nodes []Node
+	var missing []string
 
-	order := []string{
-		"asia-east1-a",
-		"asia-northeast1-a",
-		"australia-southeast1-a",
-		"us-west1-a",
-		"us-central1-f",
-		"us-east4-a",
-		"europe-west2-b",
-		"europe-west3-a",
-		"southamerica-east1-a",
-	}
-
-	randslots := rand.Perm(9)
-
-	for i, name := range order {
+	for _, name := range layout.Order {
 		n, err := r.getNodeByName(name)
 		if err != nil {
-			return err
+			if !contains(down, name) {
+				missing = append(missing, name)
+			}
+			continue
 		}
-		n.Slot = randslots[i]
 		nodes = append(nodes, *n)
 	}
 
+	if len(missing) > 0 {
+		return fmt.Errorf("zones in the layout are missing from the route: %s", strings.Join(missing, ", "))
+	}
+
+	for _, n := range r.Nodes {
+		if !layout.ordered(n.Host.Name) {
+			nodes = append(nodes, n)
+		}
+	}
+
+	if len(nodes) == 0 {
+		return fmt.Errorf("there are no nodes to route through")
+	}
+
+	// Every node gets its own place around the border of the postcard.
+	slots := rand.Perm(len(nodes))
+	for i := range nodes {
+		nodes[i].Slot = slots[i]
+	}
+
 	r.Nodes = nodes
 	err := r.UpdateHops()
 	if err != nil {
@@ -383,6 +519,16 @@ func (r *Route) Order() error {
 	return nil
 }
 
+// contains answers if name is one of names.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *Route) getNodeByName(name string) (*Node, error) {
 	for _, n := range r.Nodes {
 		if n.Host.Name == name {
@@ -393,185 +539,140 @@ func (r *Route) getNodeByName(name string) (*Node, error) {
 }
 
 // StampImage takes the relayed postcard and adds a stamp image that
-// corresponds with current host
+// corresponds with current host, where the stamps of the route are placed.
 func (r *Route) StampImage(name string) error {
 
-	img := base64.NewDecoder(base64.StdEncoding, strings.NewReader(r.Postcard))
+	i := r.CurrentNode(name)
+	if i == len(r.Nodes) {
+		return fmt.Errorf("node %s is not on the route", name)
+	}
 
 	stamp, err := GetImage(name)
 	if err != nil {
 		return fmt.Errorf("could not get stamp: %v", err)
 	}
 
-	// stamp = resize.Resize(75, 0, stamp, resize.Lanczos3)
-
-	rand.Seed(time.Now().UTC().UnixNano())
-	rot := randomFloat(-45, 45)
-	stamp = imaging.Rotate(stamp, rot, color.RGBA{.0, .0, .0, .0})
-
-	postcard, _, err := image.Decode(img)
+	rgba, err := r.Image()
 	if err != nil {
-		return fmt.Errorf("could not decode image %v", err)
+		return err
 	}
 
-	zed := image.Point{0, 0}
-	rec := image.Rectangle{zed, zed.Add(postcard.Bounds().Size())}
+	size := rgba.Bounds().Size()
+	p, err := r.placement(name, Size{Width: size.X, Height: size.Y})
+	if err != nil {
+		return fmt.Errorf("could not place stamp: %v", err)
+	}
+	if b := stamp.Bounds(); b.Dx() != p.Width || b.Dy() != p.Height {
+		stamp = imaging.Resize(stamp, p.Width, p.Height, imaging.Lanczos)
+	}
+	stamp = imaging.Rotate(stamp, p.Angle, color.Transparent)
 
-	rgba := image.NewRGBA(rec)
-	slot := r.Nodes[r.CurrentNode(name)].Slot
+	b := p.Bounds()
+	draw.Draw(rgba, b, stamp, image.Point{}, draw.Over)
 
-	ranX, ranY := getImagePlacement(slot)
+	// The postmark is dated when the postcard came in, and cancels the
+	// stamp across its bottom left.
+	in := r.Nodes[i].In
+	if in.IsZero() {
+		in = time.Now()
+	}
+	mark, err := Postmark(name, in, rand.New(rand.NewSource(in.UnixNano())))
+	if err != nil {
+		return fmt.Errorf("could not draw postmark: %v", err)
+	}
+	center := image.Pt(b.Min.X+b.Dx()/3, b.Min.Y+b.Dy()*2/3)
+	at := center.Sub(image.Pt(postmarkRadius+6, postmarkHeight/2))
+	draw.Draw(rgba, mark.Bounds().Add(at), mark, image.Point{}, draw.Over)
+	r.touch()
 
-	draw.Draw(rgba, postcard.Bounds(), postcard, zed, draw.Over)
-	draw.Draw(rgba, rec, stamp, image.Point{-ranX, -ranY}, draw.Over)
+	return nil
+}
 
-	if err := r.SetPostcard(rgba); err != nil {
-		return fmt.Errorf("could not get set the postcard")
+// placement returns where the stamp of a node goes on a postcard. The
+// stamps of every node on the route are placed together, in the order of
+// their slots, so that none of them overlap, and every node places them the
+// same way.
+func (r *Route) placement(name string, card Size) (Placement, error) {
+	order := make([]int, len(r.Nodes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return r.Nodes[order[a]].Slot < r.Nodes[order[b]].Slot
+	})
+
+	stamps := make([]Size, len(order))
+	mine := 0
+	for i, n := range order {
+		node := r.Nodes[n]
+		stamps[i] = stampSize(node.Host.Name)
+		if node.Host.Name == name {
+			mine = i
+		}
 	}
 
-	return nil
+	placements, err := Place(placementSeed(r.ID), card, stamps)
+	if err != nil {
+		return Placement{}, err
+	}
+	return placements[mine], nil
 }
 
 // MatteImage places the image matte over the transmitted image.
 func (r *Route) MatteImage() error {
 
-	img := base64.NewDecoder(base64.StdEncoding, strings.NewReader(r.Postcard))
-
 	matte, err := GetImage("matte")
 	if err != nil {
 		return fmt.Errorf("could not get matte: %v", err)
 	}
 
-	postcard, _, err := image.Decode(img)
+	rgba, err := r.Image()
 	if err != nil {
-		return fmt.Errorf("could not decode image %v", err)
+		return err
 	}
 
-	zed := image.Point{0, 0}
-	rec := image.Rectangle{zed, zed.Add(postcard.Bounds().Size())}
-	rgba := image.NewRGBA(rec)
-
-	draw.Draw(rgba, postcard.Bounds(), postcard, zed, draw.Over)
-	draw.Draw(rgba, rec, matte, image.Point{0, 0}, draw.Over)
-
-	if err := r.SetPostcard(rgba); err != nil {
-		return fmt.Errorf("could not get set the postcard")
-	}
+	draw.Draw(rgba, rgba.Bounds(), matte, image.Point{0, 0}, draw.Over)
+	r.touch()
 
 	return nil
 }
 
-// LastStamp should fire on the last hop that a route take, and adds total time
-// to the picture.
+// LastStamp should fire on the last hop that a route take, and draws the
+// template on the picture, with the total time.
 func (r *Route) LastStamp() error {
 
-	img := base64.NewDecoder(base64.StdEncoding, strings.NewReader(r.Postcard))
-
-	postcard, _, err := image.Decode(img)
+	card, err := r.Card()
 	if err != nil {
-		return fmt.Errorf("could not decode image %v", err)
-	}
-
-	zed := image.Point{0, 0}
-	rec := image.Rectangle{zed, zed.Add(postcard.Bounds().Size())}
-
-	rgba := image.NewRGBA(rec)
-
-	draw.Draw(rgba, postcard.Bounds(), postcard, zed, draw.Over)
-
-	num := len(r.Nodes) - 1
-	total := fmt.Sprintf("transfered in %f seconds ", r.CalculateTransitTime())
-	addLabel(rgba, 55, 700, 10, r.Nodes[0].Host.Name, "gobold")
-	addLabel(rgba, 100, 700, 10, " - ", "gobold")
-	addLabel(rgba, 150, 700, 10, r.Nodes[num].Host.Name, "gobold")
-	addLabel(rgba, 300, 700, 10, total, "gobold")
-
-	if err := r.SetPostcard(rgba); err != nil {
-		return fmt.Errorf("could not get set the postcard")
+		return err
 	}
 
-	return nil
-}
-
-type boundary struct {
-	Label string
-	XMin  int
-	XMax  int
-	YMin  int
-	YMax  int
-}
-
-func getImagePlacement(slot int) (int, int) {
-	areas := map[int]boundary{
-		0: {"topgutter1", 50, 150, -20, 20},
-		1: {"topgutter2", 150, 300, -20, 20},
-		2: {"topgutter3", 300, 380, -20, 20},
-
-		3: {"leftgutter1", 0, 20, 50, 150},
-		4: {"leftgutter2", 0, 20, 150, 180},
-		5: {"leftgutter3", 0, 20, 300, 340},
-
-		6: {"rightgutter1", 300, 360, 50, 150},
-		7: {"rightgutter2", 300, 360, 150, 180},
-		8: {"rightgutter3", 300, 360, 300, 340},
+	rgba, err := r.Image()
+	if err != nil {
+		return err
 	}
-	area, _ := areas[slot]
-
-	return randomInt(area.XMin, area.XMax), randomInt(area.YMin, area.YMax)
-
-}
-
-// SetPostcard sets the image in both encoded and binary version. For GRPC.
-func (r *Route) SetPostcard(img image.Image) error {
 
-	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
-
-	buf := new(bytes.Buffer)
-
-	if err := encoder.Encode(buf, img); err != nil {
-		return fmt.Errorf("could not encode image: %v", err)
+	if err := stampTemplate.Draw(rgba, card); err != nil {
+		return fmt.Errorf("could not draw template: %v", err)
 	}
-	r.Postcard = base64.StdEncoding.EncodeToString(buf.Bytes())
+	r.touch()
 
 	return nil
 }
 
-func addLabel(img *image.RGBA, x, y int, fontsize float64, label, family string) {
-	col := color.RGBA{0, 0, 0, 200}
-	point := fixed.Point26_6{X: fixed.Int26_6(x * 64), Y: fixed.Int26_6(y * 64)}
-
-	f := gomonoitalic.TTF
-
-	switch family {
-	case "goregular":
-		f = goregular.TTF
-	case "gobold":
-		f = gobold.TTF
-	case "gobolditalic":
-		f = gobolditalic.TTF
-	default:
-		f = gomonoitalic.TTF
-	}
-
-	gofont, _ := truetype.Parse(f)
-	goface := truetype.NewFace(gofont, &truetype.Options{Size: fontsize})
-
-	d := &font.Drawer{
-		Dst:  img,
-		Src:  image.NewUniform(col),
-		Face: goface,
-		Dot:  point,
-	}
-	d.DrawString(label)
-}
-
 // Hop represents a path on the route form origin node to destination node.
+// Duration, Nanoseconds and Seconds are corrected for the skew between the
+// clocks of the two nodes. RawDuration and RawSeconds are what the clocks
+// said.
 type Hop struct {
 	Origin      Node          `json:"origin,omitempty"`
 	Destination Node          `json:"destination,omitempty"`
 	Duration    time.Duration `json:"duration,omitempty"`
 	Nanoseconds int64         `json:"nanoseconds,omitempty"`
 	Seconds     float64       `json:"seconds,omitempty"`
+	RawDuration time.Duration `json:"rawduration,omitempty"`
+	RawSeconds  float64       `json:"rawseconds,omitempty"`
+	// Skipped is set when the destination could not be reached.
+	Skipped bool `json:"skipped,omitempty"`
 }
 
 // NewHop returns a new hop for which we have done the math.
@@ -583,8 +684,14 @@ func NewHop(o, d Node) Hop {
 
 // CalculateDuration does the math for a hop.
 func (h *Hop) CalculateDuration() error {
-	h.Duration = h.Destination.In.Sub(h.Origin.Out)
-	h.Seconds = h.Duration.Seconds()
-	h.Nanoseconds = h.Duration.Nanoseconds()
+	h.RawDuration = h.Destination.In.Sub(h.Origin.Out)
+	h.RawSeconds = h.RawDuration.Seconds()
+	h.setDuration(h.RawDuration - h.Destination.Skew)
 	return nil
 }
+
+func (h *Hop) setDuration(d time.Duration) {
+	h.Duration = d
+	h.Seconds = d.Seconds()
+	h.Nanoseconds = d.Nanoseconds()
+}
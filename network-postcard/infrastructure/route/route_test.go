@@ -1,46 +1,253 @@
 package route
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
 	"image/png"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/golang/freetype/truetype"
+	"github.com/tpryan/gcprelay/infrastructure/gcloud"
+	"golang.org/x/image/font"
 )
 
-func TestRandomInt(t *testing.T) {
-	trials := 1000
+func TestPlace(t *testing.T) {
+	card := Size{Width: 1000, Height: 667}
 
-	for i := 0; i < trials; i++ {
-		cases := []struct {
-			min int
-			max int
-		}{
-			{100, 800},
+	for n := 1; n <= 30; n++ {
+		stamps := make([]Size, n)
+		for i := range stamps {
+			stamps[i] = Size{Width: StampSize, Height: StampSize}
 		}
+		// Stamps don't all have to be square.
+		stamps[0] = Size{Width: 260, Height: 150}
+
+		for seed := int64(0); seed < 5; seed++ {
+			placements, err := Place(seed, card, stamps)
+			if err != nil {
+				t.Fatalf("%d stamps, seed %d: %v", n, seed, err)
+			}
+			if len(placements) != n {
+				t.Fatalf("%d stamps: got %d placements", n, len(placements))
+			}
 
-		for _, c := range cases {
-			got := randomInt(c.min, c.max)
-			if got > c.max {
-				t.Fatalf("randomInt(%d,%d) got %d, want less than %d", c.min, c.max, got, c.max)
+			bounds := image.Rect(0, 0, card.Width, card.Height)
+			for i, p := range placements {
+				b := p.Bounds()
+				if !b.In(bounds) {
+					t.Errorf("%d stamps, seed %d: stamp %d at %v is off the postcard", n, seed, i, b)
+				}
+				if p.Angle < -MaxTilt || p.Angle > MaxTilt {
+					t.Errorf("%d stamps, seed %d: stamp %d is turned %v", n, seed, i, p.Angle)
+				}
+				// Stamps are only ever made smaller, and all by as much.
+				scale := float64(p.Width) / float64(stamps[i].Width)
+				first := float64(placements[0].Width) / float64(stamps[0].Width)
+				if scale > 1 || math.Abs(scale-first) > 0.02 {
+					t.Errorf("%d stamps, seed %d: stamp %d is scaled %v, the first %v", n, seed, i, scale, first)
+				}
+				for k := i + 1; k < n; k++ {
+					if b.Overlaps(placements[k].Bounds()) {
+						t.Errorf("%d stamps, seed %d: stamp %d at %v overlaps stamp %d at %v", n, seed, i, b, k, placements[k].Bounds())
+					}
+				}
 			}
-			if got < c.min {
-				t.Fatalf("randomInt(%d,%d) got %d, want more than %d", c.min, c.max, got, c.min)
+
+			again, _ := Place(seed, card, stamps)
+			for i := range again {
+				if again[i] != placements[i] {
+					t.Errorf("%d stamps, seed %d: stamp %d got %+v, then %+v", n, seed, i, placements[i], again[i])
+				}
 			}
 		}
 	}
 
+	// A few stamps fit at their own size.
+	if p, _ := Place(1, card, []Size{{StampSize, StampSize}, {StampSize, StampSize}}); p[1].Width != StampSize {
+		t.Errorf("stamp was scaled to %dx%d when there was room", p[1].Width, p[1].Height)
+	}
+	one, _ := Place(1, card, make([]Size, 3))
+	two, _ := Place(2, card, make([]Size, 3))
+	if one[0] == two[0] {
+		t.Errorf("stamps are placed the same for every seed")
+	}
+
+	// Placing the stamps of a route doesn't draw the generated ones.
+	generatedMu.Lock()
+	generated = make(map[string]generatedEntry)
+	generatedMu.Unlock()
+	r := &Route{ID: "placed"}
+	r.AddNode(Node{Host: Host{Name: "moon-base1-a"}})
+	r.AddNode(Node{Host: Host{Name: "moon-base2-a"}})
+	if _, err := r.placement("moon-base1-a", card); err != nil {
+		t.Fatalf("could not place stamps: %v", err)
+	}
+	if len(generated) != 0 {
+		t.Errorf("placing stamps drew %d of them", len(generated))
+	}
+
+	// Stamps that don't fit however small they are aren't piled up.
+	if p, err := Place(1, Size{Width: 20, Height: 20}, make([]Size, 30)); err == nil {
+		t.Errorf("30 stamps on a tiny postcard got %+v, want an error", p)
+	}
+
+	// The bounds are what turning the stamp really takes up.
+	stamp := image.NewRGBA(image.Rect(0, 0, 173, 91))
+	for _, angle := range []float64{-30, -12.5, 0, 7.3, 29.9} {
+		p := Placement{Width: 173, Height: 91, Angle: angle}
+		if got, want := p.Bounds().Size(), imaging.Rotate(stamp, angle, color.Transparent).Bounds().Size(); got != want {
+			t.Errorf("turned %v got bounds of %v, want %v", angle, got, want)
+		}
+	}
+}
+
+func TestShare(t *testing.T) {
+	cases := []struct {
+		n       int
+		lengths []int
+		want    []int
+	}{
+		{1, []int{900, 300, 900, 300}, []int{1, 0, 0, 0}},
+		{4, []int{900, 300, 900, 300}, []int{2, 1, 1, 0}},
+		{8, []int{900, 300, 900, 300}, []int{3, 1, 3, 1}},
+		{5, []int{900, 0, 900, 0}, []int{3, 0, 2, 0}},
+	}
+	for _, c := range cases {
+		got := share(c.n, c.lengths)
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("share(%d, %v) got %v, want %v", c.n, c.lengths, got, c.want)
+		}
+	}
+}
+
+func TestOrder(t *testing.T) {
+	defer SetLayout(CurrentLayout())
+
+	if err := SetLayout(Layout{
+		Order: []string{"us-west1-a", "asia-east1-a"},
+	}); err != nil {
+		t.Fatalf("could not set layout: %v", err)
+	}
+
+	r := &Route{ID: NewID(32)}
+	r.AddNode(Node{Host: Host{Name: "asia-east1-a"}})
+	r.AddNode(Node{Host: Host{Name: "europe-west4-a"}})
+	r.AddNode(Node{Host: Host{Name: "us-west1-a"}})
+	r.AddNode(Node{Host: Host{Name: "me-west1-a"}})
+
+	if err := r.Order(); err != nil {
+		t.Fatalf("could not order route: %v", err)
+	}
+
+	want := []string{"us-west1-a", "asia-east1-a", "europe-west4-a", "me-west1-a"}
+	slots := make(map[int]bool)
+	for i, name := range want {
+		if r.Nodes[i].Host.Name != name {
+			t.Errorf("node %d got %s, want %s", i, r.Nodes[i].Host.Name, name)
+		}
+		if s := r.Nodes[i].Slot; s < 0 || s >= len(want) || slots[s] {
+			t.Errorf("node %d got slot %d, want its own slot of %d", i, s, len(want))
+		}
+		slots[r.Nodes[i].Slot] = true
+	}
+	if len(r.Hops) != len(want)-1 {
+		t.Errorf("wrong number of hops, expected %d got %d", len(want)-1, len(r.Hops))
+	}
+
+	missing := &Route{ID: NewID(32)}
+	missing.AddNode(Node{Host: Host{Name: "me-west1-a"}})
+	missing.AddNode(Node{Host: Host{Name: "asia-east1-a"}})
+	err := missing.Order()
+	if err == nil || !strings.Contains(err.Error(), "us-west1-a") {
+		t.Errorf("Order() with a missing zone got %v, want error naming us-west1-a", err)
+	}
+
+	// A zone whose node is known to be down is left out, rather than
+	// holding up the rest.
+	if err := missing.Order("us-west1-a"); err != nil {
+		t.Fatalf("Order() with a zone that is down got %v", err)
+	}
+	if len(missing.Nodes) != 2 || missing.Nodes[0].Host.Name != "asia-east1-a" || len(missing.Hops) != 1 {
+		t.Errorf("Order() with a zone that is down got nodes %+v", missing.Nodes)
+	}
+}
+
+func TestLoadLayout(t *testing.T) {
+	l, err := LoadLayout(ImagePath + "/" + LayoutFile)
+	if err != nil {
+		t.Fatalf("could not load layout: %v", err)
+	}
+
+	if len(l.Order) == 0 {
+		t.Errorf("layout has no zones")
+	}
+
+	bad := []Layout{
+		{Order: []string{"a", "a"}},
+		{TimeZones: map[string]string{"a": "Nowhere/Special"}},
+	}
+	for i, l := range bad {
+		if err := l.Validate(); err == nil {
+			t.Errorf("layout %d should not be valid", i)
+		}
+	}
+
+	// Stamp slots from older layouts aren't used any more, so a layout
+	// that still has them is turned away rather than half read.
+	old := filepath.Join(t.TempDir(), LayoutFile)
+	if err := ioutil.WriteFile(old, []byte(`{"order": ["a"], "slots": [{"label": "top", "xmax": 10, "ymax": 10}]}`), 0644); err != nil {
+		t.Fatalf("could not write layout: %v", err)
+	}
+	if _, err := LoadLayout(old); err == nil || !strings.Contains(err.Error(), "slots") {
+		t.Errorf("layout with slots got %v, want an error naming them", err)
+	}
 }
 
-func TestRandomSlot(t *testing.T) {
-	for i := 0; i <= 8; i++ {
-		getImagePlacement(i)
+func TestLastHop(t *testing.T) {
+	route, err := dummyRoute()
+	if err != nil {
+		t.Errorf("could not get dummy route: %v", err)
+	}
+	route.CalculateHops()
+
+	cases := []struct {
+		name string
+		want int
+	}{
+		{"asia-east1-a", 1},
+		{"us-east4-a", 6},
+		{"australia-southeast1-a", 0},
+	}
+
+	for _, c := range cases {
+		got, err := route.LastHop(gcloud.Static{"name": c.name})
+		if err != nil {
+			t.Errorf("LastHop(%s) got error: %v", c.name, err)
+		}
+		if got != c.want {
+			t.Errorf("LastHop(%s) got %d, want %d", c.name, got, c.want)
+		}
 	}
 
+	if _, err := route.LastHop(gcloud.Static{}); err == nil {
+		t.Errorf("LastHop without a name should have failed")
+	}
 }
 
 func TestHops(t *testing.T) {
@@ -166,6 +373,9 @@ func TestImageStamp(t *testing.T) {
 		t.Errorf("could not stamp image: %v", err)
 	}
 	route.Stamp("out")
+	if err := route.EncodePostcard(); err != nil {
+		t.Errorf("could not encode postcard: %v", err)
+	}
 	img := base64.NewDecoder(base64.StdEncoding, strings.NewReader(route.Postcard))
 
 	stamp, format, err := image.Decode(img)
@@ -203,6 +413,50 @@ func TestCalculateHops(t *testing.T) {
 
 }
 
+func TestSkew(t *testing.T) {
+	route, err := dummyRoute()
+	if err != nil {
+		t.Errorf("could not get dummy route: %v", err)
+	}
+
+	// The clock of the second node is behind, so the hop to it looks
+	// instant, and the third node's clock makes its hop look negative.
+	route.Nodes[1].Skew = -300 * time.Millisecond
+	route.Nodes[2].In = route.Nodes[1].Out.Add(-100 * time.Millisecond)
+	route.Nodes[2].Skew = -200 * time.Millisecond
+
+	if err := route.CalculateHops(); err != nil {
+		t.Errorf("could not calculate hops: %v", err)
+	}
+
+	cases := []struct {
+		hop  int
+		raw  float64
+		want float64
+	}{
+		{0, 0, 0.3},
+		{1, -0.1, 0.1},
+		{2, 0, 0},
+	}
+	for _, c := range cases {
+		h := route.Hops[c.hop]
+		if h.RawSeconds != c.raw || h.Seconds != c.want {
+			t.Errorf("hop %d got raw %f corrected %f, wanted raw %f corrected %f", c.hop, h.RawSeconds, h.Seconds, c.raw, c.want)
+		}
+	}
+
+	if got := route.CalculateTransitTime(); got < 0.4-1e-9 || got > 0.4+1e-9 {
+		t.Errorf("transit time got %f, wanted 0.4", got)
+	}
+
+	if err := route.CalculateTotal(); err != nil {
+		t.Errorf("could not calculate total: %v", err)
+	}
+	if route.Total.RawSeconds != 6 || route.Total.Seconds != 6.5 {
+		t.Errorf("total got raw %f corrected %f, wanted raw 6 corrected 6.5", route.Total.RawSeconds, route.Total.Seconds)
+	}
+}
+
 func TestCalculateTotal(t *testing.T) {
 	route, err := dummyRoute()
 	if err != nil {
@@ -219,6 +473,69 @@ func TestCalculateTotal(t *testing.T) {
 
 }
 
+func TestSkip(t *testing.T) {
+	route, err := dummyRoute()
+	if err != nil {
+		t.Errorf("could not get dummy route: %v", err)
+	}
+
+	// The route has reached the third node, and the fourth can't be reached.
+	for i := 3; i < len(route.Nodes); i++ {
+		route.Nodes[i].In = time.Time{}
+		route.Nodes[i].Out = time.Time{}
+	}
+
+	skipped, err := route.Skip()
+	if err != nil {
+		t.Fatalf("could not skip node: %v", err)
+	}
+	if skipped.Host.Name != "asia-northeast1-a" {
+		t.Errorf("skipped %s, wanted asia-northeast1-a", skipped.Host.Name)
+	}
+	if got := route.Next(); got != route.Nodes[4].Host.Private {
+		t.Errorf("next is %s after skip, wanted %s", got, route.Nodes[4].Host.Private)
+	}
+
+	// The rest of the route is passed through except for the last node.
+	for i := 4; i < len(route.Nodes)-1; i++ {
+		route.Nodes[i].In = time.Date(2017, 12, 17, 1, 0, i+1, 0, time.UTC)
+		route.Nodes[i].Out = time.Date(2017, 12, 17, 1, 0, i+2, 0, time.UTC)
+	}
+	if route.Done() {
+		t.Errorf("route is done before the last node was passed through")
+	}
+	if _, err := route.Skip(); err != nil {
+		t.Fatalf("could not skip last node: %v", err)
+	}
+	if !route.Done() {
+		t.Errorf("route is not done after the last node was skipped")
+	}
+
+	if err := route.CalculateHops(); err != nil {
+		t.Errorf("could not calculate hops: %v", err)
+	}
+	if len(route.Hops) != len(route.Nodes)-1 {
+		t.Fatalf("got %d hops, wanted %d", len(route.Hops), len(route.Nodes)-1)
+	}
+	if !route.Hops[2].Skipped || !route.Hops[6].Skipped {
+		t.Errorf("hops to skipped nodes are not marked skipped: %+v", route.Hops)
+	}
+	if hop := route.Hops[3]; hop.Origin.Host.Name != "asia-east1-a" || hop.Seconds != 1 {
+		t.Errorf("hop after skip got %s -> %s %f, wanted asia-east1-a -> europe-west2-b 1", hop.Origin.Host.Name, hop.Destination.Host.Name, hop.Seconds)
+	}
+
+	if err := route.CalculateTotal(); err != nil {
+		t.Errorf("could not calculate total: %v", err)
+	}
+	if route.Total.Destination.Host.Name != "us-west1-a" || route.Total.Seconds != 5 {
+		t.Errorf("total got %s %f, wanted us-west1-a 5", route.Total.Destination.Host.Name, route.Total.Seconds)
+	}
+
+	if _, err := route.Skip(); err != ErrNoMoreToStamp {
+		t.Errorf("skip on finished route got %v, wanted %v", err, ErrNoMoreToStamp)
+	}
+}
+
 func TestJustStartedl(t *testing.T) {
 	route, err := dummyRoute()
 	if err != nil {
@@ -288,6 +605,362 @@ func TestStatusFunctions(t *testing.T) {
 	}
 }
 
+func TestSetStatus(t *testing.T) {
+	cases := []struct {
+		label string
+		steps []Status
+		ok    bool
+	}{
+		{"started", []Status{StatusPending, StatusInFlight}, true},
+		{"completed", []Status{StatusPending, StatusInFlight, StatusCompleted}, true},
+		{"cancelled before sending", []Status{StatusPending, StatusCancelled}, true},
+		{"old route timed out", []Status{StatusTimedOut}, true},
+		{"back to pending", []Status{StatusPending, StatusInFlight, StatusPending}, false},
+		{"completed after timing out", []Status{StatusInFlight, StatusTimedOut, StatusCompleted}, false},
+		{"cancelled twice", []Status{StatusCancelled, StatusCancelled}, false},
+	}
+
+	for _, c := range cases {
+		r := &Route{ID: "dummy"}
+		var err error
+		for _, s := range c.steps {
+			if err = r.SetStatus(s, "test"); err != nil {
+				break
+			}
+		}
+
+		if c.ok != (err == nil) {
+			t.Errorf("%s: got error %v", c.label, err)
+			continue
+		}
+		if !c.ok {
+			if !errors.Is(err, ErrBadTransition) {
+				t.Errorf("%s: got %v, want %v", c.label, err, ErrBadTransition)
+			}
+			continue
+		}
+
+		if r.Status != c.steps[len(c.steps)-1] || len(r.Transitions) != len(c.steps) {
+			t.Errorf("%s: got status %s after %d transitions", c.label, r.Status, len(r.Transitions))
+		}
+		if r.Progressed().IsZero() {
+			t.Errorf("%s: transitions are not progress", c.label)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	bad := []struct {
+		label string
+		t     Template
+	}{
+		{"font", Template{Blocks: []TextBlock{{Text: "x", Style: Style{Font: "comicsans"}}}}},
+		{"colour", Template{Blocks: []TextBlock{{Text: "x", Style: Style{Color: "black"}}}}},
+		{"alignment", Template{Blocks: []TextBlock{{Text: "x", Align: "justify"}}}},
+		{"text", Template{Blocks: []TextBlock{{Text: "{{.Origin"}}}},
+		{"itinerary width", Template{Itinerary: &Itinerary{}}},
+	}
+	for _, c := range bad {
+		if err := c.t.Validate(); err == nil {
+			t.Errorf("template with a bad %s is valid", c.label)
+		}
+	}
+	if err := DefaultTemplate().Validate(); err != nil {
+		t.Errorf("default template is invalid: %v", err)
+	}
+
+	a, err := parsedFont("gomono")
+	if err != nil {
+		t.Fatalf("could not parse font: %v", err)
+	}
+	if b, _ := parsedFont("gomono"); a != b {
+		t.Errorf("font was parsed again")
+	}
+
+	// A template drawn at twice its size, with a right aligned block.
+	tmpl := Template{
+		Width: 200,
+		Blocks: []TextBlock{
+			{Style: Style{Font: "gomono", Size: 8, Color: "#ff0000"}, Text: "{{.Origin}}", X: 10, Y: 20, Width: 100, Align: "right"},
+		},
+		Itinerary: &Itinerary{Style: Style{Font: "gomono", Size: 5, Color: "#0000ff"}, X: 10, Y: 60, Width: 100},
+	}
+	if err := tmpl.Validate(); err != nil {
+		t.Fatalf("template is invalid: %v", err)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	card := Card{Origin: "asia-east1-a", Hops: []Hop{{Origin: Node{Host: Host{Name: "asia-east1-a"}}, Destination: Node{Host: Host{Name: "us-west1-a"}}, Seconds: 0.1234}}}
+	if err := tmpl.Draw(img, card); err != nil {
+		t.Fatalf("could not draw template: %v", err)
+	}
+
+	red, blue := inked(img, func(c color.RGBA) bool { return c.R > 0 }), inked(img, func(c color.RGBA) bool { return c.B > 0 })
+	if red.Empty() || red.Max.X > 220 || red.Max.X < 200 || red.Max.Y > 45 {
+		t.Errorf("right aligned block is at %v, want it ending near x 220 above y 45", red)
+	}
+	if blue.Empty() || blue.Min.X < 20 || blue.Max.X > 220 || blue.Min.Y < 100 {
+		t.Errorf("itinerary is at %v, want it between x 20 and 220 below y 100", blue)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	f, err := parsedFont("gomono")
+	if err != nil {
+		t.Fatalf("could not parse font: %v", err)
+	}
+	d := &font.Drawer{Face: truetype.NewFace(f, &truetype.Options{Size: 10})}
+
+	got := wrap(d, "one two three four\nfive", d.MeasureString("one two").Ceil())
+	want := []string{"one two", "three", "four", "five"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestItineraryRows(t *testing.T) {
+	var hops []Hop
+	for _, name := range []string{"b", "c", "d", "e"} {
+		hops = append(hops, Hop{Origin: Node{Host: Host{Name: "a"}}, Destination: Node{Host: Host{Name: name}}, Seconds: 0.5})
+	}
+	hops[1].Skipped = true
+
+	rows := ItineraryRows(hops, 0)
+	if len(rows) != 4 || rows[0] != [2]string{"a - b", "0.500s"} || rows[1][1] != "skipped" {
+		t.Errorf("got rows %q", rows)
+	}
+
+	rows = ItineraryRows(hops, 3)
+	if len(rows) != 3 || rows[2][0] != "+ 2 more" {
+		t.Errorf("got limited rows %q", rows)
+	}
+}
+
+// inked returns the bounds of the pixels that match.
+func inked(img *image.RGBA, match func(color.RGBA) bool) image.Rectangle {
+	var r image.Rectangle
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if match(img.RGBAAt(x, y)) {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
+
+func TestAnimation(t *testing.T) {
+	r := &Route{ID: "animated"}
+	r.AddNode(Node{Host: Host{Name: "asia-east1-a"}})
+	r.AddNode(Node{Host: Host{Name: "us-west1-a"}})
+	r.Hops = []Hop{{Seconds: 0.25}}
+
+	var frames []Frame
+	for i, c := range []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}} {
+		img := image.NewRGBA(image.Rect(0, 0, 300, 200))
+		draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+		if err := r.SetPostcard(img); err != nil {
+			t.Fatalf("could not set postcard: %v", err)
+		}
+		name := ""
+		if i > 0 {
+			name = r.Nodes[i-1].Host.Name
+		}
+		frames = append(frames, r.Frame(name))
+	}
+	if frames[2].Index != 2 || frames[2].Seconds != 0.25 || frames[1].Seconds != 0 {
+		t.Errorf("got frames %+v", frames)
+	}
+
+	// Frames are only made smaller, whether or not they were taken from a
+	// route that had the postcard decoded.
+	for _, f := range []Frame{frames[0], {Postcard: frames[0].Postcard}} {
+		for width, want := range map[int]image.Point{150: {150, 100}, AnimationWidth: {300, 200}} {
+			small, err := f.Shrink(width)
+			if err != nil {
+				t.Fatalf("could not shrink frame: %v", err)
+			}
+			img, _, err := image.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(small.Postcard)))
+			if err != nil {
+				t.Fatalf("could not decode shrunk frame: %v", err)
+			}
+			if got := img.Bounds().Size(); got != want {
+				t.Errorf("Shrink(%d) got size %v, want %v", width, got, want)
+			}
+		}
+	}
+
+	anim, err := NewAnimation(frames)
+	if err != nil {
+		t.Fatalf("could not decode frames: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := anim.EncodeGIF(&buf); err != nil {
+		t.Fatalf("could not encode gif: %v", err)
+	}
+	g, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatalf("could not decode gif: %v", err)
+	}
+	if len(g.Image) != 3 || g.Delay[2] != int(FinalDelay/(10*time.Millisecond)) {
+		t.Errorf("got %d frames with delays %v", len(g.Image), g.Delay)
+	}
+	if b := g.Image[0].Bounds(); b.Dx() != AnimationWidth || b.Dy() != AnimationWidth*2/3 {
+		t.Errorf("got gif size %v", b)
+	}
+
+	// The index quantize picks is the web safe colour it means.
+	for _, c := range []color.RGBA{{0, 0, 0, 255}, {255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 255}, {102, 153, 204, 255}} {
+		img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+		draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+		if got := quantize(img).At(2, 2); got != color.Color(color.RGBA{c.R, c.G, c.B, 255}) {
+			t.Errorf("quantized %v to %v", c, got)
+		}
+	}
+
+	buf.Reset()
+	if err := anim.EncodeAPNG(&buf); err != nil {
+		t.Fatalf("could not encode apng: %v", err)
+	}
+	// Viewers that don't know about animation show the first frame.
+	first, err := png.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("could not decode apng: %v", err)
+	}
+	if r, g, b, _ := first.At(0, 0).RGBA(); r>>8 < 200 || g>>8 > 50 || b>>8 > 50 {
+		t.Errorf("first frame is not red: %d %d %d", r>>8, g>>8, b>>8)
+	}
+
+	chunks, err := readChunks(buf.Bytes())
+	if err != nil {
+		t.Fatalf("could not read apng: %v", err)
+	}
+	if n := binary.BigEndian.Uint32(chunks["acTL"][0]); n != 3 {
+		t.Errorf("acTL says %d frames, want 3", n)
+	}
+	if len(chunks["fcTL"]) != 3 || len(chunks["fdAT"]) < 2 {
+		t.Errorf("got %d fcTL and %d fdAT chunks", len(chunks["fcTL"]), len(chunks["fdAT"]))
+	}
+
+	// Every fcTL and fdAT chunk is numbered in order.
+	var seqs []uint32
+	rest := buf.Bytes()[len(pngSignature):]
+	for len(rest) > 0 {
+		n := binary.BigEndian.Uint32(rest)
+		if kind := string(rest[4:8]); kind == "fcTL" || kind == "fdAT" {
+			seqs = append(seqs, binary.BigEndian.Uint32(rest[8:]))
+		}
+		rest = rest[12+n:]
+	}
+	for i, seq := range seqs {
+		if seq != uint32(i) {
+			t.Errorf("chunk %d has sequence number %d", i, seq)
+		}
+	}
+
+	if _, err := NewAnimation(nil); err == nil {
+		t.Errorf("animating no frames got no error")
+	}
+}
+
+func TestEncodePostcard(t *testing.T) {
+	route, err := dummyRoute()
+	if err != nil {
+		t.Errorf("could not get dummy route: %v", err)
+	}
+	original := route.Postcard
+
+	if err := route.StampImage("australia-southeast1-a"); err != nil {
+		t.Errorf("could not stamp image: %v", err)
+	}
+	if route.Postcard != original {
+		t.Errorf("postcard was encoded before EncodePostcard was called")
+	}
+
+	if err := route.EncodePostcard(); err != nil {
+		t.Errorf("could not encode postcard: %v", err)
+	}
+	if route.Postcard == original {
+		t.Errorf("stamp was not written back to the postcard")
+	}
+
+	// Replacing the postcard throws away the decoded one, and it is only
+	// decoded once after that.
+	stamped := route.canvas.img
+	route.Postcard = original
+	first, err := route.Image()
+	if err != nil {
+		t.Errorf("could not decode postcard: %v", err)
+	}
+	second, err := route.Image()
+	if err != nil {
+		t.Errorf("could not decode postcard: %v", err)
+	}
+	if first == stamped {
+		t.Errorf("replaced postcard was not decoded")
+	}
+	if first != second {
+		t.Errorf("postcard was decoded again when it had not changed")
+	}
+
+	// SetPostcard must not draw on the preloaded images.
+	blank, err := GetImage("postcard")
+	if err != nil {
+		t.Fatalf("could not get postcard: %v", err)
+	}
+	before := blank.At(200, 20)
+	if err := route.SetPostcard(blank); err != nil {
+		t.Errorf("could not set postcard: %v", err)
+	}
+	for i := range route.Nodes {
+		route.Nodes[i].Slot = 1
+	}
+	if err := route.StampImage("australia-southeast1-a"); err != nil {
+		t.Errorf("could not stamp image: %v", err)
+	}
+	if blank.At(200, 20) != before {
+		t.Errorf("stamping the postcard changed the preloaded image")
+	}
+}
+
+// benchmarkHop sends a route through a node. When encodeEach is true the
+// postcard is encoded and decoded around every operation, the way it was
+// before the decoded postcard was kept on the route.
+func benchmarkHop(b *testing.B, last, encodeEach bool) {
+	route, err := dummyRoute()
+	if err != nil {
+		b.Errorf("could not get dummy route: %v", err)
+	}
+	wire := route.Postcard
+
+	step := func(f func() error) {
+		if err := f(); err != nil {
+			b.Errorf("could not work on postcard: %v", err)
+		}
+		if encodeEach {
+			route.EncodePostcard()
+			route.canvas = nil
+		}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		route.Postcard = wire
+		step(func() error { return route.StampImage("australia-southeast1-a") })
+		if last {
+			step(route.LastStamp)
+		}
+		route.EncodePostcard()
+	}
+}
+
+func BenchmarkHop(b *testing.B)               { benchmarkHop(b, false, false) }
+func BenchmarkHopEncodeEach(b *testing.B)     { benchmarkHop(b, false, true) }
+func BenchmarkLastHop(b *testing.B)           { benchmarkHop(b, true, false) }
+func BenchmarkLastHopEncodeEach(b *testing.B) { benchmarkHop(b, true, true) }
+
 func BenchmarkImageStamp(b *testing.B) {
 	route, err := dummyRoute()
 	if err != nil {
@@ -326,3 +999,222 @@ func dummyRoute() (*Route, error) {
 
 	return r, nil
 }
+
+func TestPlan(t *testing.T) {
+	names := []string{
+		"us-west1-a",
+		"asia-east1-a",
+		"us-east4-a",
+		"europe-west2-b",
+		"us-central1-f",
+		"asia-northeast1-a",
+		"europe-west3-a",
+	}
+
+	newRoute := func() *Route {
+		r := &Route{ID: NewID(32)}
+		for _, name := range names {
+			r.AddNode(Node{Host: Host{Name: name}})
+		}
+		return r
+	}
+
+	distance := func(r *Route) float64 {
+		return tourCost(r.Nodes, distanceCost)
+	}
+
+	original := distance(newRoute())
+
+	nearest := newRoute()
+	if err := nearest.Plan("nearest", nil); err != nil {
+		t.Fatalf("could not plan nearest route: %v", err)
+	}
+
+	longest := newRoute()
+	if err := longest.Plan("longest", nil); err != nil {
+		t.Fatalf("could not plan longest route: %v", err)
+	}
+
+	if distance(nearest) > original {
+		t.Errorf("nearest route is %f km, longer than unplanned %f km", distance(nearest), original)
+	}
+	if distance(longest) < original {
+		t.Errorf("longest route is %f km, shorter than unplanned %f km", distance(longest), original)
+	}
+
+	for _, r := range []*Route{nearest, longest} {
+		if r.Nodes[0].Host.Name != names[0] {
+			t.Errorf("first node moved, got %s, want %s", r.Nodes[0].Host.Name, names[0])
+		}
+		if len(r.Nodes) != len(names) || len(r.Hops) != len(names)-1 {
+			t.Errorf("planned route has %d nodes and %d hops", len(r.Nodes), len(r.Hops))
+		}
+	}
+
+	// us-west1 to asia-east1 is measured as the quickest way out of the
+	// first node, even though it is far away.
+	hops := []Hop{
+		{Origin: Node{Host: Host{Name: "us-west1-a"}}, Destination: Node{Host: Host{Name: "asia-east1-a"}}, Seconds: 0.001},
+		{Origin: Node{Host: Host{Name: "us-west1-a"}}, Destination: Node{Host: Host{Name: "asia-east1-a"}}, Seconds: 0.003},
+	}
+	latencies := MeanLatencies(hops)
+	if latencies["us-west1-a"]["asia-east1-a"] != 0.002 {
+		t.Errorf("mean latency got %f, want 0.002", latencies["us-west1-a"]["asia-east1-a"])
+	}
+
+	fastest := newRoute()
+	if err := fastest.Plan("fastest", latencies); err != nil {
+		t.Fatalf("could not plan fastest route: %v", err)
+	}
+	if fastest.Nodes[1].Host.Name != "asia-east1-a" {
+		t.Errorf("fastest route went to %s second, want asia-east1-a", fastest.Nodes[1].Host.Name)
+	}
+
+	if err := newRoute().Plan("scenic", nil); err == nil {
+		t.Errorf("unknown strategy should have failed")
+	}
+}
+
+func TestDistance(t *testing.T) {
+	london, _ := Locate("europe-west2-b")
+	frankfurt, _ := Locate("europe-west3-a")
+
+	got := Distance(london, frankfurt)
+	if got < 600 || got > 700 {
+		t.Errorf("London to Frankfurt got %f km, want about 640", got)
+	}
+
+	if _, ok := Locate("mars-north1-a"); ok {
+		t.Errorf("mars-north1-a should not be on the map")
+	}
+}
+
+func TestGenerateStamp(t *testing.T) {
+	date := time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)
+	tokyo, err := GenerateStamp("asia-northeast1-b", date)
+	if err != nil {
+		t.Fatalf("could not generate stamp: %v", err)
+	}
+	if got := tokyo.Bounds().Size(); got != image.Pt(StampSize, StampSize) {
+		t.Errorf("got stamp of %v, want %dx%d", got, StampSize, StampSize)
+	}
+
+	// The edges are perforated, and the middle is solid.
+	for _, p := range []image.Point{{0, 0}, {4, 100}, {100, 196}} {
+		if _, _, _, a := tokyo.At(p.X, p.Y).RGBA(); a != 0 {
+			t.Errorf("stamp isn't see through at %v", p)
+		}
+	}
+	if _, _, _, a := tokyo.At(10, 100).RGBA(); a != 0xffff {
+		t.Errorf("stamp is see through between the holes")
+	}
+	city := tokyo.SubImage(image.Rect(30, 60, 170, 120)).(*image.RGBA)
+	if inked(city, func(c color.RGBA) bool { return c == color.RGBA{0xbc, 0x00, 0x2d, 0xff} }).Empty() {
+		t.Errorf("city isn't drawn in the colours of Japan")
+	}
+
+	// Another country has other colours, and a zone that isn't known at all
+	// still gets a stamp.
+	sydney, _ := GenerateStamp("australia-southeast1-a", date)
+	unknown, err := GenerateStamp("moon-base1-a", date)
+	if err != nil {
+		t.Fatalf("could not generate stamp for unknown zone: %v", err)
+	}
+	if tokyo.At(100, 100) == sydney.At(100, 100) || sydney.At(100, 100) == unknown.At(100, 100) {
+		t.Errorf("stamps of different countries have the same colours")
+	}
+
+	// The same zone on the same day is the same stamp.
+	again, _ := GenerateStamp("asia-northeast1-b", date)
+	if !bytes.Equal(tokyo.Pix, again.Pix) {
+		t.Errorf("stamp isn't the same when drawn again")
+	}
+	tomorrow, _ := GenerateStamp("asia-northeast1-b", date.AddDate(0, 0, 1))
+	if bytes.Equal(tokyo.Pix, tomorrow.Pix) {
+		t.Errorf("stamp doesn't have the date on it")
+	}
+
+	if _, err := GetImage("moon-base1-a"); err != nil {
+		t.Errorf("zone without a stamp got no stamp: %v", err)
+	}
+	if _, err := GetImage("missing"); err == nil {
+		t.Errorf("image that isn't a zone got no error")
+	}
+
+	for name, p := range regions {
+		if p.City == "" {
+			t.Errorf("%s has no city", name)
+		}
+		if _, ok := palettes[p.Country]; !ok {
+			t.Errorf("%s is in %q, which has no colours", name, p.Country)
+		}
+	}
+}
+
+func TestPostmark(t *testing.T) {
+	at := time.Date(2026, 10, 18, 0, 30, 0, 0, time.UTC)
+	cases := []struct {
+		zone string
+		want [4]string
+	}{
+		{"asia-northeast1-b", [4]string{"ASIA-NORTHEAST1-B", "TOKYO", "18 OCT 2026", "09:30 JST"}},
+		{"southamerica-east1-a", [4]string{"SOUTHAMERICA-EAST1-A", "SAO PAULO", "17 OCT 2026", "21:30 -03"}},
+		{"moon-base1-a", [4]string{"MOON-BASE1-A", "", "18 OCT 2026", "00:30 UTC"}},
+	}
+	for _, c := range cases {
+		top, bottom, date, clock := postmarkText(c.zone, at)
+		if got := [4]string{top, bottom, date, clock}; got != c.want {
+			t.Errorf("%s: got %q, want %q", c.zone, got, c.want)
+		}
+	}
+
+	old := CurrentLayout()
+	defer SetLayout(old)
+	l := CurrentLayout()
+	l.TimeZones = map[string]string{"moon-base1": "Pacific/Auckland"}
+	if err := SetLayout(l); err != nil {
+		t.Fatalf("could not set layout: %v", err)
+	}
+	if got := TimeZone("moon-base1-a").String(); got != "Pacific/Auckland" {
+		t.Errorf("layout time zone got %s, want Pacific/Auckland", got)
+	}
+	l.TimeZones = map[string]string{"moon-base1": "Moon/Tranquility"}
+	if err := SetLayout(l); err == nil {
+		t.Errorf("unknown time zone got no error")
+	}
+
+	for name, p := range regions {
+		if _, err := time.LoadLocation(p.TimeZone); err != nil || p.TimeZone == "" {
+			t.Errorf("%s has no time zone: %v", name, err)
+		}
+	}
+
+	mark, err := Postmark("asia-northeast1-b", at, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("could not draw postmark: %v", err)
+	}
+	if _, _, _, a := mark.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("postmark isn't see through outside of the rings")
+	}
+	// The top of the outside ring, and a cancellation line.
+	for _, p := range []image.Point{{postmarkRadius + 6, 6}, {postmarkWidth - 40, postmarkHeight / 2}} {
+		inked := false
+		for y := p.Y - 4; y <= p.Y+4; y++ {
+			if _, _, _, a := mark.At(p.X, y).RGBA(); a > 0 {
+				inked = true
+			}
+		}
+		if !inked {
+			t.Errorf("postmark has no ink near %v", p)
+		}
+	}
+
+	again, _ := Postmark("asia-northeast1-b", at, rand.New(rand.NewSource(1)))
+	if !bytes.Equal(mark.Pix, again.Pix) {
+		t.Errorf("postmark isn't the same for the same seed")
+	}
+	other, _ := Postmark("asia-northeast1-b", at, rand.New(rand.NewSource(2)))
+	if bytes.Equal(mark.Pix, other.Pix) {
+		t.Errorf("postmark is inked the same for every seed")
+	}
+}
@@ -0,0 +1,231 @@
+package route
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/font"
+)
+
+// StampSize is how wide and high stamps are, drawn or generated.
+const StampSize = 200
+
+// stampPalette are the colours of a generated stamp, taken from the flag of
+// the country it is from. Panel is the middle of the stamp, Ink the text
+// on it, and Accent the band across the top and the frame.
+type stampPalette struct {
+	Panel  string
+	Ink    string
+	Accent string
+}
+
+const stampPaper = "#fbf8ef"
+
+var (
+	defaultPalette = stampPalette{"#4285f4", "#ffffff", "#34a853"}
+	palettes       = map[string]stampPalette{
+		"Australia":      {"#00008b", "#ffffff", "#e4002b"},
+		"Belgium":        {"#fdda24", "#000000", "#ef3340"},
+		"Brazil":         {"#009c3b", "#ffdf00", "#002776"},
+		"Canada":         {"#ffffff", "#d80621", "#d80621"},
+		"Chile":          {"#0039a6", "#ffffff", "#d52b1e"},
+		"Finland":        {"#ffffff", "#002f6c", "#002f6c"},
+		"Germany":        {"#000000", "#ffce00", "#dd0000"},
+		"Hong Kong":      {"#de2910", "#ffffff", "#ffffff"},
+		"India":          {"#ffffff", "#000080", "#ff9933"},
+		"Indonesia":      {"#ffffff", "#ce1126", "#ce1126"},
+		"Israel":         {"#ffffff", "#0038b8", "#0038b8"},
+		"Japan":          {"#ffffff", "#bc002d", "#bc002d"},
+		"Netherlands":    {"#21468b", "#ffffff", "#ae1c28"},
+		"Poland":         {"#ffffff", "#dc143c", "#dc143c"},
+		"Singapore":      {"#ef3340", "#ffffff", "#ffffff"},
+		"South Korea":    {"#ffffff", "#000000", "#cd2e3a"},
+		"Switzerland":    {"#da291c", "#ffffff", "#ffffff"},
+		"Taiwan":         {"#000095", "#ffffff", "#fe0000"},
+		"United Kingdom": {"#012169", "#ffffff", "#c8102e"},
+		"United States":  {"#3c3b6e", "#ffffff", "#b22234"},
+	}
+
+	generatedMu sync.Mutex
+	// generated are the stamps that have been drawn, by zone. Each one is
+	// only kept for the day it is dated.
+	generated = make(map[string]generatedEntry)
+)
+
+type generatedEntry struct {
+	day   string
+	stamp image.Image
+}
+
+// generatedStamp returns the stamp of a zone for a day, drawing it the
+// first time it is asked for that day.
+func generatedStamp(zone string, date time.Time) (image.Image, error) {
+	day := date.Format("2006-01-02")
+
+	generatedMu.Lock()
+	defer generatedMu.Unlock()
+
+	if e, ok := generated[zone]; ok && e.day == day {
+		return e.stamp, nil
+	}
+	stamp, err := GenerateStamp(zone, date)
+	if err != nil {
+		return nil, err
+	}
+	generated[zone] = generatedEntry{day: day, stamp: stamp}
+	return stamp, nil
+}
+
+// stampSize is the size of the stamp of a node, without drawing it if it is
+// generated, since those are all StampSize.
+func stampSize(name string) Size {
+	if img, ok := images[name]; ok {
+		return Size{Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}
+	}
+	return Size{Width: StampSize, Height: StampSize}
+}
+
+// GenerateStamp draws a stamp for a zone that has no artwork: a perforated
+// stamp in the colours of the country the zone is in, with the city, the
+// zone and the date. Zones outside the regions that are known get the city
+// and country left off, and plain colours.
+func GenerateStamp(zone string, date time.Time) (*image.RGBA, error) {
+	p, ok := regions[Region(zone)]
+	if !ok {
+		p.City = Region(zone)
+	}
+	pal, ok := palettes[p.Country]
+	if !ok {
+		pal = defaultPalette
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, StampSize, StampSize))
+	paper := image.Rect(4, 4, StampSize-4, StampSize-4)
+	panel := paper.Inset(10)
+	band := image.Rect(panel.Min.X, panel.Min.Y, panel.Max.X, panel.Min.Y+26)
+
+	fill(img, paper, stampPaper)
+	perforate(img, paper, 12, 4)
+	fill(img, panel, pal.Accent)
+	fill(img, panel.Inset(3), pal.Panel)
+	fill(img, band, pal.Accent)
+
+	bandInk := stampPaper
+	if c, _ := parseColor(pal.Accent); luminance(c) > 0.6 {
+		bandInk = pal.Panel
+	}
+
+	width := panel.Dx() - 20
+	x := panel.Min.X + 10
+	blocks := []struct {
+		style    Style
+		text     string
+		maxLines int
+		middle   int
+	}{
+		{Style{"gobold", 13, bandInk}, strings.ToUpper(p.Country), 1, band.Min.Y + band.Dy()/2},
+		{Style{"gobold", 30, pal.Ink}, p.City, 2, 86},
+		{Style{"gomono", 11, pal.Ink}, zone, 1, 139},
+		{Style{"gomonobold", 12, pal.Ink}, strings.ToUpper(date.Format("2 Jan 2006")), 1, 168},
+	}
+	for _, b := range blocks {
+		if b.text == "" {
+			continue
+		}
+		d, lines, err := fitText(img, b.style, b.text, width, b.maxLines)
+		if err != nil {
+			return nil, fmt.Errorf("could not draw stamp: %v", err)
+		}
+
+		// The lines are centered on the middle of the block, with the
+		// ascent of the font standing in for the height of a line.
+		size := d.Face.Metrics().Ascent.Ceil()
+		leading := size * 5 / 4
+		y := b.middle - (leading*(len(lines)-1)+size)/2 + size
+		for _, line := range lines {
+			drawString(d, line, align(d, line, x, width, "center"), y)
+			y += leading
+		}
+	}
+
+	rule := image.Rect(panel.Min.X+20, 152, panel.Max.X-20, 153)
+	fill(img, rule, pal.Ink)
+
+	return img, nil
+}
+
+// fitText breaks text into no more than maxLines lines that fit in width,
+// making the style smaller until they do. It gives up at 6 points.
+func fitText(img draw.Image, s Style, text string, width, maxLines int) (*font.Drawer, []string, error) {
+	for ; ; s.Size-- {
+		d, err := s.drawer(img, 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		lines := wrap(d, text, width)
+		fits := len(lines) <= maxLines
+		for _, line := range lines {
+			if d.MeasureString(line).Ceil() > width {
+				fits = false
+			}
+		}
+		if fits || s.Size <= 6 {
+			return d, lines, nil
+		}
+	}
+}
+
+// perforate punches holes of radius every step along the edges of a
+// rectangle, like the perforations a stamp is torn along.
+func perforate(img *image.RGBA, r image.Rectangle, step, radius int) {
+	var centers []image.Point
+	for x := r.Min.X; x <= r.Max.X; x += step {
+		centers = append(centers, image.Pt(x, r.Min.Y), image.Pt(x, r.Max.Y))
+	}
+	for y := r.Min.Y + step; y < r.Max.Y; y += step {
+		centers = append(centers, image.Pt(r.Min.X, y), image.Pt(r.Max.X, y))
+	}
+
+	for _, c := range centers {
+		hole := &circle{c, radius}
+		draw.DrawMask(img, hole.Bounds(), image.Transparent, image.Point{}, hole, hole.Bounds().Min, draw.Src)
+	}
+}
+
+// fill fills a rectangle with a #rrggbb colour.
+func fill(img *image.RGBA, r image.Rectangle, hex string) {
+	c, _ := parseColor(hex)
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// luminance is how light a colour looks, from 0 to 1.
+func luminance(c color.RGBA) float64 {
+	return (0.2126*float64(c.R) + 0.7152*float64(c.G) + 0.0722*float64(c.B)) / 255
+}
+
+// circle is a mask of a filled circle.
+type circle struct {
+	p image.Point
+	r int
+}
+
+func (c *circle) ColorModel() color.Model {
+	return color.AlphaModel
+}
+
+func (c *circle) Bounds() image.Rectangle {
+	return image.Rect(c.p.X-c.r, c.p.Y-c.r, c.p.X+c.r+1, c.p.Y+c.r+1)
+}
+
+func (c *circle) At(x, y int) color.Color {
+	dx, dy := x-c.p.X, y-c.p.Y
+	if dx*dx+dy*dy <= c.r*c.r {
+		return color.Alpha{255}
+	}
+	return color.Alpha{0}
+}
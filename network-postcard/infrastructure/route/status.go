@@ -0,0 +1,78 @@
+package route
+
+import (
+	"fmt"
+	"time"
+)
+
+// Status is where a route is in its life.
+type Status string
+
+const (
+	// StatusPending is a route that has been set up, but not sent yet.
+	StatusPending Status = "pending"
+	// StatusInFlight is a route that is on its way around the nodes.
+	StatusInFlight Status = "in_flight"
+	// StatusCompleted is a route that every node it could reach has stamped.
+	StatusCompleted Status = "completed"
+	// StatusFailed is a route that couldn't be finished.
+	StatusFailed Status = "failed"
+	// StatusTimedOut is a route that made no progress for too long.
+	StatusTimedOut Status = "timed_out"
+	// StatusCancelled is a route that was stopped on purpose.
+	StatusCancelled Status = "cancelled"
+)
+
+// ErrBadTransition means a route can't go from its status to the one asked
+// for, most often because it is already over.
+var ErrBadTransition = fmt.Errorf("route can not change to that status")
+
+// transitions are the statuses a route can go to from each status. Routes
+// recorded before statuses existed have none, and are treated as pending.
+var transitions = map[Status][]Status{
+	"":             {StatusPending, StatusInFlight, StatusCompleted, StatusFailed, StatusTimedOut, StatusCancelled},
+	StatusPending:  {StatusInFlight, StatusCompleted, StatusFailed, StatusTimedOut, StatusCancelled},
+	StatusInFlight: {StatusCompleted, StatusFailed, StatusTimedOut, StatusCancelled},
+}
+
+// Final answers if a route with the status is over.
+func (s Status) Final() bool {
+	switch s {
+	case StatusCompleted, StatusFailed, StatusTimedOut, StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// Transition is a change in the status of a route.
+type Transition struct {
+	Status Status    `json:"status"`
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// SetStatus moves the route to a new status, and records when and why. It
+// returns ErrBadTransition if the route can't go to the status from the one
+// it is in.
+func (r *Route) SetStatus(s Status, reason string) error {
+	for _, to := range transitions[r.Status] {
+		if to == s {
+			r.Status = s
+			r.Transitions = append(r.Transitions, Transition{Status: s, At: time.Now(), Reason: reason})
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s to %s", ErrBadTransition, r.Status, s)
+}
+
+// Progressed returns the last time the route made progress: a node took it,
+// or its status changed.
+func (r *Route) Progressed() time.Time {
+	last := r.LastUpdate
+	for _, t := range r.Transitions {
+		if t.At.After(last) {
+			last = t.At
+		}
+	}
+	return last
+}
@@ -0,0 +1,488 @@
+package route
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/gomonoitalic"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+)
+
+// TemplateFile is the name of the file, next to the stamps in ImagePath,
+// that describes the text drawn on a finished postcard.
+const TemplateFile = "template.json"
+
+var stampTemplate = DefaultTemplate()
+
+// Style is how text is drawn. Font is one of the Go fonts (goregular,
+// gobold, goitalic, gobolditalic, gomono, gomonobold, gomonoitalic) or the
+// name of a .ttf file in ImagePath without its extension. Color is #rrggbb
+// or #rrggbbaa.
+type Style struct {
+	Font  string  `json:"font,omitempty"`
+	Size  float64 `json:"size,omitempty"`
+	Color string  `json:"color,omitempty"`
+}
+
+// TextBlock is text drawn with its first baseline at X, Y. Text is a Go
+// template of a Card. Text wider than Width, if it is set, is wrapped. Align
+// is left, center or right, within Width if it is set, or of X if it isn't.
+// LineHeight is the distance between wrapped lines, as a multiple of Size.
+type TextBlock struct {
+	Style
+	Text       string  `json:"text"`
+	X          int     `json:"x"`
+	Y          int     `json:"y"`
+	Width      int     `json:"width,omitempty"`
+	Align      string  `json:"align,omitempty"`
+	LineHeight float64 `json:"lineheight,omitempty"`
+}
+
+// Itinerary is a table of every hop the route made, and how long it took,
+// with its first baseline at X, Y. The durations are right aligned at
+// X + Width. MaxRows limits the rows, with the last one saying how many
+// hops were left out.
+type Itinerary struct {
+	Style
+	X         int `json:"x"`
+	Y         int `json:"y"`
+	Width     int `json:"width"`
+	RowHeight int `json:"rowheight,omitempty"`
+	MaxRows   int `json:"maxrows,omitempty"`
+}
+
+// Template describes the text drawn on a finished postcard. Width and Height
+// are optional. When they are set, the positions and sizes in the template
+// are taken to be for a postcard of that size, and are scaled to the size of
+// the postcard being drawn on. With only one of them set, both directions
+// are scaled by the same amount.
+type Template struct {
+	Width     int         `json:"width,omitempty"`
+	Height    int         `json:"height,omitempty"`
+	Blocks    []TextBlock `json:"blocks"`
+	Itinerary *Itinerary  `json:"itinerary,omitempty"`
+}
+
+// Card is what the text of a template can refer to.
+type Card struct {
+	ID          string
+	Origin      string
+	Destination string
+	// Seconds is the time the route spent on the wire.
+	Seconds float64
+	// Stops is how many nodes the route passed through.
+	Stops int
+	Hops  []Hop
+}
+
+// Card returns what the text of a template can refer to for the route.
+func (r *Route) Card() (Card, error) {
+	visited := r.Visited()
+	if len(visited) == 0 {
+		return Card{}, fmt.Errorf("route %s did not pass through any nodes", r.ID)
+	}
+
+	return Card{
+		ID:          r.ID,
+		Origin:      visited[0].Host.Name,
+		Destination: visited[len(visited)-1].Host.Name,
+		Seconds:     r.CalculateTransitTime(),
+		Stops:       len(visited),
+		Hops:        r.Hops,
+	}, nil
+}
+
+// DefaultTemplate is the template used when there is no template file.
+func DefaultTemplate() Template {
+	style := Style{Font: "gobold", Size: 10, Color: "#000000c8"}
+	return Template{
+		Blocks: []TextBlock{
+			{Style: style, Text: "{{.Origin}}", X: 55, Y: 700},
+			{Style: style, Text: " - ", X: 100, Y: 700},
+			{Style: style, Text: "{{.Destination}}", X: 150, Y: 700},
+			{Style: style, Text: `transfered in {{printf "%f" .Seconds}} seconds `, X: 300, Y: 700},
+		},
+	}
+}
+
+// CurrentTemplate returns the template that finished postcards are drawn
+// with.
+func CurrentTemplate() Template {
+	return stampTemplate
+}
+
+// SetTemplate replaces the template that finished postcards are drawn with.
+// It is not safe to call while routes are being stamped.
+func SetTemplate(t Template) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	stampTemplate = t
+	return nil
+}
+
+// LoadTemplate reads a template from a json file.
+func LoadTemplate(path string) (Template, error) {
+	var t Template
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return t, fmt.Errorf("could not read template '%s': %v", path, err)
+	}
+
+	if err := json.Unmarshal(b, &t); err != nil {
+		return t, fmt.Errorf("could not decode template '%s': %v", path, err)
+	}
+
+	if err := t.Validate(); err != nil {
+		return t, fmt.Errorf("invalid template '%s': %v", path, err)
+	}
+
+	return t, nil
+}
+
+// loadTemplate sets the template from the template file in imagePath, and
+// keeps the default template if there isn't one.
+func loadTemplate(imagePath string) error {
+	path := filepath.Join(imagePath, TemplateFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	t, err := LoadTemplate(path)
+	if err != nil {
+		return err
+	}
+	stampTemplate = t
+	return nil
+}
+
+// Validate reports the first problem with the template.
+func (t Template) Validate() error {
+	if t.Width < 0 || t.Height < 0 {
+		return fmt.Errorf("postcard size can not be negative, got %dx%d", t.Width, t.Height)
+	}
+
+	for i, b := range t.Blocks {
+		if _, err := template.New("block").Parse(b.Text); err != nil {
+			return fmt.Errorf("block %d: %v", i, err)
+		}
+		if err := b.Style.validate(); err != nil {
+			return fmt.Errorf("block %d: %v", i, err)
+		}
+		switch b.Align {
+		case "", "left", "center", "right":
+		default:
+			return fmt.Errorf("block %d: unknown alignment '%s'", i, b.Align)
+		}
+		if b.Width < 0 || b.LineHeight < 0 {
+			return fmt.Errorf("block %d: width and line height can not be negative", i)
+		}
+	}
+
+	if it := t.Itinerary; it != nil {
+		if err := it.Style.validate(); err != nil {
+			return fmt.Errorf("itinerary: %v", err)
+		}
+		if it.Width <= 0 {
+			return fmt.Errorf("itinerary needs a width")
+		}
+		if it.RowHeight < 0 || it.MaxRows < 0 {
+			return fmt.Errorf("itinerary row height and rows can not be negative")
+		}
+	}
+
+	return nil
+}
+
+func (s Style) validate() error {
+	if s.Size < 0 {
+		return fmt.Errorf("font size can not be negative")
+	}
+	if _, err := parsedFont(s.font()); err != nil {
+		return err
+	}
+	if _, err := parseColor(s.color()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s Style) font() string {
+	if s.Font == "" {
+		return "gobold"
+	}
+	return s.Font
+}
+
+func (s Style) size() float64 {
+	if s.Size == 0 {
+		return 10
+	}
+	return s.Size
+}
+
+func (s Style) color() string {
+	if s.Color == "" {
+		return "#000000c8"
+	}
+	return s.Color
+}
+
+// parseColor reads a #rrggbb or #rrggbbaa colour.
+func parseColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 || !strings.HasPrefix(s, "#") {
+		return color.RGBA{}, fmt.Errorf("colour '%s' is not #rrggbb or #rrggbbaa", s)
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("colour '%s' is not #rrggbb or #rrggbbaa", s)
+	}
+	return color.RGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
+
+// Draw draws the text of the template for a card on a postcard.
+func (t Template) Draw(img *image.RGBA, c Card) error {
+	size := img.Bounds().Size()
+	sx, sy := 1.0, 1.0
+	if t.Width > 0 {
+		sx = float64(size.X) / float64(t.Width)
+	}
+	if t.Height > 0 {
+		sy = float64(size.Y) / float64(t.Height)
+	}
+	// With only one side given, the other scales the same.
+	if t.Width > 0 && t.Height <= 0 {
+		sy = sx
+	} else if t.Height > 0 && t.Width <= 0 {
+		sx = sy
+	}
+
+	for i, b := range t.Blocks {
+		tmpl, err := template.New("block").Parse(b.Text)
+		if err != nil {
+			return fmt.Errorf("block %d: %v", i, err)
+		}
+		var text bytes.Buffer
+		if err := tmpl.Execute(&text, c); err != nil {
+			return fmt.Errorf("block %d: %v", i, err)
+		}
+
+		d, err := b.Style.drawer(img, sy)
+		if err != nil {
+			return fmt.Errorf("block %d: %v", i, err)
+		}
+
+		width := int(float64(b.Width) * sx)
+		lineHeight := b.LineHeight
+		if lineHeight == 0 {
+			lineHeight = 1.2
+		}
+		x, y := int(float64(b.X)*sx), float64(b.Y)*sy
+		for _, line := range wrap(d, text.String(), width) {
+			drawString(d, line, align(d, line, x, width, b.Align), int(y))
+			y += lineHeight * b.Style.size() * sy
+		}
+	}
+
+	if t.Itinerary != nil {
+		return t.Itinerary.draw(img, c, sx, sy)
+	}
+	return nil
+}
+
+func (it Itinerary) draw(img *image.RGBA, c Card, sx, sy float64) error {
+	d, err := it.Style.drawer(img, sy)
+	if err != nil {
+		return fmt.Errorf("itinerary: %v", err)
+	}
+
+	rowHeight := float64(it.RowHeight) * sy
+	if it.RowHeight == 0 {
+		rowHeight = 1.5 * it.Style.size() * sy
+	}
+	x, width, y := int(float64(it.X)*sx), int(float64(it.Width)*sx), float64(it.Y)*sy
+
+	rows := ItineraryRows(c.Hops, it.MaxRows)
+	for _, row := range rows {
+		drawString(d, row[0], x, int(y))
+		drawString(d, row[1], align(d, row[1], x, width, "right"), int(y))
+		y += rowHeight
+	}
+	return nil
+}
+
+// ItineraryRows returns the route and duration columns of every hop, with
+// the hops past maxRows folded into the last row. A maxRows of 0 is no
+// limit.
+func ItineraryRows(hops []Hop, maxRows int) [][2]string {
+	var rows [][2]string
+	for i, h := range hops {
+		if maxRows > 0 && len(rows) == maxRows-1 && len(hops)-i > 1 {
+			rows = append(rows, [2]string{fmt.Sprintf("+ %d more", len(hops)-i), ""})
+			break
+		}
+
+		duration := fmt.Sprintf("%.3fs", h.Seconds)
+		if h.Skipped {
+			duration = "skipped"
+		}
+		rows = append(rows, [2]string{h.Origin.Host.Name + " - " + h.Destination.Host.Name, duration})
+	}
+	return rows
+}
+
+func (s Style) drawer(img draw.Image, scale float64) (*font.Drawer, error) {
+	f, err := parsedFont(s.font())
+	if err != nil {
+		return nil, err
+	}
+	col, err := parseColor(s.color())
+	if err != nil {
+		return nil, err
+	}
+
+	// Faces keep a glyph cache that isn't safe to share between routes, so
+	// every drawing gets its own. Parsing the font is the slow part.
+	return &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(col),
+		Face: truetype.NewFace(f, &truetype.Options{Size: s.size() * scale}),
+	}, nil
+}
+
+func drawString(d *font.Drawer, s string, x, y int) {
+	d.Dot = fixed.P(x, y)
+	d.DrawString(s)
+}
+
+// align returns where a line starts to be aligned within width from x, or
+// of x if there is no width.
+func align(d *font.Drawer, line string, x, width int, alignment string) int {
+	w := d.MeasureString(line).Ceil()
+	switch alignment {
+	case "center":
+		if width > 0 {
+			return x + (width-w)/2
+		}
+		return x - w/2
+	case "right":
+		if width > 0 {
+			return x + width - w
+		}
+		return x - w
+	}
+	return x
+}
+
+// wrap breaks text into lines no wider than width, between words. A word
+// that is wider than width on its own gets a line to itself. Line breaks in
+// the text are kept.
+func wrap(d *font.Drawer, text string, width int) []string {
+	if width <= 0 {
+		return strings.Split(text, "\n")
+	}
+
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			next := word
+			if line != "" {
+				next = line + " " + word
+			}
+			if line != "" && d.MeasureString(next).Ceil() > width {
+				lines = append(lines, line)
+				next = word
+			}
+			line = next
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+var (
+	fontsMu sync.Mutex
+	// fontFiles are the fonts that can be used, by name.
+	fontFiles = map[string][]byte{
+		"goregular":    goregular.TTF,
+		"gobold":       gobold.TTF,
+		"goitalic":     goitalic.TTF,
+		"gobolditalic": gobolditalic.TTF,
+		"gomono":       gomono.TTF,
+		"gomonobold":   gomonobold.TTF,
+		"gomonoitalic": gomonoitalic.TTF,
+	}
+	// fonts are the fonts that have been parsed.
+	fonts = make(map[string]*truetype.Font)
+)
+
+// parsedFont returns the named font, parsing it the first time it is asked
+// for.
+func parsedFont(name string) (*truetype.Font, error) {
+	fontsMu.Lock()
+	defer fontsMu.Unlock()
+
+	if f, ok := fonts[name]; ok {
+		return f, nil
+	}
+
+	b, ok := fontFiles[name]
+	if !ok {
+		return nil, fmt.Errorf("font '%s' does not exist", name)
+	}
+	f, err := truetype.Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse font '%s': %v", name, err)
+	}
+	fonts[name] = f
+	return f, nil
+}
+
+// loadFonts makes the .ttf files in imagePath available to templates, by
+// their names without the extension.
+func loadFonts(imagePath string) error {
+	files, err := filepath.Glob(filepath.Join(imagePath, "*.ttf"))
+	if err != nil {
+		return err
+	}
+
+	fontsMu.Lock()
+	defer fontsMu.Unlock()
+
+	for _, path := range files {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read font '%s': %v", path, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		fontFiles[name] = b
+		delete(fonts, name)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Package stats folds the hops of completed routes into statistics for every
+// link between two zones, so that it is easy to see how fast a link usually
+// is, and when it got slower.
+package stats
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+// Link is the statistics for hops from one zone to another. Times are in
+// seconds. They only cover the hops that were made since Since, since the
+// history they are worked out from only goes back so far.
+type Link struct {
+	Origin      string    `json:"origin"`
+	Destination string    `json:"destination"`
+	Count       int       `json:"count"`
+	Skipped     int       `json:"skipped,omitempty"`
+	Mean        float64   `json:"mean"`
+	P50         float64   `json:"p50"`
+	P95         float64   `json:"p95"`
+	P99         float64   `json:"p99"`
+	LastSeen    time.Time `json:"lastseen"`
+	Since       time.Time `json:"since"`
+}
+
+// Links returns the statistics for every link that appears in hops, sorted
+// by origin and then destination.
+func Links(hops []route.Hop) []Link {
+	type key struct{ o, d string }
+	samples := make(map[key][]float64)
+	links := make(map[key]*Link)
+	since := Since(hops)
+
+	for _, h := range hops {
+		k := key{h.Origin.Host.Name, h.Destination.Host.Name}
+		if k.o == "" || k.d == "" {
+			continue
+		}
+
+		l, ok := links[k]
+		if !ok {
+			l = &Link{Origin: k.o, Destination: k.d, Since: since}
+			links[k] = l
+		}
+
+		if h.Skipped {
+			l.Skipped++
+			continue
+		}
+
+		samples[k] = append(samples[k], h.Seconds)
+		if h.Destination.In.After(l.LastSeen) {
+			l.LastSeen = h.Destination.In
+		}
+	}
+
+	var result []Link
+	for k, l := range links {
+		s := samples[k]
+		sort.Float64s(s)
+
+		l.Count = len(s)
+		l.Mean = mean(s)
+		l.P50 = percentile(s, 50)
+		l.P95 = percentile(s, 95)
+		l.P99 = percentile(s, 99)
+		result = append(result, *l)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Origin != result[j].Origin {
+			return result[i].Origin < result[j].Origin
+		}
+		return result[i].Destination < result[j].Destination
+	})
+	return result
+}
+
+// Since returns when the first of hops was made, which is as far back as
+// statistics worked out from them go.
+func Since(hops []route.Hop) time.Time {
+	var since time.Time
+	for _, h := range hops {
+		in := h.Destination.In
+		if !in.IsZero() && (since.IsZero() || in.Before(since)) {
+			since = in
+		}
+	}
+	return since
+}
+
+func mean(s []float64) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range s {
+		sum += v
+	}
+	return sum / float64(len(s))
+}
+
+// percentile returns the nearest rank percentile of sorted samples.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Matrix lays the links out as a grid of zones. Cells for links that have
+// never been measured are null.
+type Matrix struct {
+	Zones []string  `json:"zones"`
+	Since time.Time `json:"since"`
+	// Mean and P50 are indexed by origin and then destination, in the order
+	// of Zones.
+	Mean [][]*float64 `json:"mean"`
+	P50  [][]*float64 `json:"p50"`
+}
+
+// NewMatrix arranges links into a Matrix.
+func NewMatrix(links []Link) Matrix {
+	index := make(map[string]int)
+	var zones []string
+	for _, l := range links {
+		for _, z := range []string{l.Origin, l.Destination} {
+			if _, ok := index[z]; !ok {
+				index[z] = 0
+				zones = append(zones, z)
+			}
+		}
+	}
+	sort.Strings(zones)
+	for i, z := range zones {
+		index[z] = i
+	}
+
+	m := Matrix{
+		Zones: zones,
+		Since: earliest(links),
+		Mean:  grid(len(zones)),
+		P50:   grid(len(zones)),
+	}
+	for _, l := range links {
+		if l.Count == 0 {
+			continue
+		}
+		o, d := index[l.Origin], index[l.Destination]
+		mean, p50 := l.Mean, l.P50
+		m.Mean[o][d] = &mean
+		m.P50[o][d] = &p50
+	}
+	return m
+}
+
+func grid(n int) [][]*float64 {
+	g := make([][]*float64, n)
+	for i := range g {
+		g[i] = make([]*float64, n)
+	}
+	return g
+}
+
+// earliest returns the earliest Since of links.
+func earliest(links []Link) time.Time {
+	var result time.Time
+	for _, l := range links {
+		if !l.Since.IsZero() && (result.IsZero() || l.Since.Before(result)) {
+			result = l.Since
+		}
+	}
+	return result
+}
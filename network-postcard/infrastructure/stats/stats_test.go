@@ -0,0 +1,98 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tpryan/gcprelay/infrastructure/route"
+)
+
+func TestLinks(t *testing.T) {
+	var hops []route.Hop
+	for i := 1; i <= 100; i++ {
+		hops = append(hops, hop("asia-east1-a", "us-west1-a", i, float64(i)/100))
+	}
+	hops = append(hops, hop("us-west1-a", "asia-east1-a", 1, 0.5))
+	skipped := hop("us-west1-a", "europe-west1-b", 2, 0)
+	skipped.Skipped = true
+	hops = append(hops, skipped)
+
+	links := Links(hops)
+	if len(links) != 3 {
+		t.Fatalf("got %d links, want 3: %+v", len(links), links)
+	}
+
+	l := links[0]
+	if l.Origin != "asia-east1-a" || l.Destination != "us-west1-a" {
+		t.Fatalf("links are out of order: %+v", links)
+	}
+
+	cases := []struct {
+		label string
+		got   float64
+		want  float64
+	}{
+		{"mean", l.Mean, 0.505},
+		{"p50", l.P50, 0.5},
+		{"p95", l.P95, 0.95},
+		{"p99", l.P99, 0.99},
+	}
+	for _, c := range cases {
+		if diff := c.got - c.want; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("%s got %f, want %f", c.label, c.got, c.want)
+		}
+	}
+
+	if l.Count != 100 {
+		t.Errorf("got count %d, want 100", l.Count)
+	}
+	if want := time.Date(2017, 12, 17, 1, 0, 100, 0, time.UTC); !l.LastSeen.Equal(want) {
+		t.Errorf("got last seen %v, want %v", l.LastSeen, want)
+	}
+
+	for _, l := range links {
+		if want := time.Date(2017, 12, 17, 1, 0, 1, 0, time.UTC); !l.Since.Equal(want) {
+			t.Errorf("%s -> %s got since %v, want %v", l.Origin, l.Destination, l.Since, want)
+		}
+	}
+
+	if s := links[2]; s.Destination != "europe-west1-b" || s.Skipped != 1 || s.Count != 0 {
+		t.Errorf("skipped hop was counted: %+v", s)
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	links := Links([]route.Hop{
+		hop("asia-east1-a", "us-west1-a", 1, 0.1),
+		hop("us-west1-a", "europe-west1-b", 1, 0.2),
+	})
+
+	m := NewMatrix(links)
+	want := []string{"asia-east1-a", "europe-west1-b", "us-west1-a"}
+	if len(m.Zones) != len(want) {
+		t.Fatalf("got zones %v, want %v", m.Zones, want)
+	}
+	for i := range want {
+		if m.Zones[i] != want[i] {
+			t.Fatalf("got zones %v, want %v", m.Zones, want)
+		}
+	}
+
+	if m.Mean[0][2] == nil || *m.Mean[0][2] != 0.1 {
+		t.Errorf("asia-east1-a -> us-west1-a is missing from the matrix")
+	}
+	if m.Mean[2][0] != nil {
+		t.Errorf("us-west1-a -> asia-east1-a was never measured, got %f", *m.Mean[2][0])
+	}
+	if want := time.Date(2017, 12, 17, 1, 0, 1, 0, time.UTC); !m.Since.Equal(want) {
+		t.Errorf("got since %v, want %v", m.Since, want)
+	}
+}
+
+func hop(origin, destination string, second int, seconds float64) route.Hop {
+	return route.Hop{
+		Origin:      route.Node{Host: route.Host{Name: origin}},
+		Destination: route.Node{Host: route.Host{Name: destination}, In: time.Date(2017, 12, 17, 1, 0, second, 0, time.UTC)},
+		Seconds:     seconds,
+	}
+}
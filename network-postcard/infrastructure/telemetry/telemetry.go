@@ -0,0 +1,55 @@
+// Package telemetry sets up the tracing that follows a postcard around the
+// world. Every node adds its spans to the trace of the route, and sends them
+// to an OpenTelemetry collector over OTLP.
+package telemetry
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// ServiceName is what the relay nodes are called in traces.
+const ServiceName = "gcprelay"
+
+// Setup installs the W3C trace context propagator, and when endpoint is set,
+// a tracer provider that exports spans to the OTLP collector at endpoint.
+// Without an endpoint spans are still propagated between nodes, but not
+// recorded. The returned function flushes any spans that haven't been sent
+// yet, and should be called before the node exits.
+func Setup(ctx context.Context, node, endpoint string, insecure bool) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create otlp exporter: %v", err)
+	}
+
+	res := resource.NewSchemaless(
+		attribute.String("service.name", ServiceName),
+		attribute.String("service.instance.id", node),
+	)
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}